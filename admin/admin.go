@@ -0,0 +1,290 @@
+// Package admin serves an HTTP view of the groups of a process, listing their
+// running servers and letting operators inspect and stop them.
+//
+// The handler serves paths relative to where it is mounted:
+//
+//	GET  /                              groups and uptime
+//	GET  /groups/{kind}                 running servers of a group
+//	GET  /groups/{kind}/{id}            state of an identifier, as JSON
+//	POST /groups/{kind}/{id}/shutdown   shut down the running server
+//	POST /groups/{kind}/{id}/evict      evict the running server, if any
+//
+// To mount it under a prefix of an existing mux, strip the prefix:
+//
+//	mux.Handle("/admin/", http.StripPrefix("/admin", handler))
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	gosync "sync"
+	"time"
+
+	"github.com/hannahhoward/go-genserver/genserver"
+	"github.com/hannahhoward/go-genserver/group"
+)
+
+// errNotRunning is returned when shutting down an identifier without a
+// running server
+var errNotRunning = errors.New("no running server")
+
+// errBadID is returned for identifiers in paths that do not parse
+var errBadID = errors.New("invalid identifier")
+
+// Overview is the response to GET /
+type Overview struct {
+	Started time.Time      `json:"started"`
+	Uptime  string         `json:"uptime"`
+	Groups  []GroupSummary `json:"groups"`
+}
+
+// GroupSummary describes a group in the Overview
+type GroupSummary struct {
+	Kind    string `json:"kind"`
+	Running int    `json:"running"`
+}
+
+// GroupDetail is the response to GET /groups/{kind}
+type GroupDetail struct {
+	Kind    string   `json:"kind"`
+	Servers []Server `json:"servers"`
+}
+
+// Server describes a running server
+type Server struct {
+	ID       string `json:"id"`
+	Mailbox  int    `json:"mailbox"`
+	Messages uint64 `json:"messages"`
+	// LastMessage is nil until the server receives a message
+	LastMessage *time.Time `json:"last_message,omitempty"`
+	Started     time.Time  `json:"started"`
+	Uptime      string     `json:"uptime"`
+}
+
+// target is a group with its identifier and state types erased
+type target interface {
+	servers() []Server
+	state(ctx context.Context, id string) (any, error)
+	shutdown(ctx context.Context, id string) error
+	evict(ctx context.Context, id string) error
+}
+
+type groupTarget[ID fmt.Stringer, State any] struct {
+	group   *group.Group[ID, State]
+	parseID func(string) (ID, error)
+}
+
+func (t groupTarget[ID, State]) servers() []Server {
+	now := time.Now()
+	servers := []Server{}
+	for _, id := range t.group.Running() {
+		gs, ok := t.group.Server(id)
+		if !ok {
+			continue
+		}
+		stats := gs.Stats()
+		server := Server{
+			ID:       id.String(),
+			Mailbox:  stats.Mailbox,
+			Messages: stats.Messages,
+			Started:  stats.Started,
+			Uptime:   now.Sub(stats.Started).Round(time.Millisecond).String(),
+		}
+		if !stats.LastMessage.IsZero() {
+			server.LastMessage = &stats.LastMessage
+		}
+		servers = append(servers, server)
+	}
+	sort.Slice(servers, func(i, j int) bool { return servers[i].ID < servers[j].ID })
+	return servers
+}
+
+func (t groupTarget[ID, State]) parse(key string) (ID, error) {
+	id, err := t.parseID(key)
+	if err != nil {
+		return id, fmt.Errorf("%w %q: %s", errBadID, key, err)
+	}
+	return id, nil
+}
+
+// state asks the server for its state, as group.Get does, so inspecting a
+// stopped server starts it
+func (t groupTarget[ID, State]) state(ctx context.Context, key string) (any, error) {
+	id, err := t.parse(key)
+	if err != nil {
+		return nil, err
+	}
+	return t.group.GetContext(ctx, id)
+}
+
+func (t groupTarget[ID, State]) shutdown(ctx context.Context, key string) error {
+	id, err := t.parse(key)
+	if err != nil {
+		return err
+	}
+	gs, ok := t.group.Server(id)
+	if !ok {
+		return fmt.Errorf("%s: %w", key, errNotRunning)
+	}
+	return genserver.Shutdown(gs, genserver.Normal, func(State, genserver.ShutdownReason) error {
+		return nil
+	}, ctx.Done())
+}
+
+func (t groupTarget[ID, State]) evict(ctx context.Context, key string) error {
+	id, err := t.parse(key)
+	if err != nil {
+		return err
+	}
+	return t.group.Evict(ctx, id)
+}
+
+// Handler serves the admin view of the groups registered with it
+type Handler struct {
+	started time.Time
+
+	lock   gosync.RWMutex
+	groups map[string]target
+}
+
+// New returns a handler without groups
+func New() *Handler {
+	return &Handler{
+		started: time.Now(),
+		groups:  make(map[string]target),
+	}
+}
+
+// Register adds g to the handler under its kind. parseID turns the
+// identifiers in paths, which are ID.String(), back into identifiers.
+func Register[ID fmt.Stringer, State any](h *Handler, g *group.Group[ID, State], parseID func(string) (ID, error)) error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if _, ok := h.groups[g.Kind()]; ok {
+		return fmt.Errorf("group %s is already registered", g.Kind())
+	}
+	h.groups[g.Kind()] = groupTarget[ID, State]{g, parseID}
+	return nil
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var segments []string
+	for _, segment := range strings.Split(strings.Trim(r.URL.EscapedPath(), "/"), "/") {
+		if segment == "" {
+			continue
+		}
+		unescaped, err := url.PathUnescape(segment)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		segments = append(segments, unescaped)
+	}
+
+	if len(segments) == 0 {
+		h.overview(w, r)
+		return
+	}
+	if segments[0] != "groups" || len(segments) < 2 || len(segments) > 4 {
+		http.NotFound(w, r)
+		return
+	}
+	h.lock.RLock()
+	t, ok := h.groups[segments[1]]
+	h.lock.RUnlock()
+	if !ok {
+		http.Error(w, fmt.Sprintf("no group %s", segments[1]), http.StatusNotFound)
+		return
+	}
+	switch len(segments) {
+	case 2:
+		if !allow(w, r, http.MethodGet) {
+			return
+		}
+		writeJSON(w, GroupDetail{Kind: segments[1], Servers: t.servers()})
+	case 3:
+		if !allow(w, r, http.MethodGet) {
+			return
+		}
+		state, err := t.state(r.Context(), segments[2])
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJSON(w, state)
+	case 4:
+		var action func(context.Context, string) error
+		switch segments[3] {
+		case "shutdown":
+			action = t.shutdown
+		case "evict":
+			action = t.evict
+		default:
+			http.NotFound(w, r)
+			return
+		}
+		if !allow(w, r, http.MethodPost) {
+			return
+		}
+		if err := action(r.Context(), segments[2]); err != nil {
+			writeError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (h *Handler) overview(w http.ResponseWriter, r *http.Request) {
+	if !allow(w, r, http.MethodGet) {
+		return
+	}
+	h.lock.RLock()
+	overview := Overview{
+		Started: h.started,
+		Uptime:  time.Since(h.started).Round(time.Millisecond).String(),
+		Groups:  make([]GroupSummary, 0, len(h.groups)),
+	}
+	for kind, t := range h.groups {
+		overview.Groups = append(overview.Groups, GroupSummary{Kind: kind, Running: len(t.servers())})
+	}
+	h.lock.RUnlock()
+	sort.Slice(overview.Groups, func(i, j int) bool { return overview.Groups[i].Kind < overview.Groups[j].Kind })
+	writeJSON(w, overview)
+}
+
+// allow replies with 405 and reports false unless r uses method
+func allow(w http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method == method {
+		return true
+	}
+	w.Header().Set("Allow", method)
+	http.Error(w, fmt.Sprintf("%s not allowed", r.Method), http.StatusMethodNotAllowed)
+	return false
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("encoding response: %s", err), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, errBadID):
+		status = http.StatusBadRequest
+	case errors.Is(err, group.ErrNotFound), errors.Is(err, errNotRunning):
+		status = http.StatusNotFound
+	}
+	http.Error(w, err.Error(), status)
+}
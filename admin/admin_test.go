@@ -0,0 +1,143 @@
+package admin_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/hannahhoward/go-genserver/admin"
+	"github.com/hannahhoward/go-genserver/group"
+	"github.com/hannahhoward/go-genserver/store/memory"
+	"github.com/stretchr/testify/require"
+)
+
+type PrintableInt int
+
+func (p PrintableInt) String() string {
+	return strconv.Itoa(int(p))
+}
+
+func parseID(s string) (PrintableInt, error) {
+	i, err := strconv.Atoi(s)
+	return PrintableInt(i), err
+}
+
+type counter struct {
+	Current int
+}
+
+func add(c *counter, amt int) (int, error) {
+	c.Current += amt
+	return c.Current, nil
+}
+
+func get(t *testing.T, server *httptest.Server, path string, v any) {
+	response, err := http.Get(server.URL + path)
+	require.NoError(t, err)
+	defer response.Body.Close()
+	require.Equal(t, http.StatusOK, response.StatusCode)
+	require.NoError(t, json.NewDecoder(response.Body).Decode(v))
+}
+
+func status(t *testing.T, server *httptest.Server, method string, path string) int {
+	request, err := http.NewRequest(method, server.URL+path, nil)
+	require.NoError(t, err)
+	response, err := http.DefaultClient.Do(request)
+	require.NoError(t, err)
+	response.Body.Close()
+	return response.StatusCode
+}
+
+func TestHandler(t *testing.T) {
+	g := group.New[PrintableInt, counter]("counter", memory.NewStore[PrintableInt, counter]())
+	defer g.Stop(context.Background())
+	h := admin.New()
+	require.NoError(t, admin.Register(h, g, parseID))
+	require.Error(t, admin.Register(h, g, parseID))
+	mux := http.NewServeMux()
+	mux.Handle("/admin/", http.StripPrefix("/admin", h))
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	for _, id := range []PrintableInt{1, 2} {
+		_, err := group.Call(g, id, int(id)*10, add)
+		require.NoError(t, err)
+	}
+
+	var overview admin.Overview
+	get(t, server, "/admin/", &overview)
+	require.Equal(t, []admin.GroupSummary{{Kind: "counter", Running: 2}}, overview.Groups)
+	require.False(t, overview.Started.IsZero())
+
+	var detail admin.GroupDetail
+	get(t, server, "/admin/groups/counter", &detail)
+	require.Len(t, detail.Servers, 2)
+	first := detail.Servers[0]
+	require.Equal(t, "1", first.ID)
+	require.Equal(t, 0, first.Mailbox)
+	require.Equal(t, uint64(1), first.Messages)
+	require.NotNil(t, first.LastMessage)
+	require.WithinDuration(t, time.Now(), first.Started, time.Minute)
+
+	var state counter
+	get(t, server, "/admin/groups/counter/2", &state)
+	require.Equal(t, counter{20}, state)
+
+	testCases := map[string]struct {
+		method string
+		path   string
+		status int
+	}{
+		"unknown group":      {http.MethodGet, "/admin/groups/timer", http.StatusNotFound},
+		"unknown identifier": {http.MethodGet, "/admin/groups/counter/3", http.StatusNotFound},
+		"invalid identifier": {http.MethodGet, "/admin/groups/counter/x", http.StatusBadRequest},
+		"unknown action":     {http.MethodPost, "/admin/groups/counter/1/restart", http.StatusNotFound},
+		"get an action":      {http.MethodGet, "/admin/groups/counter/1/evict", http.StatusMethodNotAllowed},
+		"not running":        {http.MethodPost, "/admin/groups/counter/3/shutdown", http.StatusNotFound},
+	}
+	for testCase, data := range testCases {
+		t.Run(testCase, func(t *testing.T) {
+			require.Equal(t, data.status, status(t, server, data.method, data.path))
+		})
+	}
+
+	require.Equal(t, http.StatusNoContent, status(t, server, http.MethodPost, "/admin/groups/counter/1/shutdown"))
+	require.Equal(t, http.StatusNoContent, status(t, server, http.MethodPost, "/admin/groups/counter/2/evict"))
+	require.Eventually(t, func() bool {
+		return len(g.Running()) == 0
+	}, time.Second, time.Millisecond)
+	get(t, server, "/admin/groups/counter", &detail)
+	require.Empty(t, detail.Servers)
+	// stopped servers keep their state in the store, and start again to
+	// show it
+	get(t, server, "/admin/groups/counter/1", &state)
+	require.Equal(t, counter{10}, state)
+	require.Equal(t, []PrintableInt{1}, g.Running())
+}
+
+func TestStateContext(t *testing.T) {
+	g := group.New[PrintableInt, counter]("counter", memory.NewStore[PrintableInt, counter]())
+	defer g.Stop(context.Background())
+	h := admin.New()
+	require.NoError(t, admin.Register(h, g, parseID))
+	require.NoError(t, g.Begin(1, counter{}))
+	release := make(chan struct{})
+	defer close(release)
+	require.NoError(t, group.Cast(g, 1, 0, func(*counter, int) error {
+		<-release
+		return nil
+	}))
+
+	// the server is busy, so the request gives up when its context does
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	request := httptest.NewRequest(http.MethodGet, "/groups/counter/1", nil).WithContext(ctx)
+	recorder := httptest.NewRecorder()
+	h.ServeHTTP(recorder, request)
+	require.Equal(t, http.StatusInternalServerError, recorder.Code)
+	require.Contains(t, recorder.Body.String(), context.DeadlineExceeded.Error())
+}
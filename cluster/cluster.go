@@ -0,0 +1,458 @@
+// Package cluster tracks which nodes are members of a cluster, by gossiping
+// heartbeats between them over the remote package.
+//
+// Every node counts up its own heartbeat, and regularly exchanges the
+// heartbeats it knows of with a few random members. A member whose heartbeat
+// stops increasing is suspected after the suspect timeout, and presumed dead
+// after the failure timeout. Members that left are forgotten once another
+// failure timeout has passed. Nodes find each other through static seeds.
+package cluster
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"sort"
+	gosync "sync"
+	"time"
+
+	"github.com/hannahhoward/go-genserver/remote"
+)
+
+const (
+	defaultHeartbeatInterval = time.Second
+	defaultFanout            = 3
+	// gossipHandler is the name the gossip handler is registered under on
+	// the node
+	gossipHandler = "cluster.gossip"
+)
+
+type config struct {
+	seeds             []string
+	heartbeatInterval time.Duration
+	suspectTimeout    time.Duration
+	failureTimeout    time.Duration
+	fanout            int
+	eventHandlers     []EventHandler
+	remoteOptions     []remote.Option
+}
+
+type Option func(*config)
+
+// WithSeeds sets the addresses of nodes to contact when joining. A node keeps
+// contacting seeds it does not know to be alive, so the cluster heals once a
+// seed comes back.
+func WithSeeds(seeds ...string) Option {
+	return func(c *config) {
+		c.seeds = append(c.seeds, seeds...)
+	}
+}
+
+// WithHeartbeatInterval sets how often a node counts up its heartbeat and
+// gossips. The default is one second.
+func WithHeartbeatInterval(interval time.Duration) Option {
+	return func(c *config) {
+		c.heartbeatInterval = interval
+	}
+}
+
+// WithSuspectTimeout sets how long a member's heartbeat may stay the same
+// before it is suspected. The default is five heartbeat intervals.
+func WithSuspectTimeout(timeout time.Duration) Option {
+	return func(c *config) {
+		c.suspectTimeout = timeout
+	}
+}
+
+// WithFailureTimeout sets how long a member's heartbeat may stay the same
+// before it is presumed dead and leaves. The default is ten heartbeat
+// intervals.
+func WithFailureTimeout(timeout time.Duration) Option {
+	return func(c *config) {
+		c.failureTimeout = timeout
+	}
+}
+
+// WithFanout sets how many members a node gossips with each interval. The
+// default is 3.
+func WithFanout(fanout int) Option {
+	return func(c *config) {
+		c.fanout = fanout
+	}
+}
+
+// WithEventHandler registers a handler for membership events. It may be given
+// more than once to register several handlers.
+func WithEventHandler(handler EventHandler) Option {
+	return func(c *config) {
+		c.eventHandlers = append(c.eventHandlers, handler)
+	}
+}
+
+// WithRemoteOptions passes options to the clients gossiping with other nodes
+func WithRemoteOptions(options ...remote.Option) Option {
+	return func(c *config) {
+		c.remoteOptions = append(c.remoteOptions, options...)
+	}
+}
+
+// heartbeat is what nodes gossip about each member. Heartbeats start from
+// the time a node started, so a node that restarts at the same address
+// outranks what others remember of it.
+type heartbeat struct {
+	Count uint64 `json:"count"`
+	Left  bool   `json:"left,omitempty"`
+	// Age is how long before gossiping it the sender saw the count
+	// increase, so heartbeats relayed about dead members are not taken
+	// for signs of life. It is only set in gossip.
+	Age time.Duration `json:"age,omitempty"`
+}
+
+// member is what a node knows about another
+type member struct {
+	heartbeat
+	// updated is when the heartbeat last increased, by the local clock
+	updated time.Time
+	suspect bool
+	// left is when the member left, by the local clock
+	left time.Time
+}
+
+// Cluster is a node's view of the members of its cluster
+type Cluster struct {
+	self   string
+	config config
+
+	lock    gosync.Mutex
+	own     heartbeat
+	members map[string]*member
+	clients map[string]*remote.Client
+
+	startOnce gosync.Once
+	stopOnce  gosync.Once
+	done      chan struct{}
+	stopped   chan struct{}
+}
+
+// New returns the cluster membership of the node listening at address self.
+// It registers a gossip handler on node, which the caller serves and closes.
+// Gossip starts with Start.
+func New(self string, node *remote.Node, options ...Option) (*Cluster, error) {
+	c := config{
+		heartbeatInterval: defaultHeartbeatInterval,
+		fanout:            defaultFanout,
+	}
+	for _, option := range options {
+		option(&c)
+	}
+	if c.suspectTimeout <= 0 {
+		c.suspectTimeout = 5 * c.heartbeatInterval
+	}
+	if c.failureTimeout <= 0 {
+		c.failureTimeout = 10 * c.heartbeatInterval
+	}
+	cl := &Cluster{
+		self:    self,
+		config:  c,
+		own:     heartbeat{Count: uint64(time.Now().UnixNano())},
+		members: make(map[string]*member),
+		clients: make(map[string]*remote.Client),
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	err := remote.HandleCallFunc(node, gossipHandler, func(ctx context.Context, _ string, heartbeats map[string]heartbeat) (map[string]heartbeat, error) {
+		cl.merge(heartbeats)
+		return cl.heartbeats(), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return cl, nil
+}
+
+// Start starts gossiping, beginning with the seeds
+func (c *Cluster) Start() {
+	c.startOnce.Do(func() {
+		go c.loop()
+	})
+}
+
+func (c *Cluster) loop() {
+	defer close(c.stopped)
+	ticker := time.NewTicker(c.config.heartbeatInterval)
+	defer ticker.Stop()
+	for {
+		c.tick()
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// tick counts up the heartbeat, checks for failed members, and gossips
+func (c *Cluster) tick() {
+	now := time.Now()
+	var events []Event
+	c.lock.Lock()
+	c.own.Count++
+	for address, m := range c.members {
+		if m.Left {
+			// by now every member has heard of it leaving, or presumes it
+			// dead itself
+			if now.Sub(m.left) > c.config.failureTimeout {
+				delete(c.members, address)
+			}
+			continue
+		}
+		silent := now.Sub(m.updated)
+		switch {
+		case silent > c.config.failureTimeout:
+			m.Left = true
+			m.suspect = false
+			m.left = now
+			events = append(events, Event{Left, address, now})
+		case silent > c.config.suspectTimeout && !m.suspect:
+			m.suspect = true
+			events = append(events, Event{Suspected, address, now})
+		}
+	}
+	targets := c.targets()
+	c.lock.Unlock()
+	c.emit(events)
+	c.gossip(targets)
+}
+
+// targets picks up to fanout random members to gossip with, plus any seeds
+// not known to be alive. The caller holds c.lock.
+func (c *Cluster) targets() []string {
+	var alive []string
+	for address, m := range c.members {
+		if !m.Left {
+			alive = append(alive, address)
+		}
+	}
+	rand.Shuffle(len(alive), func(i, j int) { alive[i], alive[j] = alive[j], alive[i] })
+	if len(alive) > c.config.fanout {
+		alive = alive[:c.config.fanout]
+	}
+	targets := alive
+	for _, seed := range c.config.seeds {
+		if m, ok := c.members[seed]; seed != c.self && (!ok || m.Left) {
+			targets = append(targets, seed)
+		}
+	}
+	return targets
+}
+
+// gossip exchanges heartbeats with each of targets at once, and waits for
+// them to reply or time out
+func (c *Cluster) gossip(targets []string) {
+	heartbeats := c.heartbeats()
+	var wg gosync.WaitGroup
+	for _, target := range targets {
+		wg.Add(1)
+		go func(target string) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), c.config.heartbeatInterval)
+			defer cancel()
+			client, err := c.client(ctx, target)
+			if err != nil {
+				// unreachable members are left to the failure detector
+				return
+			}
+			reply, err := remote.CallContext[map[string]heartbeat, map[string]heartbeat](ctx, client, c.self, gossipHandler, heartbeats)
+			if err != nil {
+				c.forget(target, client, err)
+				return
+			}
+			c.merge(reply)
+		}(target)
+	}
+	wg.Wait()
+}
+
+// heartbeats returns the heartbeats this node knows, including its own
+func (c *Cluster) heartbeats() map[string]heartbeat {
+	now := time.Now()
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	heartbeats := make(map[string]heartbeat, len(c.members)+1)
+	for address, m := range c.members {
+		hb := m.heartbeat
+		hb.Age = now.Sub(m.updated)
+		heartbeats[address] = hb
+	}
+	heartbeats[c.self] = c.own
+	return heartbeats
+}
+
+// merge takes in heartbeats gossiped by another node. Only newer heartbeats
+// change anything, so members presumed dead here stay dead until they send
+// a heartbeat, while members that announced leaving are known to have left
+// everywhere. Heartbeats that stopped increasing over the failure timeout
+// ago are news of a dead member, so they never make it join or recover.
+func (c *Cluster) merge(heartbeats map[string]heartbeat) {
+	now := time.Now()
+	var events []Event
+	c.lock.Lock()
+	for address, hb := range heartbeats {
+		if address == c.self {
+			continue
+		}
+		silent := hb.Age
+		stale := silent > c.config.failureTimeout && !hb.Left
+		updated := now.Add(-silent)
+		hb.Age = 0
+		m, known := c.members[address]
+		if !known {
+			// members forgotten after leaving stay forgotten
+			if silent > c.config.failureTimeout {
+				continue
+			}
+			m = &member{heartbeat: hb, updated: updated}
+			c.members[address] = m
+			if hb.Left {
+				m.left = now
+			} else {
+				events = append(events, Event{Joined, address, now})
+			}
+			continue
+		}
+		if hb.Count <= m.Count || stale {
+			continue
+		}
+		switch {
+		case hb.Left && !m.Left:
+			m.left = now
+			events = append(events, Event{Left, address, now})
+		case !hb.Left && m.Left:
+			events = append(events, Event{Joined, address, now})
+		case !hb.Left && m.suspect && silent <= c.config.suspectTimeout:
+			m.suspect = false
+			events = append(events, Event{Recovered, address, now})
+		}
+		if hb.Left {
+			m.suspect = false
+		}
+		m.heartbeat = hb
+		m.updated = updated
+	}
+	c.lock.Unlock()
+	c.emit(events)
+}
+
+func (c *Cluster) emit(events []Event) {
+	for _, event := range events {
+		for _, handler := range c.config.eventHandlers {
+			handler(event)
+		}
+	}
+}
+
+// Members lists the addresses of the members, including this node and
+// suspected members, in order
+func (c *Cluster) Members() []string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	members := []string{c.self}
+	for address, m := range c.members {
+		if !m.Left {
+			members = append(members, address)
+		}
+	}
+	sort.Strings(members)
+	return members
+}
+
+// Leave stops gossiping, after announcing to every member that this node is
+// leaving, so they need not wait for the failure timeout
+func (c *Cluster) Leave(ctx context.Context) error {
+	c.lock.Lock()
+	c.own.Count++
+	c.own.Left = true
+	var targets []string
+	for address, m := range c.members {
+		if !m.Left {
+			targets = append(targets, address)
+		}
+	}
+	c.lock.Unlock()
+	c.stop()
+	heartbeats := c.heartbeats()
+	var errs []error
+	for _, target := range targets {
+		client, err := c.client(ctx, target)
+		if err == nil {
+			_, err = remote.CallContext[map[string]heartbeat, map[string]heartbeat](ctx, client, c.self, gossipHandler, heartbeats)
+		}
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	c.closeClients()
+	return errors.Join(errs...)
+}
+
+// Stop stops gossiping without telling anyone, so other members find out
+// through the failure detector
+func (c *Cluster) Stop() {
+	c.stop()
+	c.closeClients()
+}
+
+func (c *Cluster) stop() {
+	c.stopOnce.Do(func() {
+		close(c.done)
+	})
+	c.startOnce.Do(func() {
+		close(c.stopped)
+	})
+	<-c.stopped
+}
+
+// client returns a client connected to address
+func (c *Cluster) client(ctx context.Context, address string) (*remote.Client, error) {
+	c.lock.Lock()
+	client, ok := c.clients[address]
+	c.lock.Unlock()
+	if ok {
+		return client, nil
+	}
+	client, err := remote.Dial(ctx, address, c.config.remoteOptions...)
+	if err != nil {
+		return nil, err
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if existing, ok := c.clients[address]; ok {
+		client.Close()
+		return existing, nil
+	}
+	c.clients[address] = client
+	return client, nil
+}
+
+// forget drops client after its connection failed, so the next gossip with
+// address connects again
+func (c *Cluster) forget(address string, client *remote.Client, err error) {
+	if !errors.Is(err, remote.ErrClosed) {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.clients[address] == client {
+		client.Close()
+		delete(c.clients, address)
+	}
+}
+
+func (c *Cluster) closeClients() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for address, client := range c.clients {
+		client.Close()
+		delete(c.clients, address)
+	}
+}
@@ -0,0 +1,146 @@
+package cluster_test
+
+import (
+	"context"
+	"net"
+	gosync "sync"
+	"testing"
+	"time"
+
+	"github.com/hannahhoward/go-genserver/cluster"
+	"github.com/hannahhoward/go-genserver/registry"
+	"github.com/hannahhoward/go-genserver/remote"
+	"github.com/stretchr/testify/require"
+)
+
+// recorder keeps the events a node saw, by member
+type recorder struct {
+	lock   gosync.Mutex
+	events map[string][]cluster.EventKind
+}
+
+func (r *recorder) handle(event cluster.Event) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.events[event.Member] = append(r.events[event.Member], event.Kind)
+}
+
+func (r *recorder) kinds(member string) []cluster.EventKind {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return append([]cluster.EventKind(nil), r.events[member]...)
+}
+
+type testNode struct {
+	address  string
+	node     *remote.Node
+	cluster  *cluster.Cluster
+	recorder *recorder
+}
+
+// start starts a node on loopback, gossiping every few milliseconds
+func start(t *testing.T, seeds ...string) *testNode {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	n := &testNode{
+		address:  l.Addr().String(),
+		node:     remote.NewNode(registry.New()),
+		recorder: &recorder{events: make(map[string][]cluster.EventKind)},
+	}
+	n.cluster, err = cluster.New(n.address, n.node,
+		cluster.WithSeeds(seeds...),
+		cluster.WithHeartbeatInterval(10*time.Millisecond),
+		cluster.WithSuspectTimeout(150*time.Millisecond),
+		cluster.WithFailureTimeout(300*time.Millisecond),
+		cluster.WithEventHandler(n.recorder.handle))
+	require.NoError(t, err)
+	go n.node.Serve(l)
+	n.cluster.Start()
+	t.Cleanup(func() {
+		n.cluster.Stop()
+		n.node.Close()
+	})
+	return n
+}
+
+func members(nodes ...*testNode) []string {
+	addresses := make([]string, 0, len(nodes))
+	for _, n := range nodes {
+		addresses = append(addresses, n.address)
+	}
+	return addresses
+}
+
+func TestMembership(t *testing.T) {
+	seed := start(t)
+	a := start(t, seed.address)
+	b := start(t, seed.address)
+	all := []*testNode{seed, a, b}
+	for _, n := range all {
+		require.Eventually(t, func() bool {
+			return len(n.cluster.Members()) == 3
+		}, 5*time.Second, time.Millisecond)
+		require.ElementsMatch(t, members(all...), n.cluster.Members())
+	}
+	// a and b only know of each other through the seed
+	require.Equal(t, []cluster.EventKind{cluster.Joined}, a.recorder.kinds(b.address))
+
+	// b crashes, and the others detect it
+	b.cluster.Stop()
+	b.node.Close()
+	for _, n := range []*testNode{seed, a} {
+		require.Eventually(t, func() bool {
+			return len(n.cluster.Members()) == 2
+		}, 5*time.Second, time.Millisecond)
+		require.Equal(t, []cluster.EventKind{cluster.Joined, cluster.Suspected, cluster.Left}, n.recorder.kinds(b.address))
+	}
+
+	// a leaves, and tells the seed straight away
+	require.NoError(t, a.cluster.Leave(context.Background()))
+	require.Equal(t, []string{seed.address}, seed.cluster.Members())
+	require.Equal(t, []cluster.EventKind{cluster.Joined, cluster.Left}, seed.recorder.kinds(a.address))
+
+	// a new node at another address joins through the seed
+	c := start(t, seed.address)
+	require.Eventually(t, func() bool {
+		return len(seed.cluster.Members()) == 2 && len(c.cluster.Members()) == 2
+	}, 5*time.Second, time.Millisecond)
+	// c hears that a left, but never saw it join
+	require.Empty(t, c.recorder.kinds(a.address))
+}
+
+// gossiped is a heartbeat as nodes gossip it
+type gossiped struct {
+	Count uint64        `json:"count"`
+	Left  bool          `json:"left,omitempty"`
+	Age   time.Duration `json:"age,omitempty"`
+}
+
+func TestDeadMembers(t *testing.T) {
+	seed := start(t)
+	client, err := remote.Dial(context.Background(), seed.address)
+	require.NoError(t, err)
+	defer client.Close()
+	gossip := func(heartbeats map[string]gossiped) map[string]gossiped {
+		reply, err := remote.CallContext[map[string]gossiped, map[string]gossiped](context.Background(), client, "", "cluster.gossip", heartbeats)
+		require.NoError(t, err)
+		return reply
+	}
+
+	// a heartbeat relayed long after its member stopped is no sign of life
+	gossip(map[string]gossiped{"dead": {Count: 5, Age: time.Second}})
+	require.Empty(t, seed.recorder.kinds("dead"))
+	require.Equal(t, []string{seed.address}, seed.cluster.Members())
+
+	// a member that stops is forgotten a while after it leaves, and
+	// heartbeats still relayed about it do not bring it back
+	gossip(map[string]gossiped{"gone": {Count: 5}})
+	require.Equal(t, []cluster.EventKind{cluster.Joined}, seed.recorder.kinds("gone"))
+	require.Eventually(t, func() bool {
+		_, known := gossip(nil)["gone"]
+		return !known
+	}, 5*time.Second, time.Millisecond)
+	gossip(map[string]gossiped{"gone": {Count: 5, Age: time.Second}})
+	require.Equal(t, []cluster.EventKind{cluster.Joined, cluster.Suspected, cluster.Left}, seed.recorder.kinds("gone"))
+	require.Equal(t, []string{seed.address}, seed.cluster.Members())
+}
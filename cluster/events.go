@@ -0,0 +1,51 @@
+package cluster
+
+import (
+	"fmt"
+	"time"
+)
+
+// EventKind identifies a change in what a node knows about a member
+type EventKind uint64
+
+const (
+	// Joined means a member was seen for the first time, or again after it
+	// left
+	Joined EventKind = iota
+	// Left means a member announced it is leaving, or sent no heartbeat for
+	// the failure timeout and is presumed dead
+	Left
+	// Suspected means a member sent no heartbeat for the suspect timeout. It
+	// is still a member until it leaves.
+	Suspected
+	// Recovered means a suspected member sent a heartbeat again
+	Recovered
+)
+
+func (k EventKind) String() string {
+	switch k {
+	case Joined:
+		return "joined"
+	case Left:
+		return "left"
+	case Suspected:
+		return "suspected"
+	case Recovered:
+		return "recovered"
+	default:
+		return fmt.Sprintf("EventKind(%d)", uint64(k))
+	}
+}
+
+// Event describes a change of a single member
+type Event struct {
+	Kind EventKind
+	// Member is the address of the member
+	Member string
+	Time   time.Time
+}
+
+// EventHandler receives membership events. It is called synchronously from
+// the goroutine that noticed the change, without holding any lock of the
+// cluster, so it may call Members.
+type EventHandler func(Event)
@@ -0,0 +1,166 @@
+// Package codec turns states into bytes for persistent stores, and back
+package codec
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// Codec encodes and decodes values of a single type
+type Codec[T any] interface {
+	// Name identifies the codec in the header of versioned blobs
+	Name() string
+	Marshal(v T) ([]byte, error)
+	Unmarshal(data []byte, v *T) error
+}
+
+type jsonCodec[T any] struct{}
+
+// JSON encodes values with encoding/json
+func JSON[T any]() Codec[T] {
+	return jsonCodec[T]{}
+}
+
+func (jsonCodec[T]) Name() string {
+	return "json"
+}
+
+func (jsonCodec[T]) Marshal(v T) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec[T]) Unmarshal(data []byte, v *T) error {
+	return json.Unmarshal(data, v)
+}
+
+type gobCodec[T any] struct{}
+
+// Gob encodes values with encoding/gob
+func Gob[T any]() Codec[T] {
+	return gobCodec[T]{}
+}
+
+func (gobCodec[T]) Name() string {
+	return "gob"
+}
+
+func (gobCodec[T]) Marshal(v T) ([]byte, error) {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(v)
+	return buf.Bytes(), err
+}
+
+func (gobCodec[T]) Unmarshal(data []byte, v *T) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+// magic starts every versioned blob
+const magic = 0xc0
+
+// ErrNoHeader is returned when decoding a blob without a versioned header
+var ErrNoHeader = errors.New("blob has no codec header")
+
+// Header records which codec, at which format version, produced a blob
+type Header struct {
+	Codec   string
+	Version uint64
+}
+
+// ReadHeader returns the header of a versioned blob, and the encoded value
+// that follows it
+func ReadHeader(data []byte) (Header, []byte, error) {
+	if len(data) == 0 || data[0] != magic {
+		return Header{}, nil, ErrNoHeader
+	}
+	nameLen, n := binary.Uvarint(data[1:])
+	if n <= 0 || uint64(len(data)-1-n) < nameLen {
+		return Header{}, nil, fmt.Errorf("malformed codec header")
+	}
+	rest := data[1+n:]
+	header := Header{Codec: string(rest[:nameLen])}
+	rest = rest[nameLen:]
+	header.Version, n = binary.Uvarint(rest)
+	if n <= 0 {
+		return Header{}, nil, fmt.Errorf("malformed codec header")
+	}
+	return header, rest[n:], nil
+}
+
+// versionedCodec prefixes every blob with a Header, so stored data says how
+// to read it back
+type versionedCodec[T any] struct {
+	version    uint64
+	codec      Codec[T]
+	codecs     map[string]Codec[T]
+	migrations *Migrations
+}
+
+// Versioned returns a codec that encodes with codec, and tags each blob with
+// the codec's name and version. It decodes blobs from codec and from any of
+// decoders, so a store can switch codecs without rewriting its data. Blobs
+// with a version newer than version are rejected.
+func Versioned[T any](version uint64, codec Codec[T], decoders ...Codec[T]) Codec[T] {
+	codecs := make(map[string]Codec[T], len(decoders)+1)
+	for _, decoder := range decoders {
+		codecs[decoder.Name()] = decoder
+	}
+	codecs[codec.Name()] = codec
+	return &versionedCodec[T]{version: version, codec: codec, codecs: codecs}
+}
+
+func (vc *versionedCodec[T]) Name() string {
+	return vc.codec.Name()
+}
+
+func (vc *versionedCodec[T]) Marshal(v T) ([]byte, error) {
+	name := vc.codec.Name()
+	buf := make([]byte, 0, 1+2*binary.MaxVarintLen64+len(name))
+	buf = append(buf, magic)
+	buf = binary.AppendUvarint(buf, uint64(len(name)))
+	buf = append(buf, name...)
+	buf = binary.AppendUvarint(buf, vc.version)
+	payload, err := vc.codec.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return append(buf, payload...), nil
+}
+
+func (vc *versionedCodec[T]) Unmarshal(data []byte, v *T) error {
+	header, payload, err := ReadHeader(data)
+	if err != nil {
+		return err
+	}
+	if header.Version > vc.version {
+		return fmt.Errorf("blob version %d is newer than %d", header.Version, vc.version)
+	}
+	codec, ok := vc.codecs[header.Codec]
+	if !ok {
+		return fmt.Errorf("no codec %q to decode blob", header.Codec)
+	}
+	if vc.migrations != nil && header.Version < vc.version {
+		payload, err = vc.migrations.migrate(payload, header.Version, vc.version)
+		if err != nil {
+			return err
+		}
+	}
+	return codec.Unmarshal(payload, v)
+}
+
+// For returns c as a codec for T, or versioned JSON when c is nil. Stores
+// use it to accept a codec through options that are not generic.
+func For[T any](c any) (Codec[T], error) {
+	if c == nil {
+		return Versioned(1, JSON[T]()), nil
+	}
+	typed, ok := c.(Codec[T])
+	if !ok {
+		var zero T
+		return nil, fmt.Errorf("codec %T does not encode %T", c, zero)
+	}
+	return typed, nil
+}
@@ -0,0 +1,57 @@
+package codec_test
+
+import (
+	"testing"
+
+	"github.com/hannahhoward/go-genserver/codec"
+	"github.com/stretchr/testify/require"
+)
+
+type state struct {
+	Count int
+	Names []string
+}
+
+func TestCodecs(t *testing.T) {
+	testCases := map[string]codec.Codec[state]{
+		"json":           codec.JSON[state](),
+		"gob":            codec.Gob[state](),
+		"versioned json": codec.Versioned(1, codec.JSON[state]()),
+		"versioned gob":  codec.Versioned(1, codec.Gob[state]()),
+	}
+	for testCase, c := range testCases {
+		t.Run(testCase, func(t *testing.T) {
+			data, err := c.Marshal(state{3, []string{"a", "b"}})
+			require.NoError(t, err)
+			var decoded state
+			require.NoError(t, c.Unmarshal(data, &decoded))
+			require.Equal(t, state{3, []string{"a", "b"}}, decoded)
+		})
+	}
+}
+
+func TestVersioned(t *testing.T) {
+	old := codec.Versioned(1, codec.JSON[state]())
+	data, err := old.Marshal(state{Count: 1})
+	require.NoError(t, err)
+	header, _, err := codec.ReadHeader(data)
+	require.NoError(t, err)
+	require.Equal(t, codec.Header{Codec: "json", Version: 1}, header)
+
+	// a newer format reads blobs written by an older codec and version
+	current := codec.Versioned(2, codec.Gob[state](), codec.JSON[state]())
+	var decoded state
+	require.NoError(t, current.Unmarshal(data, &decoded))
+	require.Equal(t, state{Count: 1}, decoded)
+	data, err = current.Marshal(state{Count: 2})
+	require.NoError(t, err)
+	header, _, err = codec.ReadHeader(data)
+	require.NoError(t, err)
+	require.Equal(t, codec.Header{Codec: "gob", Version: 2}, header)
+
+	// but an older format refuses blobs it does not know how to read
+	require.Error(t, old.Unmarshal(data, &decoded))
+	untagged, err := codec.JSON[state]().Marshal(state{})
+	require.NoError(t, err)
+	require.ErrorIs(t, old.Unmarshal(untagged, &decoded), codec.ErrNoHeader)
+}
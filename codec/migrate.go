@@ -0,0 +1,87 @@
+package codec
+
+import (
+	"fmt"
+)
+
+// Migration upgrades an encoded value from one schema version to the next.
+// It receives and returns the payload of a blob, encoded by the codec named in
+// the blob's header.
+type Migration func(payload []byte) ([]byte, error)
+
+// Migrations is a registry of migrations keyed by the schema version they
+// upgrade from
+type Migrations struct {
+	steps map[uint64]Migration
+}
+
+// NewMigrations returns an empty registry
+func NewMigrations() *Migrations {
+	return &Migrations{steps: make(map[uint64]Migration)}
+}
+
+// Register adds the migration from schema version from to from+1. It panics if
+// a migration from that version is already registered.
+func (m *Migrations) Register(from uint64, migration Migration) *Migrations {
+	if _, ok := m.steps[from]; ok {
+		panic(fmt.Sprintf("codec: migration from version %d registered twice", from))
+	}
+	m.steps[from] = migration
+	return m
+}
+
+// MigrationError is returned when decoding a blob that could not be upgraded
+// to the current schema version
+type MigrationError struct {
+	From uint64
+	To   uint64
+	Err  error
+}
+
+func (me MigrationError) Error() string {
+	return fmt.Sprintf("migrating from schema version %d to %d: %s", me.From, me.To, me.Err)
+}
+
+func (me MigrationError) Unwrap() error {
+	return me.Err
+}
+
+// migrate applies migrations in order until payload is at version to
+func (m *Migrations) migrate(payload []byte, from uint64, to uint64) ([]byte, error) {
+	var err error
+	for version := from; version < to; version++ {
+		step, ok := m.steps[version]
+		if !ok {
+			return nil, MigrationError{version, version + 1, fmt.Errorf("no migration registered")}
+		}
+		payload, err = step(payload)
+		if err != nil {
+			return nil, MigrationError{version, version + 1, err}
+		}
+	}
+	return payload, nil
+}
+
+// Migrating is like Versioned, but blobs written at an older version are
+// upgraded with migrations before they are decoded, so codec only ever decodes
+// the current schema
+func Migrating[T any](version uint64, codec Codec[T], migrations *Migrations, decoders ...Codec[T]) Codec[T] {
+	vc := Versioned(version, codec, decoders...).(*versionedCodec[T])
+	vc.migrations = migrations
+	return vc
+}
+
+// Outdated reports whether data should be written back by c, because it was
+// encoded at an older schema version or with another codec than c encodes
+// with. It is false for codecs that do not write versioned blobs.
+func Outdated[T any](c Codec[T], data []byte) bool {
+	vc, ok := c.(*versionedCodec[T])
+	if !ok {
+		return false
+	}
+	header, _, err := ReadHeader(data)
+	if err != nil {
+		return false
+	}
+	return header.Version < vc.version || header.Codec != vc.codec.Name()
+}
@@ -0,0 +1,84 @@
+package codec_test
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/hannahhoward/go-genserver/codec"
+	"github.com/stretchr/testify/require"
+)
+
+type stateV1 struct {
+	Count int
+}
+
+type stateV3 struct {
+	Total int
+	Unit  string
+}
+
+func migrations() *codec.Migrations {
+	return codec.NewMigrations().
+		// v2 renamed Count to Total
+		Register(1, func(payload []byte) ([]byte, error) {
+			var v map[string]any
+			if err := json.Unmarshal(payload, &v); err != nil {
+				return nil, err
+			}
+			v["Total"] = v["Count"]
+			delete(v, "Count")
+			return json.Marshal(v)
+		}).
+		// v3 added Unit
+		Register(2, func(payload []byte) ([]byte, error) {
+			var v map[string]any
+			if err := json.Unmarshal(payload, &v); err != nil {
+				return nil, err
+			}
+			v["Unit"] = "items"
+			return json.Marshal(v)
+		})
+}
+
+func TestMigrations(t *testing.T) {
+	data, err := codec.Versioned(1, codec.JSON[stateV1]()).Marshal(stateV1{Count: 4})
+	require.NoError(t, err)
+
+	current := codec.Migrating(3, codec.JSON[stateV3](), migrations())
+	require.True(t, codec.Outdated(current, data))
+	var decoded stateV3
+	require.NoError(t, current.Unmarshal(data, &decoded))
+	require.Equal(t, stateV3{Total: 4, Unit: "items"}, decoded)
+
+	upgraded, err := current.Marshal(decoded)
+	require.NoError(t, err)
+	require.False(t, codec.Outdated(current, upgraded))
+
+	testCases := map[string]struct {
+		migrations *codec.Migrations
+		from       uint64
+	}{
+		"missing migration": {
+			migrations: codec.NewMigrations().Register(2, func(payload []byte) ([]byte, error) { return payload, nil }),
+			from:       1,
+		},
+		"failed migration": {
+			migrations: codec.NewMigrations().
+				Register(1, func(payload []byte) ([]byte, error) { return payload, nil }).
+				Register(2, func(payload []byte) ([]byte, error) { return nil, errors.New("bad state") }),
+			from: 2,
+		},
+	}
+	for testCase, data := range testCases {
+		t.Run(testCase, func(t *testing.T) {
+			blob, err := codec.Versioned(1, codec.JSON[stateV1]()).Marshal(stateV1{Count: 4})
+			require.NoError(t, err)
+			var decoded stateV3
+			err = codec.Migrating(3, codec.JSON[stateV3](), data.migrations).Unmarshal(blob, &decoded)
+			var migrationErr codec.MigrationError
+			require.ErrorAs(t, err, &migrationErr)
+			require.Equal(t, data.from, migrationErr.From)
+		})
+	}
+}
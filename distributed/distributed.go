@@ -0,0 +1,364 @@
+// Package distributed spreads the identifiers of a group over several nodes,
+// so each identifier has its server on exactly one of them.
+//
+// Every node runs a Group over the same members and a Store they share.
+// Messages for an identifier go to the node that owns it on a consistent-hash
+// ring, either directly or through the remote package. When the members
+// change, nodes stop the servers of identifiers they no longer own and flush
+// the store, and the new owners load the states from the store. Stores that
+// cache states on each node, like cache.Store, also drop the states the node
+// no longer owns, so it does not serve stale copies if they move back.
+package distributed
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	gosync "sync"
+
+	"github.com/hannahhoward/go-genserver/genserver"
+	"github.com/hannahhoward/go-genserver/group"
+	"github.com/hannahhoward/go-genserver/remote"
+)
+
+type config[ID fmt.Stringer, State any] struct {
+	replicas      int
+	groupOptions  []group.Option[ID, State]
+	remoteOptions []remote.Option
+}
+
+type Option[ID fmt.Stringer, State any] func(*config[ID, State])
+
+// WithReplicas sets how many points each member has on the ring. Every node
+// must use the same number. The default is DefaultReplicas.
+func WithReplicas[ID fmt.Stringer, State any](replicas int) Option[ID, State] {
+	return func(c *config[ID, State]) {
+		c.replicas = replicas
+	}
+}
+
+// WithGroupOptions passes options to the local group
+func WithGroupOptions[ID fmt.Stringer, State any](options ...group.Option[ID, State]) Option[ID, State] {
+	return func(c *config[ID, State]) {
+		c.groupOptions = append(c.groupOptions, options...)
+	}
+}
+
+// WithRemoteOptions passes options to the clients connecting to other nodes,
+// for example remote.WithCallTimeout
+func WithRemoteOptions[ID fmt.Stringer, State any](options ...remote.Option) Option[ID, State] {
+	return func(c *config[ID, State]) {
+		c.remoteOptions = append(c.remoteOptions, options...)
+	}
+}
+
+// Invalidator is implemented by stores that cache states, such as
+// cache.Store. Nodes drop the cached states of identifiers they no longer
+// own, since their new owners change them behind the cache's back.
+type Invalidator[ID fmt.Stringer] interface {
+	// Invalidate writes back and drops every cached state whose identifier
+	// f returns true for
+	Invalidate(ctx context.Context, f func(id ID) bool) error
+}
+
+// Group routes messages for each identifier to the node that owns it. Nodes
+// are named by the address their remote.Node listens on.
+type Group[ID fmt.Stringer, State any] struct {
+	kind    string
+	self    string
+	store   group.Store[ID, State]
+	local   *group.Group[ID, State]
+	node    *remote.Node
+	parseID func(string) (ID, error)
+	config  config[ID, State]
+
+	lock  gosync.RWMutex
+	ring  *Ring
+	calls map[string]any
+	casts map[string]any
+
+	clientsLock gosync.Mutex
+	clients     map[string]*remote.Client
+}
+
+// New returns the group of kind on the node at address self. Handlers are
+// registered on node, which the caller serves and closes. parseID turns the
+// ID.String() of an identifier back into the identifier.
+func New[ID fmt.Stringer, State any](kind string, store group.Store[ID, State], node *remote.Node, self string, members []string, parseID func(string) (ID, error), options ...Option[ID, State]) *Group[ID, State] {
+	c := config[ID, State]{
+		replicas: DefaultReplicas,
+	}
+	for _, option := range options {
+		option(&c)
+	}
+	return &Group[ID, State]{
+		kind:    kind,
+		self:    self,
+		store:   store,
+		local:   group.New(kind, store, c.groupOptions...),
+		node:    node,
+		parseID: parseID,
+		config:  c,
+		ring:    NewRing(members, c.replicas),
+		calls:   make(map[string]any),
+		casts:   make(map[string]any),
+		clients: make(map[string]*remote.Client),
+	}
+}
+
+// Local returns the group holding the servers this node owns. Listings go
+// straight to the shared store, so they see every identifier. Get asks a
+// local server, starting one if needed, so only use it for identifiers this
+// node owns.
+func (d *Group[ID, State]) Local() *group.Group[ID, State] {
+	return d.local
+}
+
+// Owner returns the address of the node that owns id
+func (d *Group[ID, State]) Owner(id ID) string {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+	return d.ring.Owner(id.String())
+}
+
+// Members lists the addresses of the nodes in the ring, in order
+func (d *Group[ID, State]) Members() []string {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+	return d.ring.Members()
+}
+
+// SetMembers replaces the members of the ring. Servers for identifiers that
+// moved to another node are stopped, and the store is flushed if it buffers
+// writes, so their new owners load the latest states. Cached states of those
+// identifiers are dropped if the store is an Invalidator.
+func (d *Group[ID, State]) SetMembers(ctx context.Context, members []string) error {
+	ring := NewRing(members, d.config.replicas)
+	d.lock.Lock()
+	d.ring = ring
+	d.lock.Unlock()
+
+	for _, id := range d.local.Running() {
+		if ring.Owner(id.String()) == d.self {
+			continue
+		}
+		if err := d.local.Evict(ctx, id); err != nil {
+			return fmt.Errorf("SetMembers(%s): %w", d.kind, err)
+		}
+	}
+	if flusher, ok := d.store.(group.Flusher); ok {
+		if err := flusher.Flush(ctx); err != nil {
+			return fmt.Errorf("SetMembers(%s): flushing store: %w", d.kind, err)
+		}
+	}
+	if invalidator, ok := d.store.(Invalidator[ID]); ok {
+		err := invalidator.Invalidate(ctx, func(id ID) bool {
+			return ring.Owner(id.String()) != d.self
+		})
+		if err != nil {
+			return fmt.Errorf("SetMembers(%s): dropping cached states: %w", d.kind, err)
+		}
+	}
+
+	current := make(map[string]bool)
+	for _, member := range ring.Members() {
+		current[member] = true
+	}
+	d.clientsLock.Lock()
+	defer d.clientsLock.Unlock()
+	for member, client := range d.clients {
+		if !current[member] {
+			client.Close()
+			delete(d.clients, member)
+		}
+	}
+	return nil
+}
+
+// Stop stops the servers of this node, and closes its connections to others
+func (d *Group[ID, State]) Stop(ctx context.Context) error {
+	d.clientsLock.Lock()
+	for member, client := range d.clients {
+		client.Close()
+		delete(d.clients, member)
+	}
+	d.clientsLock.Unlock()
+	return d.local.Stop(ctx)
+}
+
+// settle stops the local server for id if this node no longer owns it. A
+// message routed here just before the members changed can start a server
+// after SetMembers stopped the others.
+func (d *Group[ID, State]) settle(id ID) {
+	if d.Owner(id) != d.self {
+		d.local.Evict(context.Background(), id)
+		if invalidator, ok := d.store.(Invalidator[ID]); ok {
+			invalidator.Invalidate(context.Background(), func(other ID) bool {
+				return other.String() == id.String()
+			})
+		}
+	}
+}
+
+// client returns a client connected to member
+func (d *Group[ID, State]) client(ctx context.Context, member string) (*remote.Client, error) {
+	d.clientsLock.Lock()
+	client, ok := d.clients[member]
+	d.clientsLock.Unlock()
+	if ok {
+		return client, nil
+	}
+	client, err := remote.Dial(ctx, member, d.config.remoteOptions...)
+	if err != nil {
+		return nil, fmt.Errorf("connecting to %s: %w", member, err)
+	}
+	d.clientsLock.Lock()
+	defer d.clientsLock.Unlock()
+	if existing, ok := d.clients[member]; ok {
+		client.Close()
+		return existing, nil
+	}
+	d.clients[member] = client
+	return client, nil
+}
+
+// forget drops client after its connection failed, so the next message to
+// member connects again
+func (d *Group[ID, State]) forget(member string, client *remote.Client, err error) {
+	if !errors.Is(err, remote.ErrClosed) {
+		return
+	}
+	d.clientsLock.Lock()
+	defer d.clientsLock.Unlock()
+	if d.clients[member] == client {
+		client.Close()
+		delete(d.clients, member)
+	}
+}
+
+// lookupHandler returns the handler registered under name, if it has type H
+func lookupHandler[H any, ID fmt.Stringer, State any](d *Group[ID, State], handlers map[string]any, name string) (H, error) {
+	d.lock.RLock()
+	registered, ok := handlers[name]
+	d.lock.RUnlock()
+	h, typed := registered.(H)
+	if !ok {
+		return h, fmt.Errorf("%s handler %s: %w", d.kind, name, remote.ErrUnknownHandler)
+	}
+	if !typed {
+		return h, fmt.Errorf("%s handler %s is a %T", d.kind, name, registered)
+	}
+	return h, nil
+}
+
+func (d *Group[ID, State]) register(handlers map[string]any, name string, h any) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if _, ok := handlers[name]; ok {
+		return fmt.Errorf("%s handler %s is already registered", d.kind, name)
+	}
+	handlers[name] = h
+	return nil
+}
+
+// remoteName is the name a handler is registered under on the node, so
+// groups of different kinds can share a node
+func (d *Group[ID, State]) remoteName(name string) string {
+	return d.kind + "." + name
+}
+
+// HandleCall registers handler under name, for calls from this node and
+// others. Every node registers the same handlers.
+func HandleCall[ID fmt.Stringer, State any, Message any, Return any](d *Group[ID, State], name string, handler genserver.CallHandler[State, Message, Return]) error {
+	if err := d.register(d.calls, name, handler); err != nil {
+		return err
+	}
+	return remote.HandleCallFunc(d.node, d.remoteName(name), func(ctx context.Context, target string, message Message) (Return, error) {
+		id, err := d.parseID(target)
+		if err != nil {
+			var empty Return
+			return empty, fmt.Errorf("parsing %s identifier %q: %w", d.kind, target, err)
+		}
+		// handled here even if this node's ring disagrees, so messages are
+		// not passed around while members change
+		return callLocal(ctx, d, id, message, handler)
+	})
+}
+
+// HandleCast registers handler under name, for casts from this node and
+// others. Every node registers the same handlers.
+func HandleCast[ID fmt.Stringer, State any, Message any](d *Group[ID, State], name string, handler genserver.CastHandler[State, Message]) error {
+	if err := d.register(d.casts, name, handler); err != nil {
+		return err
+	}
+	return remote.HandleCastFunc(d.node, d.remoteName(name), func(ctx context.Context, target string, message Message) error {
+		id, err := d.parseID(target)
+		if err != nil {
+			return fmt.Errorf("parsing %s identifier %q: %w", d.kind, target, err)
+		}
+		return castLocal(d, id, message, handler)
+	})
+}
+
+func callLocal[ID fmt.Stringer, State any, Message any, Return any](ctx context.Context, d *Group[ID, State], id ID, message Message, handler genserver.CallHandler[State, Message, Return]) (Return, error) {
+	defer d.settle(id)
+	reply, err := group.CallContext(ctx, d.local, id, message, handler)
+	var timeout genserver.CallTimeoutError[ID]
+	if errors.As(err, &timeout) {
+		return reply, fmt.Errorf("%w: %s", remote.ErrTimeout, err)
+	}
+	return reply, err
+}
+
+func castLocal[ID fmt.Stringer, State any, Message any](d *Group[ID, State], id ID, message Message, handler genserver.CastHandler[State, Message]) error {
+	defer d.settle(id)
+	return group.Cast(d.local, id, message, handler)
+}
+
+// Call calls the server for id with the call handler registered under name,
+// on whichever node owns id
+func Call[Return any, ID fmt.Stringer, State any, Message any](d *Group[ID, State], id ID, name string, message Message) (Return, error) {
+	return CallContext[Return](context.Background(), d, id, name, message)
+}
+
+// CallContext is like Call, but also stops waiting for a reply once ctx is
+// done
+func CallContext[Return any, ID fmt.Stringer, State any, Message any](ctx context.Context, d *Group[ID, State], id ID, name string, message Message) (Return, error) {
+	owner := d.Owner(id)
+	if owner == d.self {
+		h, err := lookupHandler[genserver.CallHandler[State, Message, Return]](d, d.calls, name)
+		if err != nil {
+			var empty Return
+			return empty, fmt.Errorf("Call(%s): %w", d.kind, err)
+		}
+		return callLocal(ctx, d, id, message, h)
+	}
+	client, err := d.client(ctx, owner)
+	if err != nil {
+		var empty Return
+		return empty, fmt.Errorf("Call(%s): %w", d.kind, err)
+	}
+	reply, err := remote.CallContext[Message, Return](ctx, client, id.String(), d.remoteName(name), message)
+	d.forget(owner, client, err)
+	return reply, err
+}
+
+// Cast casts to the server for id with the cast handler registered under
+// name, on whichever node owns id
+func Cast[ID fmt.Stringer, State any, Message any](d *Group[ID, State], id ID, name string, message Message) error {
+	owner := d.Owner(id)
+	if owner == d.self {
+		h, err := lookupHandler[genserver.CastHandler[State, Message]](d, d.casts, name)
+		if err != nil {
+			return fmt.Errorf("Cast(%s): %w", d.kind, err)
+		}
+		return castLocal(d, id, message, h)
+	}
+	client, err := d.client(context.Background(), owner)
+	if err != nil {
+		return fmt.Errorf("Cast(%s): %w", d.kind, err)
+	}
+	err = remote.Cast(client, id.String(), d.remoteName(name), message)
+	d.forget(owner, client, err)
+	return err
+}
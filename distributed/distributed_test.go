@@ -0,0 +1,199 @@
+package distributed_test
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"testing"
+
+	"github.com/hannahhoward/go-genserver/distributed"
+	"github.com/hannahhoward/go-genserver/group"
+	"github.com/hannahhoward/go-genserver/registry"
+	"github.com/hannahhoward/go-genserver/remote"
+	"github.com/hannahhoward/go-genserver/store/cache"
+	"github.com/hannahhoward/go-genserver/store/memory"
+	"github.com/stretchr/testify/require"
+)
+
+type PrintableInt int
+
+func (p PrintableInt) String() string {
+	return strconv.Itoa(int(p))
+}
+
+func parseID(s string) (PrintableInt, error) {
+	i, err := strconv.Atoi(s)
+	return PrintableInt(i), err
+}
+
+type counter struct {
+	Current int
+}
+
+func add(c *counter, amount int) (int, error) {
+	c.Current += amount
+	return c.Current, nil
+}
+
+func addCast(c *counter, amount int) error {
+	c.Current += amount
+	return nil
+}
+
+func TestRing(t *testing.T) {
+	members := []string{"a", "b", "c"}
+	ring := distributed.NewRing(members, 0)
+	reversed := distributed.NewRing([]string{"c", "b", "a", "a"}, 0)
+	require.Equal(t, members, reversed.Members())
+	owned := make(map[string]int)
+	for i := 0; i < 1000; i++ {
+		key := strconv.Itoa(i)
+		owner := ring.Owner(key)
+		require.Equal(t, owner, reversed.Owner(key))
+		owned[owner]++
+	}
+	for _, member := range members {
+		require.Greater(t, owned[member], 200, "member %s", member)
+	}
+
+	// removing a member only moves its keys
+	smaller := distributed.NewRing([]string{"a", "b"}, 0)
+	for i := 0; i < 1000; i++ {
+		key := strconv.Itoa(i)
+		if owner := ring.Owner(key); owner != "c" {
+			require.Equal(t, owner, smaller.Owner(key))
+		}
+	}
+	require.Equal(t, "", distributed.NewRing(nil, 0).Owner("a"))
+}
+
+// cluster starts count nodes on loopback, sharing a memory store
+func cluster(t *testing.T, count int) ([]*distributed.Group[PrintableInt, counter], []string) {
+	store := memory.NewStore[PrintableInt, counter]()
+	return clusterWith(t, count, func() group.Store[PrintableInt, counter] {
+		return store
+	})
+}
+
+// clusterWith starts count nodes on loopback, each with the store newStore
+// returns
+func clusterWith(t *testing.T, count int, newStore func() group.Store[PrintableInt, counter]) ([]*distributed.Group[PrintableInt, counter], []string) {
+	listeners := make([]net.Listener, count)
+	addresses := make([]string, count)
+	for i := range listeners {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		listeners[i] = l
+		addresses[i] = l.Addr().String()
+	}
+	groups := make([]*distributed.Group[PrintableInt, counter], count)
+	for i, l := range listeners {
+		node := remote.NewNode(registry.New())
+		g := distributed.New[PrintableInt, counter]("counter", newStore(), node, addresses[i], addresses, parseID)
+		require.NoError(t, distributed.HandleCall(g, "add", add))
+		require.NoError(t, distributed.HandleCast(g, "add", addCast))
+		served := make(chan error, 1)
+		go func(l net.Listener) {
+			served <- node.Serve(l)
+		}(l)
+		groups[i] = g
+		t.Cleanup(func() {
+			require.NoError(t, g.Stop(context.Background()))
+			node.Close()
+			require.NoError(t, <-served)
+		})
+	}
+	return groups, addresses
+}
+
+// running returns which node runs the server for each identifier, failing if
+// more than one does
+func running(t *testing.T, groups []*distributed.Group[PrintableInt, counter]) map[PrintableInt]int {
+	nodes := make(map[PrintableInt]int)
+	for i, g := range groups {
+		for _, id := range g.Local().Running() {
+			other, ok := nodes[id]
+			require.False(t, ok, "%s runs on nodes %d and %d", id, other, i)
+			nodes[id] = i
+		}
+	}
+	return nodes
+}
+
+func TestRouting(t *testing.T) {
+	groups, addresses := cluster(t, 3)
+	for id := PrintableInt(0); id < 30; id++ {
+		// each identifier is sent to from a different node
+		from := groups[int(id)%len(groups)]
+		total, err := distributed.Call[int](from, id, "add", 2)
+		require.NoError(t, err)
+		require.Equal(t, 2, total)
+		require.NoError(t, distributed.Cast(from, id, "add", 1))
+	}
+	nodes := running(t, groups)
+	require.Len(t, nodes, 30)
+	for id, node := range nodes {
+		require.Equal(t, addresses[node], groups[0].Owner(id))
+		total, err := distributed.Call[int](groups[0], id, "add", 0)
+		require.NoError(t, err)
+		require.Equal(t, 3, total)
+	}
+
+	_, err := distributed.Call[int](groups[0], 1, "subtract", 1)
+	require.ErrorIs(t, err, remote.ErrUnknownHandler)
+}
+
+func TestHandoff(t *testing.T) {
+	groups, addresses := cluster(t, 3)
+	for id := PrintableInt(0); id < 30; id++ {
+		_, err := distributed.Call[int](groups[0], id, "add", 1)
+		require.NoError(t, err)
+	}
+	require.NotEmpty(t, groups[2].Local().Running())
+
+	// the last node leaves, and every node learns of it
+	for _, g := range groups {
+		require.NoError(t, g.SetMembers(context.Background(), addresses[:2]))
+	}
+	require.Empty(t, groups[2].Local().Running())
+	for id := PrintableInt(0); id < 30; id++ {
+		total, err := distributed.Call[int](groups[1], id, "add", 1)
+		require.NoError(t, err)
+		require.Equal(t, 2, total, fmt.Sprintf("identifier %s", id))
+	}
+	nodes := running(t, groups)
+	require.Len(t, nodes, 30)
+	for _, node := range nodes {
+		require.NotEqual(t, 2, node)
+	}
+}
+
+func TestHandoffWithCaches(t *testing.T) {
+	backing := memory.NewStore[PrintableInt, counter]()
+	groups, addresses := clusterWith(t, 2, func() group.Store[PrintableInt, counter] {
+		store := cache.NewStore[PrintableInt, counter](backing, cache.WithFlushInterval(0))
+		t.Cleanup(func() { store.Close() })
+		return store
+	})
+	setMembers := func(members ...string) {
+		for _, g := range groups {
+			require.NoError(t, g.SetMembers(context.Background(), members))
+		}
+	}
+
+	// the identifier moves from the first node to the second and back, and
+	// the first node must not answer from its cache of the first move
+	setMembers(addresses[0])
+	total, err := distributed.Call[int](groups[0], 1, "add", 1)
+	require.NoError(t, err)
+	require.Equal(t, 1, total)
+	setMembers(addresses[1])
+	total, err = distributed.Call[int](groups[0], 1, "add", 1)
+	require.NoError(t, err)
+	require.Equal(t, 2, total)
+	setMembers(addresses[0])
+	total, err = distributed.Call[int](groups[0], 1, "add", 1)
+	require.NoError(t, err)
+	require.Equal(t, 3, total)
+}
@@ -0,0 +1,84 @@
+package distributed
+
+import (
+	"hash/fnv"
+	"sort"
+	"strconv"
+)
+
+// DefaultReplicas is how many points each member has on a ring, unless
+// configured otherwise. More points spread identifiers more evenly.
+const DefaultReplicas = 128
+
+// Ring assigns keys to members by consistent hashing, so changing the
+// members only moves the keys of the members that joined or left
+type Ring struct {
+	members []string
+	points  []uint32
+	owners  map[uint32]string
+}
+
+// NewRing returns a ring over members, with replicas points for each
+func NewRing(members []string, replicas int) *Ring {
+	if replicas <= 0 {
+		replicas = DefaultReplicas
+	}
+	r := &Ring{owners: make(map[uint32]string)}
+	seen := make(map[string]bool)
+	for _, member := range members {
+		if seen[member] {
+			continue
+		}
+		seen[member] = true
+		r.members = append(r.members, member)
+		for i := 0; i < replicas; i++ {
+			point := hash(member + "#" + strconv.Itoa(i))
+			// on a collision the member that sorts first wins, so every
+			// node builds the same ring whatever order it lists members in
+			if owner, ok := r.owners[point]; ok && owner < member {
+				continue
+			}
+			if _, ok := r.owners[point]; !ok {
+				r.points = append(r.points, point)
+			}
+			r.owners[point] = member
+		}
+	}
+	sort.Strings(r.members)
+	sort.Slice(r.points, func(i, j int) bool { return r.points[i] < r.points[j] })
+	return r
+}
+
+// hash spreads keys over the ring. FNV alone places similar keys, like
+// addresses differing in their port, close together, so its result is mixed
+// with the finalizer of MurmurHash3.
+func hash(key string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	x := h.Sum32()
+	x ^= x >> 16
+	x *= 0x85ebca6b
+	x ^= x >> 13
+	x *= 0xc2b2ae35
+	x ^= x >> 16
+	return x
+}
+
+// Members lists the members of the ring in order
+func (r *Ring) Members() []string {
+	return append([]string(nil), r.members...)
+}
+
+// Owner returns the member that owns key, or an empty string if the ring has
+// no members
+func (r *Ring) Owner(key string) string {
+	if len(r.points) == 0 {
+		return ""
+	}
+	point := hash(key)
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= point })
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.owners[r.points[i]]
+}
@@ -1,15 +1,19 @@
 package genserver
 
 import (
+	"context"
 	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"runtime"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/hannahhoward/go-genserver/mailbox"
+	"github.com/hannahhoward/go-genserver/metrics"
 	"github.com/hannahhoward/go-genserver/sync"
+	"github.com/hannahhoward/go-genserver/tracing"
 )
 
 type CallHandler[State any, Message any, Return any] func(*State, Message) (Return, error)
@@ -17,58 +21,203 @@ type CastHandler[State any, Message any] func(*State, Message) error
 type ShutdownHandler[State any] func(State, ShutdownReason) error
 type ShutdownReason uint64
 
+// ContextCallHandler is like CallHandler, but also receives the context of
+// the message. It carries the values of the context the message was sent
+// with, and the span of the message when the server traces.
+type ContextCallHandler[State any, Message any, Return any] func(context.Context, *State, Message) (Return, error)
+
+// ContextCastHandler is like CastHandler, but also receives the context of
+// the message, as ContextCallHandler does
+type ContextCastHandler[State any, Message any] func(context.Context, *State, Message) error
+
 const (
 	Normal ShutdownReason = iota
 
 	BrutalKill
+
+	// Expired stops the server of a state that no longer exists, without
+	// loading it or calling the shutdown handler. Groups use it when their
+	// store expires a state.
+	Expired
 )
 
+func (r ShutdownReason) String() string {
+	switch r {
+	case Normal:
+		return "normal"
+	case BrutalKill:
+		return "brutal kill"
+	case Expired:
+		return "expired"
+	default:
+		return fmt.Sprintf("ShutdownReason(%d)", uint64(r))
+	}
+}
+
+// Logger is the part of *slog.Logger servers log through. Servers log their
+// lifecycle at debug level, call timeouts and stops after failures as
+// warnings and failed messages as errors, with their kind and identifier.
+type Logger interface {
+	DebugContext(ctx context.Context, msg string, args ...any)
+	InfoContext(ctx context.Context, msg string, args ...any)
+	WarnContext(ctx context.Context, msg string, args ...any)
+	ErrorContext(ctx context.Context, msg string, args ...any)
+}
+
+var _ Logger = (*slog.Logger)(nil)
+
+// Envelope is what a server knows about a message besides its handler
+type Envelope struct {
+	// Context is the context the message was sent with
+	Context context.Context
+	// Sent is when the message was queued
+	Sent time.Time
+	// Operation is "call", "cast", "get" or "shutdown"
+	Operation string
+	Message   any
+}
+
+// HandlerFunc handles a message against the state. It returns the reply of a
+// call or get, and nil for other messages.
+type HandlerFunc[State any] func(ctx context.Context, s *State) (any, error)
+
+// Invocation describes a message an interceptor is handling
+type Invocation[ID fmt.Stringer] struct {
+	// Kind and ID identify the server
+	Kind string
+	ID   ID
+	Envelope
+}
+
+// Interceptor wraps the handling of every message a server receives,
+// including brutal kills, but not shutdowns for Expired, which skip handlers.
+// It calls next to continue the chain, and can inspect or replace what next
+// returns. Returning an error without calling next short-circuits the
+// message, which then fails as if its handler had. The reply of a call must
+// have the type its handler returns.
+// Interceptors run inside the state mutation, so they run again when a
+// message is retried after a conflict.
+type Interceptor[ID fmt.Stringer, State any] func(ctx context.Context, s *State, inv Invocation[ID], next HandlerFunc[State]) (any, error)
+
+// intercept runs a message through the interceptors of a server, or is nil
+// when the server has none
+type intercept[State any] func(ctx context.Context, s *State, env Envelope, next HandlerFunc[State]) (any, error)
+
+func (i intercept[State]) run(ctx context.Context, s *State, env Envelope, next HandlerFunc[State]) (any, error) {
+	if i == nil {
+		return next(ctx, s)
+	}
+	return i(ctx, s, env, next)
+}
+
+func newEnvelope(ctx context.Context, operation string, message any) Envelope {
+	return Envelope{Context: ctx, Sent: time.Now(), Operation: operation, Message: message}
+}
+
 type MessageHandler[State any] interface {
-	Handle(s *State) (func(), error)
+	// Handle processes the message against the state, returning a function
+	// that replies to the sender once the state change has been kept
+	Handle(ctx context.Context, s *State) (func(), error)
+	// Fail replies to the sender with an error when the message could not be
+	// processed, or its state change could not be kept
+	Fail(err error)
+	// Envelope describes the message
+	Envelope() Envelope
 }
 
 type CallMessageHandler[State any, Message any, Return any] struct {
+	env        Envelope
 	m          Message
-	returnChan chan<- Return
-	h          CallHandler[State, Message, Return]
+	returnChan chan<- callReturn[Return]
+	h          ContextCallHandler[State, Message, Return]
+	intercept  intercept[State]
+}
+
+type callReturn[Return any] struct {
+	r   Return
+	err error
 }
 
 type MessageReturner[Return any] struct {
 	r          Return
-	returnChan chan<- Return
+	returnChan chan<- callReturn[Return]
 }
 
 func (mr MessageReturner[Return]) Return() {
 	if mr.returnChan != nil {
-		mr.returnChan <- mr.r
+		mr.returnChan <- callReturn[Return]{r: mr.r}
+	}
+}
+
+func (m CallMessageHandler[State, Message, Return]) Handle(ctx context.Context, s *State) (func(), error) {
+	if m.intercept == nil {
+		r, err := m.h(ctx, s, m.m)
+		return MessageReturner[Return]{r, m.returnChan}.Return, err
+	}
+	reply, err := m.intercept(ctx, s, m.env, func(ctx context.Context, s *State) (any, error) {
+		return m.h(ctx, s, m.m)
+	})
+	if err != nil {
+		return nil, err
+	}
+	var r Return
+	if reply != nil {
+		var ok bool
+		if r, ok = reply.(Return); !ok {
+			return nil, fmt.Errorf("interceptor replied with %T to a %s expecting %T", reply, m.env.Operation, r)
+		}
 	}
+	return MessageReturner[Return]{r, m.returnChan}.Return, nil
+}
+
+func (m CallMessageHandler[State, Message, Return]) Fail(err error) {
+	m.returnChan <- callReturn[Return]{err: err}
 }
 
-func (m CallMessageHandler[State, Message, Return]) Handle(s *State) (func(), error) {
-	r, err := m.h(s, m.m)
-	return MessageReturner[Return]{r, m.returnChan}.Return, err
+func (m CallMessageHandler[State, Message, Return]) Envelope() Envelope {
+	return m.env
 }
 
 type CastMessageHandler[State any, Message any] struct {
-	m Message
-	h CastHandler[State, Message]
+	env       Envelope
+	m         Message
+	h         ContextCastHandler[State, Message]
+	intercept intercept[State]
 }
 
-func (m CastMessageHandler[State, Message]) Handle(s *State) (func(), error) {
-	err := m.h(s, m.m)
+func (m CastMessageHandler[State, Message]) Handle(ctx context.Context, s *State) (func(), error) {
+	_, err := m.intercept.run(ctx, s, m.env, func(ctx context.Context, s *State) (any, error) {
+		return nil, m.h(ctx, s, m.m)
+	})
 	return func() {}, err
 }
 
+func (m CastMessageHandler[State, Message]) Fail(err error) {}
+
+func (m CastMessageHandler[State, Message]) Envelope() Envelope {
+	return m.env
+}
+
 type ShutdownMessageHandler[State any] struct {
-	r ShutdownReason
-	h ShutdownHandler[State]
+	env       Envelope
+	r         ShutdownReason
+	h         ShutdownHandler[State]
+	intercept intercept[State]
 }
 
-func (m ShutdownMessageHandler[State]) Handle(s *State) (func(), error) {
-	err := m.h(*s, m.r)
+func (m ShutdownMessageHandler[State]) Handle(ctx context.Context, s *State) (func(), error) {
+	_, err := m.intercept.run(ctx, s, m.env, func(ctx context.Context, s *State) (any, error) {
+		return nil, m.h(*s, m.r)
+	})
 	return func() {}, err
 }
 
+func (m ShutdownMessageHandler[State]) Fail(err error) {}
+
+func (m ShutdownMessageHandler[State]) Envelope() Envelope {
+	return m.env
+}
+
 type StateMutatorFn[State any] func(s *State) (func(), error)
 
 type StateMutator[State any] func(StateMutatorFn[State]) (func(), error)
@@ -76,8 +225,13 @@ type StateMutator[State any] func(StateMutatorFn[State]) (func(), error)
 type genServerConfig[ID fmt.Stringer, State any] struct {
 	deadlockTimeout  time.Duration
 	deadlockCallback func(server *GenServer[ID, State], trace string)
+	failureCallback  func(server *GenServer[ID, State], err error)
+	conflictRetries  int
 	messagesPool     mailbox.Pool[MessageHandler[State]]
-	logger           *log.Logger
+	logger           Logger
+	metrics          metrics.Metrics
+	tracer           tracing.Tracer
+	interceptors     []Interceptor[ID, State]
 }
 
 // GenServer structure
@@ -87,11 +241,58 @@ type GenServer[ID fmt.Stringer, State any] struct {
 	stateMutator StateMutator[State]
 	messages     *mailbox.Mailbox[MessageHandler[State]]
 	terminated   chan struct{}
+	err          error
 	config       *genServerConfig[ID, State]
+	intercept    intercept[State]
+
+	// started, lastMessage and received are read by Stats while the server
+	// runs. The times are in Unix nanoseconds, and zero until they happen.
+	started     atomic.Int64
+	lastMessage atomic.Int64
+	received    atomic.Uint64
+}
+
+// Stats describes the activity of a server
+type Stats struct {
+	// Started is when the server started, or zero if it has not
+	Started time.Time
+	// LastMessage is when the server last received a message, or zero if it
+	// has not received any
+	LastMessage time.Time
+	// Messages is how many messages the server has received
+	Messages uint64
+	// Mailbox is how many messages are waiting to be received
+	Mailbox int
 }
 
 const defaultDeadlockTimeout = 30 * time.Second
 
+const defaultConflictRetries = 3
+
+// ErrConflict is matched by errors from a StateMutator when the stored state
+// changed after the mutator loaded it, so the mutation was not kept
+var ErrConflict = errors.New("state changed concurrently")
+
+// ErrStopped is matched by the errors calls receive when their server stopped
+// before handling them. The message had no effect, so it can be sent again,
+// for example to the server a group restarts in place of a failed one.
+var ErrStopped = errors.New("genserver stopped before handling the message")
+
+// ConflictError is returned by state mutators that compare and swap versions,
+// when the state of ID is no longer at the Version the mutation started from
+type ConflictError struct {
+	ID      string
+	Version uint64
+}
+
+func (ce ConflictError) Error() string {
+	return fmt.Sprintf("state for %s changed concurrently from version %d", ce.ID, ce.Version)
+}
+
+func (ce ConflictError) Is(target error) bool {
+	return target == ErrConflict
+}
+
 type CallTimeoutError[ID fmt.Stringer] struct {
 	kind  string
 	id    ID
@@ -121,12 +322,65 @@ func WithMessagePool[ID fmt.Stringer, State any](messagePool mailbox.Pool[Messag
 	}
 }
 
+// WithFailureCallback sets a callback that runs on the server goroutine when
+// processing a message fails, just before the server stops
+func WithFailureCallback[ID fmt.Stringer, State any](failureCallback func(server *GenServer[ID, State], err error)) Option[ID, State] {
+	return func(gsConfig *genServerConfig[ID, State]) {
+		gsConfig.failureCallback = failureCallback
+	}
+}
+
+// WithConflictRetries sets how many times a message is handled again, against
+// a freshly loaded state, when its mutation fails with ErrConflict. The
+// default is 3.
+func WithConflictRetries[ID fmt.Stringer, State any](retries int) Option[ID, State] {
+	return func(gsConfig *genServerConfig[ID, State]) {
+		gsConfig.conflictRetries = retries
+	}
+}
+
+// WithMetrics sets where the server records the messages it handles, its
+// mailbox depth and its call timeouts, labelled by its kind. The default
+// discards them.
+func WithMetrics[ID fmt.Stringer, State any](m metrics.Metrics) Option[ID, State] {
+	return func(gsConfig *genServerConfig[ID, State]) {
+		gsConfig.metrics = m
+	}
+}
+
+// WithLogger sets the logger of the server. The default is slog.Default().
+func WithLogger[ID fmt.Stringer, State any](logger Logger) Option[ID, State] {
+	return func(gsConfig *genServerConfig[ID, State]) {
+		gsConfig.logger = logger
+	}
+}
+
+// WithTracer starts a span for each message the server handles, from the
+// context the message was sent with. The default records nothing.
+func WithTracer[ID fmt.Stringer, State any](tracer tracing.Tracer) Option[ID, State] {
+	return func(gsConfig *genServerConfig[ID, State]) {
+		gsConfig.tracer = tracer
+	}
+}
+
+// WithInterceptors wraps the handling of every message in interceptors. The
+// first interceptor is the outermost. It may be given more than once to add
+// interceptors after those already set.
+func WithInterceptors[ID fmt.Stringer, State any](interceptors ...Interceptor[ID, State]) Option[ID, State] {
+	return func(gsConfig *genServerConfig[ID, State]) {
+		gsConfig.interceptors = append(gsConfig.interceptors, interceptors...)
+	}
+}
+
 // New creates a new genserver
 // Assign the Terminate function to define a callback just before the worker stops
 func New[ID fmt.Stringer, State any](kind string, id ID, stateMutator StateMutator[State], options ...Option[ID, State]) *GenServer[ID, State] {
 	config := &genServerConfig[ID, State]{
 		deadlockTimeout: defaultDeadlockTimeout,
-		logger:          log.Default(),
+		logger:          slog.Default(),
+		conflictRetries: defaultConflictRetries,
+		metrics:         metrics.Nop{},
+		tracer:          tracing.Nop{},
 	}
 	for _, option := range options {
 		option(config)
@@ -144,9 +398,28 @@ func New[ID fmt.Stringer, State any](kind string, id ID, stateMutator StateMutat
 		terminated:   make(chan struct{}),
 		config:       config,
 	}
+	server.intercept = server.chain()
 	return server
 }
 
+// chain composes the interceptors of the server, or returns nil if it has none
+func (server *GenServer[ID, State]) chain() intercept[State] {
+	interceptors := server.config.interceptors
+	if len(interceptors) == 0 {
+		return nil
+	}
+	return func(ctx context.Context, s *State, env Envelope, next HandlerFunc[State]) (any, error) {
+		inv := Invocation[ID]{Kind: server.kind, ID: server.id, Envelope: env}
+		for i := len(interceptors) - 1; i >= 0; i-- {
+			interceptor, inner := interceptors[i], next
+			next = func(ctx context.Context, s *State) (any, error) {
+				return interceptor(ctx, s, inv, inner)
+			}
+		}
+		return next(ctx, s)
+	}
+}
+
 // Spawn is like new but automatically starts the server
 func Spawn[ID fmt.Stringer, State any](kind string, id ID, state StateMutator[State], options ...Option[ID, State]) *GenServer[ID, State] {
 	server := New(kind, id, state, options...)
@@ -155,6 +428,9 @@ func Spawn[ID fmt.Stringer, State any](kind string, id ID, state StateMutator[St
 }
 
 func (server *GenServer[ID, State]) Start() {
+	server.started.Store(time.Now().UnixNano())
+	server.config.metrics.ServersChanged(server.kind, 1)
+	server.config.logger.DebugContext(context.Background(), "server started", server.logAttrs()...)
 	go server.loop()
 }
 
@@ -162,8 +438,86 @@ func (server *GenServer[ID, State]) ID() ID {
 	return server.id
 }
 
+// Kind returns the kind the server was created with
+func (server *GenServer[ID, State]) Kind() string {
+	return server.kind
+}
+
+// Stats returns the activity of the server so far
+func (server *GenServer[ID, State]) Stats() Stats {
+	return Stats{
+		Started:     unixTime(server.started.Load()),
+		LastMessage: unixTime(server.lastMessage.Load()),
+		Messages:    server.received.Load(),
+		Mailbox:     server.messages.Len(),
+	}
+}
+
+func unixTime(nanos int64) time.Time {
+	if nanos == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, nanos)
+}
+
+// Terminated is closed once the server has stopped processing messages
+func (server *GenServer[ID, State]) Terminated() <-chan struct{} {
+	return server.terminated
+}
+
+// Err returns the error that stopped the server, once Terminated is closed.
+// It returns nil while the server is running, or if it shut down normally.
+func (server *GenServer[ID, State]) Err() error {
+	select {
+	case <-server.terminated:
+		return server.err
+	default:
+		return nil
+	}
+}
+
+// send queues a message, and reports false if the server has stopped. The
+// mailbox gauge counts the message before it is queued, so the loop never
+// takes it off the gauge first.
+func (server *GenServer[ID, State]) send(message MessageHandler[State]) bool {
+	server.config.metrics.MailboxChanged(server.kind, 1)
+	if !server.messages.Send(message) {
+		server.config.metrics.MailboxChanged(server.kind, -1)
+		return false
+	}
+	return true
+}
+
+// close stops the mailbox accepting messages, and fails those still waiting
+// with ErrStopped, wrapping reason if the server failed
+func (server *GenServer[ID, State]) close(reason error) {
+	dropped := server.messages.Close()
+	if len(dropped) == 0 {
+		return
+	}
+	server.config.metrics.MailboxChanged(server.kind, -len(dropped))
+	err := ErrStopped
+	if reason != nil {
+		err = fmt.Errorf("%w: %w", ErrStopped, reason)
+	}
+	for _, messageHandler := range dropped {
+		messageHandler.Fail(err)
+	}
+}
+
+// logAttrs returns the attributes identifying the server, followed by args
+func (server *GenServer[ID, State]) logAttrs(args ...any) []any {
+	return append([]any{"kind", server.kind, "id", server.id.String()}, args...)
+}
+
 func (server *GenServer[ID, State]) loop() {
 	defer func() {
+		server.config.metrics.ServersChanged(server.kind, -1)
+		if server.err != nil {
+			server.config.logger.WarnContext(context.Background(), "server stopped", server.logAttrs("error", server.err)...)
+		} else {
+			server.config.logger.DebugContext(context.Background(), "server stopped", server.logAttrs()...)
+		}
 		close(server.terminated)
 	}()
 	for {
@@ -171,22 +525,63 @@ func (server *GenServer[ID, State]) loop() {
 		if !more {
 			return
 		}
-		_, isShutdown := messageHandler.(ShutdownMessageHandler[State])
+		received := time.Now()
+		server.lastMessage.Store(received.UnixNano())
+		server.received.Add(1)
+		server.config.metrics.MailboxChanged(server.kind, -1)
+		shutdown, isShutdown := messageHandler.(ShutdownMessageHandler[State])
 		if isShutdown {
-			server.messages.Close()
+			server.config.logger.DebugContext(context.Background(), "server shutting down", server.logAttrs("reason", shutdown.r.String())...)
+			server.close(nil)
+			if shutdown.r == Expired {
+				// there is no state left to hand the shutdown handler
+				continue
+			}
+		}
+		env := messageHandler.Envelope()
+		ctx, span := server.startSpan(env, received)
+		handle := func(s *State) (func(), error) {
+			return messageHandler.Handle(ctx, s)
+		}
+		returnValue, err := server.stateMutator(handle)
+		for retries := 0; errors.Is(err, ErrConflict) && retries < server.config.conflictRetries; retries++ {
+			server.config.logger.DebugContext(ctx, "retrying message after conflict", server.logAttrs("message", fmt.Sprintf("%T", env.Message), "error", err)...)
+			returnValue, err = server.stateMutator(handle)
 		}
-		returnValue, err := server.stateMutator(messageHandler.Handle)
+		span.End(err)
+		server.config.metrics.MessageHandled(server.kind, time.Since(received), err)
 		if err != nil {
-			server.config.logger.Printf("Processing message: %s", err)
-			server.messages.Close()
+			server.config.logger.ErrorContext(ctx, "processing message failed", server.logAttrs("message", fmt.Sprintf("%T", env.Message), "error", err)...)
+			server.err = err
+			if cb := server.config.failureCallback; cb != nil {
+				cb(server, err)
+			}
+			server.close(err)
+			messageHandler.Fail(err)
+			continue
 		}
 		returnValue()
 	}
 }
 
+// startSpan starts the span of a message received at received
+func (server *GenServer[ID, State]) startSpan(env Envelope, received time.Time) (context.Context, tracing.Span) {
+	if _, nop := server.config.tracer.(tracing.Nop); nop {
+		// skip describing the message when nothing records it
+		return tracing.Nop{}.Start(env.Context, tracing.Info{})
+	}
+	return server.config.tracer.Start(env.Context, tracing.Info{
+		Kind:      server.kind,
+		ID:        server.id.String(),
+		Operation: env.Operation,
+		Message:   fmt.Sprintf("%T", env.Message),
+		Wait:      received.Sub(env.Sent),
+	})
+}
+
 // Shutdown sends a shutdown signal to the server.
 func Shutdown[ID fmt.Stringer, State any](server *GenServer[ID, State], reason ShutdownReason, handler ShutdownHandler[State], waitUntil <-chan struct{}) error {
-	if !server.messages.Send(ShutdownMessageHandler[State]{reason, handler}) {
+	if !server.send(ShutdownMessageHandler[State]{newEnvelope(context.Background(), "shutdown", reason), reason, handler, server.intercept}) {
 		return fmt.Errorf("send to dead genserver")
 	}
 	select {
@@ -199,40 +594,82 @@ func Shutdown[ID fmt.Stringer, State any](server *GenServer[ID, State], reason S
 
 // Send sends a message to the server
 func Cast[ID fmt.Stringer, State any, Message any](server *GenServer[ID, State], message Message, handler CastHandler[State, Message]) error {
-	if !server.messages.Send(CastMessageHandler[State, Message]{message, handler}) {
+	return CastContext(context.Background(), server, message, handler)
+}
+
+// CastContext is like Cast, but sends ctx with the message, so its span is a
+// child of the span in ctx
+func CastContext[ID fmt.Stringer, State any, Message any](ctx context.Context, server *GenServer[ID, State], message Message, handler CastHandler[State, Message]) error {
+	return CastWithContext(ctx, server, message, func(_ context.Context, s *State, m Message) error {
+		return handler(s, m)
+	})
+}
+
+// CastWithContext is like CastContext, but handler also receives the context
+// of the message
+func CastWithContext[ID fmt.Stringer, State any, Message any](ctx context.Context, server *GenServer[ID, State], message Message, handler ContextCastHandler[State, Message]) error {
+	if !server.send(CastMessageHandler[State, Message]{newEnvelope(ctx, "cast", message), message, handler, server.intercept}) {
 		return fmt.Errorf("send to dead genserver")
 	}
 	return nil
 }
 
 func Call[ID fmt.Stringer, State any, Message any, Return any](server *GenServer[ID, State], message Message, handler CallHandler[State, Message, Return]) (Return, error) {
+	return CallContext(context.Background(), server, message, handler)
+}
+
+// CallContext is like Call, but also stops waiting for a reply once ctx is
+// done, and sends ctx with the message, so its span is a child of the span
+// in ctx
+func CallContext[ID fmt.Stringer, State any, Message any, Return any](ctx context.Context, server *GenServer[ID, State], message Message, handler CallHandler[State, Message, Return]) (Return, error) {
+	return CallWithContext(ctx, server, message, func(_ context.Context, s *State, m Message) (Return, error) {
+		return handler(s, m)
+	})
+}
+
+// CallWithContext is like CallContext, but handler also receives the context
+// of the message
+func CallWithContext[ID fmt.Stringer, State any, Message any, Return any](ctx context.Context, server *GenServer[ID, State], message Message, handler ContextCallHandler[State, Message, Return]) (Return, error) {
+	return call(ctx, server, "call", message, handler)
+}
+
+func call[ID fmt.Stringer, State any, Message any, Return any](ctx context.Context, server *GenServer[ID, State], operation string, message Message, handler ContextCallHandler[State, Message, Return]) (Return, error) {
 	timer := time.NewTimer(server.config.deadlockTimeout)
 	// timer.Stop() see here for details on why
 	// https://medium.com/@oboturov/golang-time-after-is-not-garbage-collected-4cbc94740082
 	defer timer.Stop()
 
-	returnValChan := make(chan Return, 1)
+	returnValChan := make(chan callReturn[Return], 1)
 	var empty Return
 
 	// Step 1 submitting message
-	if !server.messages.Send(CallMessageHandler[State, Message, Return]{message, returnValChan, handler}) {
+	if !server.send(CallMessageHandler[State, Message, Return]{newEnvelope(ctx, operation, message), message, returnValChan, handler, server.intercept}) {
 		return empty, fmt.Errorf("call to dead genserver")
 	}
 
 	// Step 2 waiting for message to finish
 	select {
+	case <-ctx.Done():
+		return empty, ctx.Err()
+
 	case <-timer.C:
 		return empty, server.handleTimeout()
 
 	case returnVal := <-returnValChan:
-		return returnVal, nil
+		return returnVal.r, returnVal.err
 	}
 }
 
 type getMessage struct{}
 
 func (server *GenServer[ID, State]) Get() (State, error) {
-	return Call(server, getMessage{}, func(s *State, gm getMessage) (State, error) {
+	return server.GetContext(context.Background())
+}
+
+// GetContext is like Get, but stops waiting for the state once ctx is done,
+// as CallContext does
+func (server *GenServer[ID, State]) GetContext(ctx context.Context) (State, error) {
+	return call(ctx, server, "get", getMessage{}, func(_ context.Context, s *State, gm getMessage) (State, error) {
 		return *s, nil
 	})
 }
@@ -254,6 +691,8 @@ func (server *GenServer[ID, State]) handleTimeout() error {
 		}
 	}
 
+	server.config.metrics.CallTimedOut(server.kind)
+	server.config.logger.WarnContext(context.Background(), "call timed out", server.logAttrs("timeout", server.config.deadlockTimeout)...)
 	if cb := server.config.deadlockCallback; cb != nil {
 		cb(server, trace)
 	}
@@ -1,10 +1,21 @@
 package genserver_test
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"runtime"
 	"strconv"
+	"strings"
+	gosync "sync"
+	"sync/atomic"
 	"testing"
 
 	"github.com/hannahhoward/go-genserver/genserver"
+	"github.com/hannahhoward/go-genserver/metrics"
 )
 
 type counter struct {
@@ -90,3 +101,385 @@ func TestGenServer(t *testing.T) {
 		t.Fatal("did not call shutdown handler properly")
 	}
 }
+
+func TestCallContext(t *testing.T) {
+	sa := &simpleAccessor{&counter{0}}
+	genServer := genserver.Spawn[PrintableInt]("counter", 1, sa.ModifyState)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	release := make(chan struct{})
+	_, err := genserver.CallContext(ctx, genServer, 1, func(c *counter, amt uint64) (uint64, error) {
+		cancel()
+		<-release
+		return add(c, amt)
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context cancellation, got %v", err)
+	}
+	close(release)
+
+	current, err := genserver.CallContext(context.Background(), genServer, 1, add)
+	if err != nil {
+		t.Fatalf("should have called genServer successfully")
+	}
+	if current != 2 {
+		t.Fatalf("did not add properly")
+	}
+}
+
+func TestShutdownReasons(t *testing.T) {
+	for _, reason := range []genserver.ShutdownReason{genserver.Normal, genserver.BrutalKill, genserver.Expired} {
+		t.Run(reason.String(), func(t *testing.T) {
+			sa := &simpleAccessor{&counter{0}}
+			genServer := genserver.Spawn[PrintableInt]("counter", 1, sa.ModifyState)
+			called := false
+			err := genserver.Shutdown(genServer, reason, func(c counter, r genserver.ShutdownReason) error {
+				called = true
+				if r != reason {
+					t.Errorf("shutdown handler got reason %s", r)
+				}
+				return nil
+			}, nil)
+			if err != nil {
+				t.Fatalf("should have shut down successfully: %s", err)
+			}
+			// only expiry skips the handler, since the state is gone
+			if called != (reason != genserver.Expired) {
+				t.Fatalf("shutdown handler called: %t", called)
+			}
+		})
+	}
+}
+
+func TestFailure(t *testing.T) {
+	sa := &simpleAccessor{&counter{0}}
+	failed := make(chan error, 1)
+	genServer := genserver.Spawn("counter", PrintableInt(1), sa.ModifyState,
+		genserver.WithFailureCallback(func(_ *genserver.GenServer[PrintableInt, counter], err error) {
+			failed <- err
+		}))
+
+	if genServer.Err() != nil {
+		t.Fatal("running server should not report an error")
+	}
+	errBoom := errors.New("boom")
+	err := genserver.Cast(genServer, 1, func(c *counter, amt uint64) error {
+		return errBoom
+	})
+	if err != nil {
+		t.Fatalf("should have cast to genServer successfully")
+	}
+	<-genServer.Terminated()
+	if !errors.Is(<-failed, errBoom) {
+		t.Fatal("did not call failure callback properly")
+	}
+	if !errors.Is(genServer.Err(), errBoom) {
+		t.Fatal("did not record failure properly")
+	}
+}
+
+func TestFailureFailsWaitingCalls(t *testing.T) {
+	sa := &simpleAccessor{&counter{0}}
+	genServer := genserver.New[PrintableInt]("counter", 1, sa.ModifyState)
+	errBoom := errors.New("boom")
+	if err := genserver.Cast(genServer, 1, func(c *counter, amt uint64) error {
+		return errBoom
+	}); err != nil {
+		t.Fatalf("should have cast to genServer successfully")
+	}
+	result := make(chan error, 1)
+	go func() {
+		_, err := genserver.Call(genServer, 1, add)
+		result <- err
+	}()
+	for genServer.Stats().Mailbox != 2 {
+		runtime.Gosched()
+	}
+
+	genServer.Start()
+	err := <-result
+	if !errors.Is(err, genserver.ErrStopped) || !errors.Is(err, errBoom) {
+		t.Fatalf("waiting call should have failed with the server, got %v", err)
+	}
+	if sa.c.current != 0 {
+		t.Fatalf("should not have handled the waiting call")
+	}
+}
+
+type conflictingAccessor struct {
+	simpleAccessor
+	conflicts int
+}
+
+func (ca *conflictingAccessor) ModifyState(modifier genserver.StateMutatorFn[counter]) (func(), error) {
+	// handle the message against a copy, as a store would, and refuse to
+	// commit while conflicts remain
+	c := *ca.c
+	f, err := modifier(&c)
+	if err != nil {
+		return nil, err
+	}
+	if ca.conflicts > 0 {
+		ca.conflicts--
+		return nil, fmt.Errorf("committing: %w", genserver.ConflictError{ID: "1", Version: 1})
+	}
+	*ca.c = c
+	return f, nil
+}
+
+func TestConflictRetries(t *testing.T) {
+	ca := &conflictingAccessor{simpleAccessor{&counter{0}}, 2}
+	genServer := genserver.Spawn("counter", PrintableInt(1), ca.ModifyState, genserver.WithConflictRetries[PrintableInt, counter](2))
+	current, err := genserver.Call(genServer, 1, add)
+	if err != nil {
+		t.Fatalf("should have retried past conflicts, got %v", err)
+	}
+	if current != 1 || ca.c.current != 1 {
+		t.Fatalf("did not add properly")
+	}
+
+	ca.conflicts = 3
+	_, err = genserver.Call(genServer, 1, add)
+	if !errors.Is(err, genserver.ErrConflict) {
+		t.Fatalf("should have failed with a conflict, got %v", err)
+	}
+	var conflict genserver.ConflictError
+	if !errors.As(err, &conflict) || conflict.Version != 1 {
+		t.Fatalf("should have returned a ConflictError")
+	}
+	if ca.c.current != 1 {
+		t.Fatalf("should not have kept the conflicting change")
+	}
+}
+
+func TestStats(t *testing.T) {
+	sa := &simpleAccessor{&counter{0}}
+	genServer := genserver.New[PrintableInt]("counter", 1, sa.ModifyState)
+	if stats := genServer.Stats(); !stats.Started.IsZero() || !stats.LastMessage.IsZero() {
+		t.Fatalf("unstarted server has activity: %+v", stats)
+	}
+	for i := 0; i < 2; i++ {
+		if err := genserver.Cast(genServer, 1, func(c *counter, amt uint64) error {
+			_, err := add(c, amt)
+			return err
+		}); err != nil {
+			t.Fatalf("should have cast to genServer successfully")
+		}
+	}
+	if stats := genServer.Stats(); stats.Mailbox != 2 {
+		t.Fatalf("expected 2 waiting messages, got %d", stats.Mailbox)
+	}
+
+	genServer.Start()
+	if _, err := genserver.Call(genServer, 1, add); err != nil {
+		t.Fatalf("should have called genServer successfully")
+	}
+	stats := genServer.Stats()
+	if stats.Started.IsZero() || stats.LastMessage.Before(stats.Started) {
+		t.Fatalf("expected a start and a later message, got %+v", stats)
+	}
+	if stats.Messages != 3 || stats.Mailbox != 0 {
+		t.Fatalf("expected 3 received and none waiting, got %+v", stats)
+	}
+	if genServer.Kind() != "counter" {
+		t.Fatalf("unexpected kind %s", genServer.Kind())
+	}
+}
+
+// mailboxGauge tracks the mailbox depth servers record, and whether it ever
+// went negative
+type mailboxGauge struct {
+	metrics.Nop
+	depth    atomic.Int64
+	negative atomic.Bool
+}
+
+func (mg *mailboxGauge) MailboxChanged(_ string, delta int) {
+	if mg.depth.Add(int64(delta)) < 0 {
+		mg.negative.Store(true)
+	}
+}
+
+func TestMailboxMetrics(t *testing.T) {
+	sa := &simpleAccessor{&counter{0}}
+	gauge := &mailboxGauge{}
+	genServer := genserver.Spawn("counter", PrintableInt(1), sa.ModifyState, genserver.WithMetrics[PrintableInt, counter](gauge))
+	var wg gosync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				if _, err := genserver.Call(genServer, 1, add); err != nil {
+					t.Errorf("should have called genServer successfully: %s", err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if err := genserver.Shutdown(genServer, genserver.Normal, func(counter, genserver.ShutdownReason) error { return nil }, nil); err != nil {
+		t.Fatalf("should have shut down successfully: %s", err)
+	}
+	// messages to a stopped server are never queued
+	if _, err := genserver.Call(genServer, 1, add); err == nil {
+		t.Fatal("should not have called a stopped genServer")
+	}
+	if gauge.negative.Load() {
+		t.Fatal("mailbox depth went negative")
+	}
+	if depth := gauge.depth.Load(); depth != 0 {
+		t.Fatalf("expected an empty mailbox, got depth %d", depth)
+	}
+}
+
+// logBuffer collects JSON log records written from server goroutines
+type logBuffer struct {
+	lock gosync.Mutex
+	buf  bytes.Buffer
+}
+
+func (lb *logBuffer) Write(p []byte) (int, error) {
+	lb.lock.Lock()
+	defer lb.lock.Unlock()
+	return lb.buf.Write(p)
+}
+
+func (lb *logBuffer) records(t *testing.T) []map[string]any {
+	lb.lock.Lock()
+	defer lb.lock.Unlock()
+	var records []map[string]any
+	for _, line := range strings.Split(strings.TrimSpace(lb.buf.String()), "\n") {
+		record := map[string]any{}
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatalf("invalid log line %q: %v", line, err)
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+func TestLogging(t *testing.T) {
+	lb := &logBuffer{}
+	logger := slog.New(slog.NewJSONHandler(lb, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	sa := &simpleAccessor{&counter{0}}
+	genServer := genserver.Spawn("counter", PrintableInt(1), sa.ModifyState, genserver.WithLogger[PrintableInt, counter](logger))
+	err := genserver.Cast(genServer, 1, func(c *counter, amt uint64) error {
+		return errors.New("boom")
+	})
+	if err != nil {
+		t.Fatalf("should have cast to genServer successfully")
+	}
+	<-genServer.Terminated()
+	stopped := genserver.Spawn("counter", PrintableInt(2), sa.ModifyState, genserver.WithLogger[PrintableInt, counter](logger))
+	if err := genserver.Shutdown(stopped, genserver.Normal, func(counter, genserver.ShutdownReason) error { return nil }, nil); err != nil {
+		t.Fatalf("should have shut down genServer successfully")
+	}
+	<-stopped.Terminated()
+
+	var failure map[string]any
+	stops := map[any]map[string]any{}
+	for _, record := range lb.records(t) {
+		if record["kind"] != "counter" || (record["id"] != "1" && record["id"] != "2") {
+			t.Fatalf("record does not identify the server: %v", record)
+		}
+		switch record["msg"] {
+		case "processing message failed":
+			failure = record
+		case "server stopped":
+			stops[record["id"]] = record
+		}
+	}
+	if failure == nil {
+		t.Fatal("did not log the failure")
+	}
+	if failure["level"] != "ERROR" || failure["error"] != "boom" {
+		t.Fatalf("unexpected failure record: %v", failure)
+	}
+	if stop := stops["1"]; stop["level"] != "WARN" || stop["error"] != "boom" {
+		t.Fatalf("unexpected stop record after failure: %v", stop)
+	}
+	if stop := stops["2"]; stop["level"] != "DEBUG" {
+		t.Fatalf("unexpected stop record after shutdown: %v", stop)
+	}
+}
+
+func TestInterceptors(t *testing.T) {
+	sa := &simpleAccessor{&counter{0}}
+	var seen []string
+	record := func(name string) genserver.Interceptor[PrintableInt, counter] {
+		return func(ctx context.Context, s *counter, inv genserver.Invocation[PrintableInt], next genserver.HandlerFunc[counter]) (any, error) {
+			seen = append(seen, fmt.Sprintf("%s %s %s %d %s", name, inv.Kind, inv.ID, s.current, inv.Operation))
+			return next(ctx, s)
+		}
+	}
+	errDenied := errors.New("denied")
+	transform := func(ctx context.Context, s *counter, inv genserver.Invocation[PrintableInt], next genserver.HandlerFunc[counter]) (any, error) {
+		switch m := inv.Message.(type) {
+		case string:
+			return nil, errDenied
+		case uint64:
+			if m == 100 {
+				return "not a uint64", nil
+			}
+			reply, err := next(ctx, s)
+			if r, ok := reply.(uint64); ok {
+				return r * 10, err
+			}
+			return reply, err
+		}
+		return next(ctx, s)
+	}
+	genServer := genserver.Spawn("counter", PrintableInt(1), sa.ModifyState,
+		genserver.WithInterceptors(record("outer"), transform),
+		genserver.WithInterceptors(record("inner")))
+
+	current, err := genserver.Call(genServer, 2, add)
+	if err != nil || current != 20 {
+		t.Fatalf("expected the transformed reply 20, got %d, %v", current, err)
+	}
+	state, err := genServer.Get()
+	if err != nil || state.current != 2 {
+		t.Fatalf("expected the state to be 2, got %d, %v", state.current, err)
+	}
+	expected := []string{"outer counter 1 0 call", "inner counter 1 0 call", "outer counter 1 2 get", "inner counter 1 2 get"}
+	if fmt.Sprint(seen) != fmt.Sprint(expected) {
+		t.Fatalf("expected %v, got %v", expected, seen)
+	}
+
+	_, err = genserver.Call(genServer, 100, add)
+	if err == nil || !strings.Contains(err.Error(), "interceptor replied with string to a call expecting uint64") {
+		t.Fatalf("should have rejected a reply of the wrong type, got %v", err)
+	}
+	<-genServer.Terminated()
+
+	sa = &simpleAccessor{&counter{0}}
+	seen = nil
+	genServer = genserver.Spawn("counter", PrintableInt(2), sa.ModifyState, genserver.WithInterceptors(record("only"), transform))
+	if err := genserver.Cast(genServer, 1, func(c *counter, amt uint64) error {
+		_, err := add(c, amt)
+		return err
+	}); err != nil {
+		t.Fatalf("should have cast to genServer successfully")
+	}
+	err = genserver.Shutdown(genServer, genserver.Normal, func(counter, genserver.ShutdownReason) error { return nil }, nil)
+	if err != nil {
+		t.Fatalf("should have shut down, got %v", err)
+	}
+	expected = []string{"only counter 2 0 cast", "only counter 2 1 shutdown"}
+	if fmt.Sprint(seen) != fmt.Sprint(expected) {
+		t.Fatalf("expected %v, got %v", expected, seen)
+	}
+
+	genServer = genserver.Spawn("counter", PrintableInt(3), sa.ModifyState, genserver.WithInterceptors(transform))
+	_, err = genserver.Call(genServer, "one", func(c *counter, amt string) (uint64, error) {
+		t.Fatal("should not have reached the handler")
+		return 0, nil
+	})
+	if !errors.Is(err, errDenied) {
+		t.Fatalf("should have short-circuited, got %v", err)
+	}
+	if sa.c.current != 1 {
+		t.Fatalf("should not have changed the state")
+	}
+}
@@ -0,0 +1,100 @@
+package group
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// EventKind identifies a lifecycle transition of a server in a group
+type EventKind uint64
+
+const (
+	// Created means a new state was created in the store
+	Created EventKind = iota
+	// Started means a server was started for an identifier
+	Started
+	// Stopped means a server shut down normally
+	Stopped
+	// Evicted means a server was stopped by Evict, leaving its state stored
+	Evicted
+	// Restarted means a server that failed was replaced by a new one
+	Restarted
+	// HandlerFailed means processing a message failed, which stops the server
+	HandlerFailed
+	// Expired means the store expired the state, so its server is stopped
+	Expired
+)
+
+func (k EventKind) String() string {
+	switch k {
+	case Created:
+		return "created"
+	case Started:
+		return "started"
+	case Stopped:
+		return "stopped"
+	case Evicted:
+		return "evicted"
+	case Restarted:
+		return "restarted"
+	case HandlerFailed:
+		return "handler failed"
+	case Expired:
+		return "expired"
+	default:
+		return fmt.Sprintf("EventKind(%d)", uint64(k))
+	}
+}
+
+// Event describes a lifecycle transition of the server for a single identifier
+type Event[ID fmt.Stringer] struct {
+	// Group is the kind of the group the event happened in
+	Group string
+	Kind  EventKind
+	ID    ID
+	// Reason is the error behind HandlerFailed and Restarted events, and
+	// Stopped events of servers whose state was gone. It is nil otherwise.
+	Reason error
+	Time   time.Time
+}
+
+// EventHandler receives lifecycle events. It is called synchronously from
+// whichever goroutine caused the event, so it must be safe for concurrent use
+// and should not block.
+type EventHandler[ID fmt.Stringer] func(Event[ID])
+
+func (g *Group[ID, State]) emit(kind EventKind, id ID, reason error) {
+	g.log(kind, id, reason)
+	if len(g.eventHandlers) == 0 {
+		return
+	}
+	event := Event[ID]{
+		Group:  g.kind,
+		Kind:   kind,
+		ID:     id,
+		Reason: reason,
+		Time:   time.Now(),
+	}
+	for _, handler := range g.eventHandlers {
+		handler(event)
+	}
+}
+
+// log logs an event at a level matching how unusual it is. Servers log the
+// errors behind HandlerFailed themselves.
+func (g *Group[ID, State]) log(kind EventKind, id ID, reason error) {
+	ctx := context.Background()
+	args := []any{"kind", g.kind, "id", id.String(), "event", kind.String()}
+	if reason != nil {
+		args = append(args, "error", reason)
+	}
+	switch {
+	case kind == Restarted:
+		g.logger.WarnContext(ctx, "server restarted", args...)
+	case kind == Expired, kind == Stopped && reason != nil:
+		g.logger.InfoContext(ctx, "server "+kind.String(), args...)
+	default:
+		g.logger.DebugContext(ctx, "server "+kind.String(), args...)
+	}
+}
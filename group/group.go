@@ -2,33 +2,180 @@ package group
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"log/slog"
+	gosync "sync"
 
 	"github.com/hannahhoward/go-genserver/genserver"
 	"github.com/hannahhoward/go-genserver/mailbox"
+	"github.com/hannahhoward/go-genserver/metrics"
 	"github.com/hannahhoward/go-genserver/sync"
 )
 
+// ErrNotFound is returned, possibly wrapped, by stores when there is no state
+// for an identifier
+var ErrNotFound = errors.New("state not found")
+
+// Store holds the states of a group. All methods must be safe for concurrent
+// use, and mutations of the same identifier must not lose each other's
+// changes. A group never mutates a state except through Mutator.
 type Store[ID fmt.Stringer, State any] interface {
+	// Has indicates whether there is a state for id
 	Has(id ID) (bool, error)
-	List() ([]State, error)
+	// Load returns a copy of the state for id, or an error wrapping
+	// ErrNotFound. Changing the returned state does not change the store.
+	Load(id ID) (State, error)
+	// LoadVersion is like Load, but also returns the version of the state.
+	// Versions are at least 1, and increase whenever a mutation changes the
+	// state. Mutators of stores shared between processes compare versions
+	// when committing, and fail with a genserver.ConflictError if another
+	// process changed the state first.
+	LoadVersion(id ID) (State, uint64, error)
+	// CreateIfNotExist stores state for id unless there already is one, and
+	// reports whether there already was
 	CreateIfNotExist(id ID, state State) (bool, error)
+	// Mutator returns a StateMutator for id. The mutation is kept only if the
+	// StateMutatorFn succeeds, and the mutator fails with an error wrapping
+	// ErrNotFound when there is no state for id.
 	Mutator(id ID) genserver.StateMutator[State]
+	// Delete removes the state for id. Deleting a missing state is not an error.
+	Delete(id ID) error
+	// IDs calls f for each identifier that sorts after cursor, in ascending
+	// order of ID.String(), until f returns false. An empty cursor starts from
+	// the first identifier.
+	IDs(cursor string, f func(id ID) bool) error
+	// Iterate is like IDs, but also passes a copy of each state
+	Iterate(cursor string, f func(id ID, state State) bool) error
+}
+
+// Expirer is implemented by stores whose states expire. A group registers a
+// function with OnExpire, to stop the servers of expired states.
+type Expirer[ID fmt.Stringer] interface {
+	// OnExpire registers f to be called after the state for an identifier
+	// has expired and been deleted
+	OnExpire(f func(id ID))
+}
+
+// Flusher is implemented by stores that buffer writes. Stop flushes them once
+// every server has stopped.
+type Flusher interface {
+	// Flush writes every buffered change, until ctx is done
+	Flush(ctx context.Context) error
+}
+
+// Entry pairs a state with the identifier it is stored under
+type Entry[ID fmt.Stringer, State any] struct {
+	ID    ID
+	State State
+}
+
+// Filter selects which entries are included in a listing
+type Filter[ID fmt.Stringer, State any] func(id ID, state State) bool
+
+// ListOptions controls which entries ListEntries returns
+type ListOptions[ID fmt.Stringer, State any] struct {
+	// Cursor resumes a listing after the entry it names. It is empty for the
+	// first page, and NextCursor of the previous page after that.
+	Cursor string
+	// Limit is the maximum number of entries in a page. Zero means no limit.
+	Limit int
+	// Filter, when set, skips entries for which it returns false
+	Filter Filter[ID, State]
+}
+
+// Page is a single page of entries returned by ListEntries
+type Page[ID fmt.Stringer, State any] struct {
+	Entries []Entry[ID, State]
+	// NextCursor fetches the following page, and is empty on the last page
+	NextCursor string
 }
 
 type Group[ID fmt.Stringer, State any] struct {
-	kind         string
-	messagesPool mailbox.Pool[genserver.MessageHandler[State]]
-	store        Store[ID, State]
-	genServers   sync.Map[ID, *genserver.GenServer[ID, State]]
+	kind          string
+	messagesPool  mailbox.Pool[genserver.MessageHandler[State]]
+	store         Store[ID, State]
+	genServers    sync.Map[ID, *genserver.GenServer[ID, State]]
+	eventHandlers []EventHandler[ID]
+	serverOptions []genserver.Option[ID, State]
+	metrics       metrics.Metrics
+	logger        genserver.Logger
+
+	// stopping is held for writing while Stop marks the group stopped, and
+	// for reading while failed servers are replaced, so no replacement starts
+	// once Stop has begun
+	stopping gosync.RWMutex
+	stopped  bool
+}
+
+type Option[ID fmt.Stringer, State any] func(g *Group[ID, State])
+
+// WithEventHandler registers a handler for lifecycle events. It may be given
+// more than once to register several handlers.
+func WithEventHandler[ID fmt.Stringer, State any](handler EventHandler[ID]) Option[ID, State] {
+	return func(g *Group[ID, State]) {
+		g.eventHandlers = append(g.eventHandlers, handler)
+	}
+}
+
+// WithGenServerOptions passes options to every server the group starts,
+// for example genserver.WithConflictRetries. The group sets its own message
+// pool and failure callback.
+func WithGenServerOptions[ID fmt.Stringer, State any](options ...genserver.Option[ID, State]) Option[ID, State] {
+	return func(g *Group[ID, State]) {
+		g.serverOptions = append(g.serverOptions, options...)
+	}
+}
+
+// WithMetrics records measurements of the group's servers, and the restarts
+// of failed ones, labelled by the group's kind
+func WithMetrics[ID fmt.Stringer, State any](m metrics.Metrics) Option[ID, State] {
+	return func(g *Group[ID, State]) {
+		g.metrics = m
+		g.serverOptions = append(g.serverOptions, genserver.WithMetrics[ID, State](m))
+	}
+}
+
+// WithLogger sets the logger of the group and its servers. The group logs
+// the lifecycle events of its servers. The default is slog.Default().
+func WithLogger[ID fmt.Stringer, State any](logger genserver.Logger) Option[ID, State] {
+	return func(g *Group[ID, State]) {
+		g.logger = logger
+		g.serverOptions = append(g.serverOptions, genserver.WithLogger[ID, State](logger))
+	}
+}
+
+// WithInterceptors wraps the handling of every message to the group's
+// servers in interceptors, as genserver.WithInterceptors does, including
+// reads with Get.
+func WithInterceptors[ID fmt.Stringer, State any](interceptors ...genserver.Interceptor[ID, State]) Option[ID, State] {
+	return func(g *Group[ID, State]) {
+		g.serverOptions = append(g.serverOptions, genserver.WithInterceptors(interceptors...))
+	}
 }
 
-func New[ID fmt.Stringer, State any](kind string, store Store[ID, State]) *Group[ID, State] {
-	return &Group[ID, State]{
+func New[ID fmt.Stringer, State any](kind string, store Store[ID, State], options ...Option[ID, State]) *Group[ID, State] {
+	g := &Group[ID, State]{
 		messagesPool: sync.NewPool[mailbox.Message[genserver.MessageHandler[State]]](),
 		kind:         kind,
 		store:        store,
+		metrics:      metrics.Nop{},
+		logger:       slog.Default(),
+	}
+	for _, option := range options {
+		option(g)
 	}
+	if expirer, ok := store.(Expirer[ID]); ok {
+		expirer.OnExpire(g.expire)
+	}
+	return g
+}
+
+// expire stops the running server for an identifier whose state expired.
+// The state is already gone, so the server is killed without loading it.
+func (g *Group[ID, State]) expire(id ID) {
+	g.emit(Expired, id, nil)
+	g.evict(context.Background(), id, genserver.Expired)
 }
 
 // Begin initiates tracking with a specific value for a given identifier
@@ -47,6 +194,7 @@ func (g *Group[ID, State]) Begin(id ID, initialState State) error {
 	if exists {
 		return fmt.Errorf("Begin(%s): cannot initiate a state for identifier `%s` that already exists", g.kind, id)
 	}
+	g.emit(Created, id, nil)
 
 	_, err = g.loadOrCreateGenServer(id)
 	if err != nil {
@@ -55,40 +203,273 @@ func (g *Group[ID, State]) Begin(id ID, initialState State) error {
 	return nil
 }
 
+// genServer returns the running server for id, creating its state and
+// starting a server as needed
+func (g *Group[ID, State]) genServer(id ID) (*genserver.GenServer[ID, State], error) {
+	gs, exist := g.genServers.Load(id)
+	if exist {
+		return gs, nil
+	}
+
+	var initialState State
+	exists, err := g.store.CreateIfNotExist(id, initialState)
+	if err != nil {
+		return nil, fmt.Errorf("Send(%s): failed to check if state for %s exists: %w", g.kind, id, err)
+	}
+	if !exists {
+		g.emit(Created, id, nil)
+	}
+
+	gs, err = g.loadOrCreateGenServer(id)
+	if err != nil {
+		return nil, fmt.Errorf("loadOrCreate state: %w", err)
+	}
+	return gs, nil
+}
+
+func (g *Group[ID, State]) newGenServer(id ID) *genserver.GenServer[ID, State] {
+	options := append([]genserver.Option[ID, State]{}, g.serverOptions...)
+	options = append(options,
+		genserver.WithMessagePool[ID](g.messagesPool),
+		genserver.WithFailureCallback(func(_ *genserver.GenServer[ID, State], err error) {
+			g.emit(HandlerFailed, id, err)
+		}))
+	return genserver.New(g.kind, id, g.store.Mutator(id), options...)
+}
+
 func (g *Group[ID, State]) loadOrCreateGenServer(id ID) (*genserver.GenServer[ID, State], error) {
 
-	res := genserver.New(g.kind, id, g.store.Get(id), genserver.WithMessagePool[ID](g.messagesPool))
+	res := g.newGenServer(id)
 
 	res, loaded := g.genServers.LoadOrStore(id, res)
 	if !loaded {
+		g.emit(Started, id, nil)
 		res.Start()
+		go g.supervise(id, res)
 	}
 	return res, nil
 }
 
-// Stop stops all state machines in this group
+// supervise waits for a server to stop, then forgets it if it stopped
+// normally or its state is gone, or replaces it with a fresh server if it
+// failed
+func (g *Group[ID, State]) supervise(id ID, gs *genserver.GenServer[ID, State]) {
+	<-gs.Terminated()
+	reason := gs.Err()
+	if errors.Is(reason, ErrNotFound) {
+		// the next message for id creates a new state and server
+		if g.genServers.CompareAndDelete(id, gs) {
+			g.emit(Stopped, id, reason)
+		}
+		return
+	}
+	if reason == nil {
+		// servers removed by Evict are no longer in the map
+		if g.genServers.CompareAndDelete(id, gs) {
+			g.emit(Stopped, id, nil)
+		}
+		return
+	}
+
+	g.stopping.RLock()
+	defer g.stopping.RUnlock()
+	if g.stopped {
+		if g.genServers.CompareAndDelete(id, gs) {
+			g.emit(Stopped, id, reason)
+		}
+		return
+	}
+	replacement := g.newGenServer(id)
+	if !g.genServers.CompareAndSwap(id, gs, replacement) {
+		return
+	}
+	g.emit(Restarted, id, reason)
+	g.metrics.Restarted(g.kind)
+	replacement.Start()
+	go g.supervise(id, replacement)
+}
+
+func noopShutdown[State any](State, genserver.ShutdownReason) error {
+	return nil
+}
+
+// Evict stops the running server for an identifier, if there is one. Its
+// state stays in the store, and the next message for it starts a new server.
+func (g *Group[ID, State]) Evict(ctx context.Context, id ID) error {
+	return g.evict(ctx, id, genserver.Normal)
+}
+
+func (g *Group[ID, State]) evict(ctx context.Context, id ID, reason genserver.ShutdownReason) error {
+	gs, loaded := g.genServers.LoadAndDelete(id)
+	if !loaded {
+		return nil
+	}
+	select {
+	case <-gs.Terminated():
+	default:
+		err := genserver.Shutdown(gs, reason, noopShutdown[State], ctx.Done())
+		if err != nil {
+			return fmt.Errorf("Evict(%s): stopping %s: %w", g.kind, id, err)
+		}
+	}
+	g.emit(Evicted, id, nil)
+	return nil
+}
+
+// Stop stops all state machines in this group, then flushes the store if it
+// buffers writes. Servers that fail from then on are not restarted. Servers
+// that fail to stop do not keep the others running or the store unflushed;
+// their errors are joined with any from flushing.
 func (g *Group[ID, State]) Stop(ctx context.Context) error {
-	var err error
+	g.stopping.Lock()
+	g.stopped = true
+	g.stopping.Unlock()
+	var errs []error
 	g.genServers.Range(func(id ID, gs *genserver.GenServer[ID, State]) bool {
-		err = genserver.Shutdown(gs, genserver.Normal, func(State, genserver.ShutdownReason) error {
-			return nil
-		}, ctx.Done())
+		select {
+		case <-gs.Terminated():
+			// failed, and not restarted now the group is stopped
+			return true
+		default:
+		}
+		err := genserver.Shutdown(gs, genserver.Normal, noopShutdown[State], ctx.Done())
 		if err != nil {
-			return false
+			errs = append(errs, fmt.Errorf("Stop(%s): stopping %s: %w", g.kind, id, err))
 		}
 		return true
 	})
-	return err
+	if flusher, ok := g.store.(Flusher); ok {
+		err := flusher.Flush(ctx)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("Stop(%s): flushing store: %w", g.kind, err))
+		}
+	}
+	return errors.Join(errs...)
 }
 
 // List outputs states of all state machines in this group
 func (g *Group[ID, State]) List() ([]State, error) {
-	return g.store.List()
+	var list []State
+	err := g.store.Iterate("", func(_ ID, state State) bool {
+		list = append(list, state)
+		return true
+	})
+	if err != nil {
+		return nil, fmt.Errorf("List(%s): %w", g.kind, err)
+	}
+	return list, nil
+}
+
+// ListEntries outputs a page of identifiers and states, ordered by ID.String()
+func (g *Group[ID, State]) ListEntries(options ListOptions[ID, State]) (Page[ID, State], error) {
+	var page Page[ID, State]
+	err := g.store.Iterate(options.Cursor, func(id ID, state State) bool {
+		if options.Filter != nil && !options.Filter(id, state) {
+			return true
+		}
+		if options.Limit > 0 && len(page.Entries) == options.Limit {
+			// another matching entry exists, so there is a next page
+			page.NextCursor = page.Entries[len(page.Entries)-1].ID.String()
+			return false
+		}
+		page.Entries = append(page.Entries, Entry[ID, State]{id, state})
+		return true
+	})
+	if err != nil {
+		return Page[ID, State]{}, fmt.Errorf("ListEntries(%s): %w", g.kind, err)
+	}
+	return page, nil
+}
+
+// Iterate calls f for every identifier and state in this group, ordered by
+// ID.String(), until f returns false. Unlike List it does not hold all states
+// in memory at once.
+func (g *Group[ID, State]) Iterate(f func(id ID, state State) bool) error {
+	err := g.store.Iterate("", f)
+	if err != nil {
+		return fmt.Errorf("Iterate(%s): %w", g.kind, err)
+	}
+	return nil
+}
+
+// Kind returns the kind of the servers in the group
+func (g *Group[ID, State]) Kind() string {
+	return g.kind
 }
 
-// Get gets state for a single state machine
-func (g *Group[ID, State]) Get(id ID) genserver.StateMutator[State] {
-	return g.store.Get(id)
+// Server returns the running server for id, if there is one, without
+// starting it
+func (g *Group[ID, State]) Server(id ID) (*genserver.GenServer[ID, State], bool) {
+	return g.genServers.Load(id)
+}
+
+// Running lists the identifiers that have a running server, in no
+// particular order
+func (g *Group[ID, State]) Running() []ID {
+	var ids []ID
+	g.genServers.Range(func(id ID, _ *genserver.GenServer[ID, State]) bool {
+		ids = append(ids, id)
+		return true
+	})
+	return ids
+}
+
+// Get gets state for a single state machine. It asks the server for the
+// state, starting one if needed, so reads pass through the server's
+// interceptors and see every message handled before them. Only if the server
+// stops before answering is the state read from the store. Unlike messages,
+// Get does not create a state that does not exist.
+func (g *Group[ID, State]) Get(id ID) (State, error) {
+	return g.GetContext(context.Background(), id)
+}
+
+// GetContext is like Get, but also stops waiting for the state once ctx is
+// done
+func (g *Group[ID, State]) GetContext(ctx context.Context, id ID) (State, error) {
+	var state State
+	gs, exist := g.genServers.Load(id)
+	if !exist {
+		has, err := g.store.Has(id)
+		if err != nil {
+			return state, fmt.Errorf("Get(%s): %w", g.kind, err)
+		}
+		if !has {
+			return state, fmt.Errorf("Get(%s): state for %s: %w", g.kind, id, ErrNotFound)
+		}
+		gs, err = g.loadOrCreateGenServer(id)
+		if err != nil {
+			return state, fmt.Errorf("Get(%s): %w", g.kind, err)
+		}
+	}
+	state, err := gs.GetContext(ctx)
+	if err == nil {
+		return state, nil
+	}
+	select {
+	case <-gs.Terminated():
+		// the server stopped before answering, and handles no more
+		// messages, so its latest state is the one in the store
+		state, err = g.store.Load(id)
+	default:
+	}
+	if err != nil {
+		return state, fmt.Errorf("Get(%s): %w", g.kind, err)
+	}
+	return state, nil
+}
+
+// Delete stops the running server for an identifier, if any, and removes its
+// state from the store
+func (g *Group[ID, State]) Delete(ctx context.Context, id ID) error {
+	err := g.Evict(ctx, id)
+	if err != nil {
+		return err
+	}
+	err = g.store.Delete(id)
+	if err != nil {
+		return fmt.Errorf("Delete(%s): %w", g.kind, err)
+	}
+	return nil
 }
 
 // Has indicates whether there is data for the given state machine
@@ -101,44 +482,53 @@ func (g *Group[ID, State]) Has(id ID) (bool, error) {
 }
 
 func Call[ID fmt.Stringer, State any, Message any, Return any](g *Group[ID, State], id ID, message Message, handler genserver.CallHandler[State, Message, Return]) (Return, error) {
-	gs, exist := g.genServers.Load(id)
-
-	if exist {
-		return genserver.Call(gs, message, handler)
-	}
+	return CallContext(context.Background(), g, id, message, handler)
+}
 
-	var initialState State
-	_, err := g.store.CreateIfNotExist(id, initialState)
-	var emptyReturn Return
+// CallContext is like Call, but also stops waiting for a reply once ctx is done
+func CallContext[ID fmt.Stringer, State any, Message any, Return any](ctx context.Context, g *Group[ID, State], id ID, message Message, handler genserver.CallHandler[State, Message, Return]) (Return, error) {
+	gs, err := g.genServer(id)
 	if err != nil {
-		return emptyReturn, fmt.Errorf("Send(%s): failed to check if state for %s exists: %w", g.kind, id, err)
+		var emptyReturn Return
+		return emptyReturn, err
 	}
 
-	gs, err = g.loadOrCreateGenServer(id)
+	return genserver.CallContext(ctx, gs, message, handler)
+}
+
+// CallWithContext is like CallContext, but handler also receives the context
+// of the message
+func CallWithContext[ID fmt.Stringer, State any, Message any, Return any](ctx context.Context, g *Group[ID, State], id ID, message Message, handler genserver.ContextCallHandler[State, Message, Return]) (Return, error) {
+	gs, err := g.genServer(id)
 	if err != nil {
-		return emptyReturn, fmt.Errorf("loadOrCreate state: %w", err)
+		var emptyReturn Return
+		return emptyReturn, err
 	}
 
-	return genserver.Call(gs, message, handler)
+	return genserver.CallWithContext(ctx, gs, message, handler)
 }
 
 func Cast[ID fmt.Stringer, State any, Message any](g *Group[ID, State], id ID, message Message, handler genserver.CastHandler[State, Message]) error {
-	gs, exist := g.genServers.Load(id)
-
-	if exist {
-		return genserver.Cast(gs, message, handler)
-	}
+	return CastContext(context.Background(), g, id, message, handler)
+}
 
-	var initialState State
-	_, err := g.store.CreateIfNotExist(id, initialState)
+// CastContext is like Cast, but sends ctx with the message
+func CastContext[ID fmt.Stringer, State any, Message any](ctx context.Context, g *Group[ID, State], id ID, message Message, handler genserver.CastHandler[State, Message]) error {
+	gs, err := g.genServer(id)
 	if err != nil {
-		return fmt.Errorf("Send(%s): failed to check if state for %s exists: %w", g.kind, id, err)
+		return err
 	}
 
-	gs, err = g.loadOrCreateGenServer(id)
+	return genserver.CastContext(ctx, gs, message, handler)
+}
+
+// CastWithContext is like CastContext, but handler also receives the context
+// of the message
+func CastWithContext[ID fmt.Stringer, State any, Message any](ctx context.Context, g *Group[ID, State], id ID, message Message, handler genserver.ContextCastHandler[State, Message]) error {
+	gs, err := g.genServer(id)
 	if err != nil {
-		return fmt.Errorf("loadOrCreate state: %w", err)
+		return err
 	}
 
-	return genserver.Cast(gs, message, handler)
+	return genserver.CastWithContext(ctx, gs, message, handler)
 }
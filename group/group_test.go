@@ -0,0 +1,434 @@
+package group_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log/slog"
+	"strconv"
+	"strings"
+	gosync "sync"
+	"testing"
+	"time"
+
+	"github.com/hannahhoward/go-genserver/genserver"
+	"github.com/hannahhoward/go-genserver/group"
+	"github.com/hannahhoward/go-genserver/store/expiry"
+	"github.com/hannahhoward/go-genserver/store/memory"
+	"github.com/stretchr/testify/require"
+)
+
+type PrintableInt int
+
+func (p PrintableInt) String() string {
+	return strconv.Itoa(int(p))
+}
+
+type counter struct {
+	Current int
+}
+
+func add(c *counter, amt int) (int, error) {
+	c.Current += amt
+	return c.Current, nil
+}
+
+func addCast(c *counter, amt int) error {
+	c.Current += amt
+	return nil
+}
+
+func TestCallAndCast(t *testing.T) {
+	g := group.New[PrintableInt, counter]("counter", memory.NewStore[PrintableInt, counter]())
+	defer g.Stop(context.Background())
+
+	require.NoError(t, g.Begin(1, counter{10}))
+	require.Error(t, g.Begin(1, counter{10}))
+
+	current, err := group.Call(g, 1, 5, add)
+	require.NoError(t, err)
+	require.Equal(t, 15, current)
+
+	// calls to unknown identifiers start from the zero state
+	current, err = group.Call(g, 2, 5, add)
+	require.NoError(t, err)
+	require.Equal(t, 5, current)
+
+	require.NoError(t, group.Cast(g, 2, 1, addCast))
+	current, err = group.Call(g, 2, 0, add)
+	require.NoError(t, err)
+	require.Equal(t, 6, current)
+	require.ElementsMatch(t, []PrintableInt{1, 2}, g.Running())
+
+	state, err := g.Get(1)
+	require.NoError(t, err)
+	require.Equal(t, counter{15}, state)
+	_, err = g.Get(3)
+	require.ErrorIs(t, err, group.ErrNotFound)
+
+	errBoom := errors.New("boom")
+	_, err = group.Call(g, 1, 5, func(c *counter, amt int) (int, error) {
+		c.Current += amt
+		return c.Current, errBoom
+	})
+	require.ErrorIs(t, err, errBoom)
+	state, err = g.Get(1)
+	require.NoError(t, err)
+	require.Equal(t, counter{15}, state)
+}
+
+func TestListEntries(t *testing.T) {
+	g := group.New[PrintableInt, counter]("counter", memory.NewStore[PrintableInt, counter]())
+	defer g.Stop(context.Background())
+	for i := 1; i <= 7; i++ {
+		require.NoError(t, g.Begin(PrintableInt(i), counter{i}))
+	}
+
+	var ids []PrintableInt
+	options := group.ListOptions[PrintableInt, counter]{
+		Limit: 3,
+		Filter: func(id PrintableInt, c counter) bool {
+			return c.Current != 2
+		},
+	}
+	pages := 0
+	for {
+		page, err := g.ListEntries(options)
+		require.NoError(t, err)
+		pages++
+		for _, entry := range page.Entries {
+			require.Equal(t, int(entry.ID), entry.State.Current)
+			ids = append(ids, entry.ID)
+		}
+		if page.NextCursor == "" {
+			break
+		}
+		options.Cursor = page.NextCursor
+	}
+	require.Equal(t, 2, pages)
+	require.Equal(t, []PrintableInt{1, 3, 4, 5, 6, 7}, ids)
+
+	list, err := g.List()
+	require.NoError(t, err)
+	require.Len(t, list, 7)
+}
+
+func TestBroadcastAndMultiCall(t *testing.T) {
+	g := group.New[PrintableInt, counter]("counter", memory.NewStore[PrintableInt, counter]())
+	defer g.Stop(context.Background())
+	for i := 1; i <= 5; i++ {
+		require.NoError(t, g.Begin(PrintableInt(i), counter{i}))
+	}
+	// stop some servers, broadcast still reaches their stored state
+	require.NoError(t, g.Evict(context.Background(), 2))
+
+	require.NoError(t, group.Broadcast(g, 10, addCast))
+
+	ids := []PrintableInt{5, 4, 3, 2, 1}
+	results := group.MultiCall(context.Background(), g, ids, 0, add, group.WithConcurrency(2))
+	require.Len(t, results, 5)
+	for i, result := range results {
+		require.Equal(t, ids[i], result.ID)
+		require.NoError(t, result.Err)
+		require.Equal(t, int(ids[i])+10, result.Return)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	results = group.MultiCall(ctx, g, ids, 0, func(c *counter, _ int) (int, error) {
+		<-ctx.Done()
+		return c.Current, nil
+	})
+	for _, result := range results {
+		require.ErrorIs(t, result.Err, context.DeadlineExceeded)
+	}
+}
+
+func TestEvents(t *testing.T) {
+	var lock gosync.Mutex
+	var kinds []group.EventKind
+	events := make(chan group.Event[PrintableInt], 10)
+	g := group.New[PrintableInt, counter]("counter", memory.NewStore[PrintableInt, counter](),
+		group.WithEventHandler[PrintableInt, counter](func(event group.Event[PrintableInt]) {
+			lock.Lock()
+			defer lock.Unlock()
+			kinds = append(kinds, event.Kind)
+			events <- event
+		}))
+
+	require.NoError(t, g.Begin(1, counter{}))
+	require.Equal(t, group.Created, (<-events).Kind)
+	require.Equal(t, group.Started, (<-events).Kind)
+
+	errBoom := errors.New("boom")
+	require.NoError(t, group.Cast(g, 1, 0, func(*counter, int) error {
+		return errBoom
+	}))
+	failed := <-events
+	require.Equal(t, group.HandlerFailed, failed.Kind)
+	require.ErrorIs(t, failed.Reason, errBoom)
+	require.Equal(t, PrintableInt(1), failed.ID)
+	require.Equal(t, "counter", failed.Group)
+	restarted := <-events
+	require.Equal(t, group.Restarted, restarted.Kind)
+	require.ErrorIs(t, restarted.Reason, errBoom)
+
+	// the restarted server keeps handling messages
+	current, err := group.Call(g, 1, 1, add)
+	require.NoError(t, err)
+	require.Equal(t, 1, current)
+
+	require.NoError(t, g.Evict(context.Background(), 1))
+	require.Equal(t, group.Evicted, (<-events).Kind)
+
+	_, err = group.Call(g, 1, 1, add)
+	require.NoError(t, err)
+	require.Equal(t, group.Started, (<-events).Kind)
+	require.NoError(t, g.Stop(context.Background()))
+	require.Equal(t, group.Stopped, (<-events).Kind)
+
+	require.NoError(t, g.Delete(context.Background(), 1))
+	has, err := g.Has(1)
+	require.NoError(t, err)
+	require.False(t, has)
+
+	lock.Lock()
+	defer lock.Unlock()
+	require.Equal(t, []group.EventKind{group.Created, group.Started, group.HandlerFailed, group.Restarted, group.Evicted, group.Started, group.Stopped}, kinds)
+}
+
+func TestExpiry(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	var lock gosync.Mutex
+	clock := func() time.Time {
+		lock.Lock()
+		defer lock.Unlock()
+		return now
+	}
+	advance := func(d time.Duration) {
+		lock.Lock()
+		defer lock.Unlock()
+		now = now.Add(d)
+	}
+	store := memory.NewStore[PrintableInt, counter](memory.WithExpiry(expiry.Config{
+		TTL:           time.Minute,
+		SweepInterval: time.Hour,
+		Clock:         clock,
+	}))
+	defer store.Close()
+	events := make(chan group.Event[PrintableInt], 10)
+	g := group.New[PrintableInt, counter]("counter", store,
+		group.WithEventHandler[PrintableInt, counter](func(event group.Event[PrintableInt]) {
+			events <- event
+		}))
+	defer g.Stop(context.Background())
+
+	nextKind := func() group.EventKind {
+		select {
+		case event := <-events:
+			return event.Kind
+		case <-time.After(5 * time.Second):
+			require.FailNow(t, "no event")
+			return 0
+		}
+	}
+
+	_, err := group.Call(g, 1, 5, add)
+	require.NoError(t, err)
+	require.Equal(t, group.Created, nextKind())
+	require.Equal(t, group.Started, nextKind())
+
+	// the sweeper stops the server of an expired state
+	advance(time.Minute)
+	require.NoError(t, store.Sweep())
+	require.Equal(t, group.Expired, nextKind())
+	require.Equal(t, group.Evicted, nextKind())
+
+	current, err := group.Call(g, 1, 1, add)
+	require.NoError(t, err)
+	require.Equal(t, 1, current)
+	require.Equal(t, group.Created, nextKind())
+	require.Equal(t, group.Started, nextKind())
+
+	// a message for a state that expired before it was swept fails, and its
+	// server is forgotten rather than restarted
+	advance(time.Minute)
+	_, err = group.Call(g, 1, 1, add)
+	require.ErrorIs(t, err, group.ErrNotFound)
+	require.Equal(t, group.HandlerFailed, nextKind())
+	require.Equal(t, group.Stopped, nextKind())
+	current, err = group.Call(g, 1, 1, add)
+	require.NoError(t, err)
+	require.Equal(t, 1, current)
+	require.Equal(t, group.Expired, nextKind())
+	require.Equal(t, group.Created, nextKind())
+	require.Equal(t, group.Started, nextKind())
+}
+
+type logBuffer struct {
+	lock gosync.Mutex
+	buf  bytes.Buffer
+}
+
+func (lb *logBuffer) Write(p []byte) (int, error) {
+	lb.lock.Lock()
+	defer lb.lock.Unlock()
+	return lb.buf.Write(p)
+}
+
+func (lb *logBuffer) String() string {
+	lb.lock.Lock()
+	defer lb.lock.Unlock()
+	return lb.buf.String()
+}
+
+func TestLogging(t *testing.T) {
+	lb := &logBuffer{}
+	logger := slog.New(slog.NewTextHandler(lb, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	restarted := make(chan struct{}, 1)
+	g := group.New[PrintableInt, counter]("counter", memory.NewStore[PrintableInt, counter](),
+		group.WithLogger[PrintableInt, counter](logger),
+		group.WithEventHandler[PrintableInt, counter](func(event group.Event[PrintableInt]) {
+			if event.Kind == group.Restarted {
+				restarted <- struct{}{}
+			}
+		}))
+	defer g.Stop(context.Background())
+
+	require.NoError(t, g.Begin(1, counter{}))
+	require.NoError(t, group.Cast(g, 1, 0, func(*counter, int) error {
+		return errors.New("boom")
+	}))
+	<-restarted
+
+	lines := strings.Split(lb.String(), "\n")
+	for _, expected := range []string{
+		`level=DEBUG msg="server created" kind=counter id=1 event=created`,
+		`level=DEBUG msg="server started" kind=counter id=1`,
+		`level=ERROR msg="processing message failed" kind=counter id=1 message=int error=boom`,
+		`level=WARN msg="server restarted" kind=counter id=1 event=restarted error=boom`,
+	} {
+		require.True(t, containsLine(lines, expected), "missing %s in:\n%s", expected, lb.String())
+	}
+}
+
+func containsLine(lines []string, fragment string) bool {
+	for _, line := range lines {
+		if strings.Contains(line, fragment) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestInterceptors(t *testing.T) {
+	var lock gosync.Mutex
+	operations := map[string]int{}
+	g := group.New[PrintableInt, counter]("counter", memory.NewStore[PrintableInt, counter](),
+		group.WithInterceptors(func(ctx context.Context, s *counter, inv genserver.Invocation[PrintableInt], next genserver.HandlerFunc[counter]) (any, error) {
+			start := time.Now()
+			reply, err := next(ctx, s)
+			lock.Lock()
+			defer lock.Unlock()
+			require.Equal(t, "counter", inv.Kind)
+			require.GreaterOrEqual(t, time.Since(start), time.Duration(0))
+			operations[inv.Operation]++
+			return reply, err
+		}))
+
+	_, err := group.Call(g, 1, 1, add)
+	require.NoError(t, err)
+	require.NoError(t, group.Cast(g, 1, 1, addCast))
+	state, err := g.Get(1)
+	require.NoError(t, err)
+	require.Equal(t, 2, state.Current)
+	require.NoError(t, g.Evict(context.Background(), 1))
+	// reads of a stopped server start it, and are intercepted too
+	state, err = g.Get(1)
+	require.NoError(t, err)
+	require.Equal(t, 2, state.Current)
+	require.NoError(t, g.Stop(context.Background()))
+
+	lock.Lock()
+	defer lock.Unlock()
+	require.Equal(t, map[string]int{"call": 1, "cast": 1, "get": 2, "shutdown": 2}, operations)
+}
+
+func TestNoRestartAfterStop(t *testing.T) {
+	events := make(chan group.Event[PrintableInt], 10)
+	g := group.New[PrintableInt, counter]("counter", memory.NewStore[PrintableInt, counter](),
+		group.WithEventHandler[PrintableInt, counter](func(event group.Event[PrintableInt]) {
+			events <- event
+		}))
+	require.NoError(t, g.Begin(1, counter{}))
+	require.Equal(t, group.Created, (<-events).Kind)
+	require.Equal(t, group.Started, (<-events).Kind)
+
+	// the server fails while Stop waits for it to shut down
+	release := make(chan struct{})
+	errBoom := errors.New("boom")
+	require.NoError(t, group.Cast(g, 1, 0, func(*counter, int) error {
+		<-release
+		return errBoom
+	}))
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- g.Stop(context.Background())
+	}()
+	gs, ok := g.Server(1)
+	require.True(t, ok)
+	require.Eventually(t, func() bool {
+		return gs.Stats().Mailbox == 1
+	}, time.Second, time.Millisecond)
+	close(release)
+	require.NoError(t, <-stopped)
+
+	require.Equal(t, group.HandlerFailed, (<-events).Kind)
+	event := <-events
+	require.Equal(t, group.Stopped, event.Kind)
+	require.ErrorIs(t, event.Reason, errBoom)
+	require.Empty(t, g.Running())
+}
+
+// flushingStore records flushes of a store that does not buffer writes
+type flushingStore struct {
+	*memory.Store[PrintableInt, counter]
+	flushed chan struct{}
+}
+
+func (fs flushingStore) Flush(context.Context) error {
+	close(fs.flushed)
+	return nil
+}
+
+func TestStopStopsEveryServer(t *testing.T) {
+	store := flushingStore{memory.NewStore[PrintableInt, counter](), make(chan struct{})}
+	g := group.New[PrintableInt, counter]("counter", store)
+	for id := PrintableInt(1); id <= 3; id++ {
+		require.NoError(t, g.Begin(id, counter{}))
+	}
+	// server 2 cannot shut down before the deadline
+	release := make(chan struct{})
+	defer close(release)
+	require.NoError(t, group.Cast(g, 2, 0, func(*counter, int) error {
+		<-release
+		return nil
+	}))
+	var others []*genserver.GenServer[PrintableInt, counter]
+	for _, id := range []PrintableInt{1, 3} {
+		gs, ok := g.Server(id)
+		require.True(t, ok)
+		others = append(others, gs)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err := g.Stop(ctx)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "stopping 2")
+
+	// the other servers stopped, and the store was flushed regardless
+	for _, gs := range others {
+		<-gs.Terminated()
+	}
+	<-store.flushed
+}
@@ -0,0 +1,94 @@
+package group
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/hannahhoward/go-genserver/genserver"
+)
+
+const defaultMultiCallConcurrency = 16
+
+// Result is the outcome of a call to a single identifier in MultiCall
+type Result[ID fmt.Stringer, Return any] struct {
+	ID     ID
+	Return Return
+	Err    error
+}
+
+type multiCallConfig struct {
+	concurrency int
+}
+
+type MultiCallOption func(*multiCallConfig)
+
+// WithConcurrency limits how many calls MultiCall has in flight at once
+func WithConcurrency(concurrency int) MultiCallOption {
+	return func(config *multiCallConfig) {
+		config.concurrency = concurrency
+	}
+}
+
+// Broadcast casts message to every entity in the group, including entities
+// that do not currently have a running server. A failed cast does not stop
+// delivery to the remaining entities; the first failure is returned.
+func Broadcast[ID fmt.Stringer, State any, Message any](g *Group[ID, State], message Message, handler genserver.CastHandler[State, Message]) error {
+	// collect identifiers first so stores are not iterated while casting
+	var ids []ID
+	err := g.store.IDs("", func(id ID) bool {
+		ids = append(ids, id)
+		return true
+	})
+	if err != nil {
+		return fmt.Errorf("Broadcast(%s): %w", g.kind, err)
+	}
+
+	var firstErr error
+	for _, id := range ids {
+		err := Cast(g, id, message, handler)
+		if err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("Broadcast(%s): cast to %s: %w", g.kind, id, err)
+		}
+	}
+	return firstErr
+}
+
+// MultiCall calls every identifier in ids with the same message, and returns
+// one result per identifier in the same order as ids. Calls share the deadline
+// of ctx, and at most WithConcurrency calls are in flight at once.
+func MultiCall[ID fmt.Stringer, State any, Message any, Return any](ctx context.Context, g *Group[ID, State], ids []ID, message Message, handler genserver.CallHandler[State, Message, Return], options ...MultiCallOption) []Result[ID, Return] {
+	config := multiCallConfig{
+		concurrency: defaultMultiCallConcurrency,
+	}
+	for _, option := range options {
+		option(&config)
+	}
+	workers := config.concurrency
+	if workers < 1 {
+		workers = 1
+	}
+	if workers > len(ids) {
+		workers = len(ids)
+	}
+
+	results := make([]Result[ID, Return], len(ids))
+	work := make(chan int)
+	done := make(chan struct{}, workers)
+	for w := 0; w < workers; w++ {
+		go func() {
+			for i := range work {
+				ret, err := CallContext(ctx, g, ids[i], message, handler)
+				results[i] = Result[ID, Return]{ids[i], ret, err}
+			}
+			done <- struct{}{}
+		}()
+	}
+	for i := range ids {
+		work <- i
+	}
+	close(work)
+	for w := 0; w < workers; w++ {
+		<-done
+	}
+	return results
+}
@@ -9,6 +9,7 @@ type Mailbox[MessageType comparable] struct {
 	tail        *Message[MessageType]
 	messagePool Pool[MessageType]
 	open        bool
+	length      int
 	lock        *sync.Mutex
 	signal      *sync.Cond
 }
@@ -47,6 +48,8 @@ func (mb *Mailbox[MessageType]) Send(message MessageType) bool {
 	}
 	newMailboxMessage := mb.messagePool.Get()
 	newMailboxMessage.message = message
+	// pooled messages may still point at whatever followed them last time
+	newMailboxMessage.next = nil
 	if mb.head == nil {
 		mb.tail = newMailboxMessage
 		mb.head = mb.tail
@@ -54,6 +57,7 @@ func (mb *Mailbox[MessageType]) Send(message MessageType) bool {
 		mb.tail.next = newMailboxMessage
 		mb.tail = mb.tail.next
 	}
+	mb.length++
 	mb.signal.Signal()
 	return true
 }
@@ -69,6 +73,7 @@ func (mb *Mailbox[MessageType]) Receive() (bool, MessageType) {
 			next := mb.head.next
 			mb.messagePool.Put(mb.head)
 			mb.head = next
+			mb.length--
 			return true, message
 		}
 
@@ -83,20 +88,33 @@ func (mb *Mailbox[MessageType]) Receive() (bool, MessageType) {
 	}
 }
 
-func (mb *Mailbox[MessageType]) Close() {
+// Close stops the mailbox accepting messages, and removes and returns those
+// still waiting, so the receiver can tell their senders they were dropped
+func (mb *Mailbox[MessageType]) Close() []MessageType {
 	mb.lock.Lock()
 	defer mb.lock.Unlock()
 
+	var dropped []MessageType
 	if mb.open {
 		mb.open = false
 		for {
 			if mb.head == nil {
 				break
 			}
+			dropped = append(dropped, mb.head.message)
 			next := mb.head.next
 			mb.messagePool.Put(mb.head)
 			mb.head = next
 		}
+		mb.length = 0
 		mb.signal.Signal()
 	}
+	return dropped
+}
+
+// Len returns how many messages are waiting to be received
+func (mb *Mailbox[MessageType]) Len() int {
+	mb.lock.Lock()
+	defer mb.lock.Unlock()
+	return mb.length
 }
@@ -53,3 +53,64 @@ func TestMessageChannel(t *testing.T) {
 	require.True(t, closed)
 	require.False(t, channel.Send(data))
 }
+
+// stackPool hands out the most recently returned message first, unlike
+// sync.Pool which gives no guarantee about reuse
+type stackPool struct {
+	messages []*mailbox.Message[int]
+}
+
+func (sp *stackPool) Put(message *mailbox.Message[int]) {
+	sp.messages = append(sp.messages, message)
+}
+
+func (sp *stackPool) Get() *mailbox.Message[int] {
+	if len(sp.messages) == 0 {
+		return new(mailbox.Message[int])
+	}
+	message := sp.messages[len(sp.messages)-1]
+	sp.messages = sp.messages[:len(sp.messages)-1]
+	return message
+}
+
+func TestSharedPool(t *testing.T) {
+	pool := &stackPool{}
+	first := mailbox.NewMailbox[int](pool)
+	second := mailbox.NewMailbox[int](pool)
+
+	require.True(t, first.Send(1))
+	require.True(t, first.Send(2))
+	more, received := first.Receive()
+	require.True(t, more)
+	require.Equal(t, 1, received)
+
+	// the recycled message must not carry over its old successor
+	require.True(t, second.Send(3))
+	more, received = second.Receive()
+	require.True(t, more)
+	require.Equal(t, 3, received)
+	require.True(t, second.Send(4))
+	more, received = second.Receive()
+	require.True(t, more)
+	require.Equal(t, 4, received)
+
+	more, received = first.Receive()
+	require.True(t, more)
+	require.Equal(t, 2, received)
+}
+
+func TestLen(t *testing.T) {
+	channel := mailbox.NewMailbox[int](sync.NewPool[mailbox.Message[int]]())
+	require.Equal(t, 0, channel.Len())
+	for i := 1; i <= 3; i++ {
+		require.True(t, channel.Send(i))
+	}
+	require.Equal(t, 3, channel.Len())
+	more, message := channel.Receive()
+	require.True(t, more)
+	require.Equal(t, 1, message)
+	require.Equal(t, 2, channel.Len())
+	require.Equal(t, []int{2, 3}, channel.Close())
+	require.Equal(t, 0, channel.Len())
+	require.Empty(t, channel.Close())
+}
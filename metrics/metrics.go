@@ -0,0 +1,37 @@
+// Package metrics defines what servers and groups measure, and exports the
+// measurements in the Prometheus text format
+package metrics
+
+import "time"
+
+// Metrics receives measurements from servers and groups, labelled by the
+// kind they were created with. Implementations must be safe for concurrent
+// use, and should not block.
+type Metrics interface {
+	// MessageHandled records a message a server of kind handled, how long
+	// handling and keeping its state change took, and the error that failed
+	// it, if any
+	MessageHandled(kind string, duration time.Duration, err error)
+	// CallTimedOut records a call that got no reply within the deadlock
+	// timeout
+	CallTimedOut(kind string)
+	// MailboxChanged records messages being queued, with a positive delta,
+	// or received or dropped, with a negative one
+	MailboxChanged(kind string, delta int)
+	// ServersChanged records servers starting, with a positive delta, or
+	// stopping, with a negative one
+	ServersChanged(kind string, delta int)
+	// Restarted records a group replacing a failed server
+	Restarted(kind string)
+}
+
+// Nop discards every measurement
+type Nop struct{}
+
+var _ Metrics = Nop{}
+
+func (Nop) MessageHandled(string, time.Duration, error) {}
+func (Nop) CallTimedOut(string)                         {}
+func (Nop) MailboxChanged(string, int)                  {}
+func (Nop) ServersChanged(string, int)                  {}
+func (Nop) Restarted(string)                            {}
@@ -0,0 +1,201 @@
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	gosync "sync"
+	"time"
+)
+
+// DefaultBuckets are the upper bounds, in seconds, of the handler latency
+// histogram, unless configured otherwise
+var DefaultBuckets = []float64{.0005, .001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+type prometheusConfig struct {
+	namespace string
+	buckets   []float64
+}
+
+type Option func(*prometheusConfig)
+
+// WithNamespace sets the prefix of every metric name. The default is
+// "genserver".
+func WithNamespace(namespace string) Option {
+	return func(config *prometheusConfig) {
+		config.namespace = namespace
+	}
+}
+
+// WithBuckets sets the upper bounds, in seconds, of the handler latency
+// histogram. The default is DefaultBuckets.
+func WithBuckets(buckets ...float64) Option {
+	return func(config *prometheusConfig) {
+		config.buckets = buckets
+	}
+}
+
+// series holds the measurements of one kind
+type series struct {
+	messages uint64
+	errors   uint64
+	timeouts uint64
+	mailbox  int64
+	servers  int64
+	restarts uint64
+	// buckets counts handled messages by the first bucket they fit in, with
+	// a last count for those that fit in none
+	buckets []uint64
+	sum     float64
+}
+
+// Prometheus keeps measurements in memory, and serves them over HTTP in the
+// Prometheus text exposition format
+type Prometheus struct {
+	config prometheusConfig
+
+	lock  gosync.Mutex
+	kinds map[string]*series
+}
+
+var _ Metrics = (*Prometheus)(nil)
+
+var _ http.Handler = (*Prometheus)(nil)
+
+// NewPrometheus returns an exporter without measurements
+func NewPrometheus(options ...Option) *Prometheus {
+	config := prometheusConfig{
+		namespace: "genserver",
+		buckets:   DefaultBuckets,
+	}
+	for _, option := range options {
+		option(&config)
+	}
+	config.buckets = append([]float64(nil), config.buckets...)
+	sort.Float64s(config.buckets)
+	return &Prometheus{
+		config: config,
+		kinds:  make(map[string]*series),
+	}
+}
+
+// series returns the measurements of kind. The caller holds p.lock.
+func (p *Prometheus) series(kind string) *series {
+	s, ok := p.kinds[kind]
+	if !ok {
+		s = &series{buckets: make([]uint64, len(p.config.buckets)+1)}
+		p.kinds[kind] = s
+	}
+	return s
+}
+
+func (p *Prometheus) MessageHandled(kind string, duration time.Duration, err error) {
+	seconds := duration.Seconds()
+	bucket := sort.SearchFloat64s(p.config.buckets, seconds)
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	s := p.series(kind)
+	s.messages++
+	if err != nil {
+		s.errors++
+	}
+	s.buckets[bucket]++
+	s.sum += seconds
+}
+
+func (p *Prometheus) CallTimedOut(kind string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.series(kind).timeouts++
+}
+
+func (p *Prometheus) MailboxChanged(kind string, delta int) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.series(kind).mailbox += int64(delta)
+}
+
+func (p *Prometheus) ServersChanged(kind string, delta int) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.series(kind).servers += int64(delta)
+}
+
+func (p *Prometheus) Restarted(kind string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.series(kind).restarts++
+}
+
+// ServeHTTP writes every measurement
+func (p *Prometheus) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var buf bytes.Buffer
+	p.write(&buf)
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write(buf.Bytes())
+}
+
+// metric is a family of samples with one sample per kind
+type metric struct {
+	name       string
+	help       string
+	metricType string
+	value      func(s *series) string
+}
+
+func (p *Prometheus) write(buf *bytes.Buffer) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	kinds := make([]string, 0, len(p.kinds))
+	for kind := range p.kinds {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+
+	counter := func(f func(s *series) uint64) func(s *series) string {
+		return func(s *series) string { return strconv.FormatUint(f(s), 10) }
+	}
+	gauge := func(f func(s *series) int64) func(s *series) string {
+		return func(s *series) string { return strconv.FormatInt(f(s), 10) }
+	}
+	metrics := []metric{
+		{"messages_total", "Messages handled by servers.", "counter", counter(func(s *series) uint64 { return s.messages })},
+		{"handler_errors_total", "Messages whose handler or state change failed.", "counter", counter(func(s *series) uint64 { return s.errors })},
+		{"call_timeouts_total", "Calls that got no reply within the deadlock timeout.", "counter", counter(func(s *series) uint64 { return s.timeouts })},
+		{"mailbox_depth", "Messages waiting to be handled.", "gauge", gauge(func(s *series) int64 { return s.mailbox })},
+		{"active_servers", "Servers running.", "gauge", gauge(func(s *series) int64 { return s.servers })},
+		{"restarts_total", "Failed servers replaced by their group.", "counter", counter(func(s *series) uint64 { return s.restarts })},
+	}
+	for _, m := range metrics {
+		name := p.config.namespace + "_" + m.name
+		fmt.Fprintf(buf, "# HELP %s %s\n# TYPE %s %s\n", name, m.help, name, m.metricType)
+		for _, kind := range kinds {
+			fmt.Fprintf(buf, "%s{kind=%s} %s\n", name, quote(kind), m.value(p.kinds[kind]))
+		}
+	}
+
+	name := p.config.namespace + "_handler_duration_seconds"
+	fmt.Fprintf(buf, "# HELP %s Time taken to handle a message and keep its state change.\n# TYPE %s histogram\n", name, name)
+	for _, kind := range kinds {
+		s := p.kinds[kind]
+		label := quote(kind)
+		var cumulative uint64
+		for i, bound := range p.config.buckets {
+			cumulative += s.buckets[i]
+			fmt.Fprintf(buf, "%s_bucket{kind=%s,le=%q} %d\n", name, label, strconv.FormatFloat(bound, 'g', -1, 64), cumulative)
+		}
+		fmt.Fprintf(buf, "%s_bucket{kind=%s,le=\"+Inf\"} %d\n", name, label, s.messages)
+		fmt.Fprintf(buf, "%s_sum{kind=%s} %s\n", name, label, strconv.FormatFloat(s.sum, 'g', -1, 64))
+		fmt.Fprintf(buf, "%s_count{kind=%s} %d\n", name, label, s.messages)
+	}
+}
+
+// labelEscaper escapes label values as the text format requires
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func quote(value string) string {
+	return `"` + labelEscaper.Replace(value) + `"`
+}
@@ -0,0 +1,132 @@
+package metrics_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hannahhoward/go-genserver/group"
+	"github.com/hannahhoward/go-genserver/metrics"
+	"github.com/hannahhoward/go-genserver/store/memory"
+	"github.com/stretchr/testify/require"
+)
+
+type PrintableInt int
+
+func (p PrintableInt) String() string {
+	return strconv.Itoa(int(p))
+}
+
+type counter struct {
+	Current int
+}
+
+func add(c *counter, amt int) (int, error) {
+	c.Current += amt
+	return c.Current, nil
+}
+
+func scrape(t *testing.T, p *metrics.Prometheus) string {
+	recorder := httptest.NewRecorder()
+	p.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	require.Equal(t, "text/plain; version=0.0.4; charset=utf-8", recorder.Header().Get("Content-Type"))
+	body, err := io.ReadAll(recorder.Body)
+	require.NoError(t, err)
+	return string(body)
+}
+
+func TestExposition(t *testing.T) {
+	p := metrics.NewPrometheus(metrics.WithNamespace("app"), metrics.WithBuckets(1, 0.1))
+	p.MessageHandled("counter", 50*time.Millisecond, nil)
+	p.MessageHandled("counter", 500*time.Millisecond, errors.New("boom"))
+	p.MessageHandled("counter", 2*time.Second, nil)
+	p.CallTimedOut("counter")
+	p.MailboxChanged("counter", 3)
+	p.MailboxChanged("counter", -1)
+	p.ServersChanged(`odd "kind"`, 1)
+	p.Restarted("counter")
+
+	require.Equal(t, `# HELP app_messages_total Messages handled by servers.
+# TYPE app_messages_total counter
+app_messages_total{kind="counter"} 3
+app_messages_total{kind="odd \"kind\""} 0
+# HELP app_handler_errors_total Messages whose handler or state change failed.
+# TYPE app_handler_errors_total counter
+app_handler_errors_total{kind="counter"} 1
+app_handler_errors_total{kind="odd \"kind\""} 0
+# HELP app_call_timeouts_total Calls that got no reply within the deadlock timeout.
+# TYPE app_call_timeouts_total counter
+app_call_timeouts_total{kind="counter"} 1
+app_call_timeouts_total{kind="odd \"kind\""} 0
+# HELP app_mailbox_depth Messages waiting to be handled.
+# TYPE app_mailbox_depth gauge
+app_mailbox_depth{kind="counter"} 2
+app_mailbox_depth{kind="odd \"kind\""} 0
+# HELP app_active_servers Servers running.
+# TYPE app_active_servers gauge
+app_active_servers{kind="counter"} 0
+app_active_servers{kind="odd \"kind\""} 1
+# HELP app_restarts_total Failed servers replaced by their group.
+# TYPE app_restarts_total counter
+app_restarts_total{kind="counter"} 1
+app_restarts_total{kind="odd \"kind\""} 0
+# HELP app_handler_duration_seconds Time taken to handle a message and keep its state change.
+# TYPE app_handler_duration_seconds histogram
+app_handler_duration_seconds_bucket{kind="counter",le="0.1"} 1
+app_handler_duration_seconds_bucket{kind="counter",le="1"} 2
+app_handler_duration_seconds_bucket{kind="counter",le="+Inf"} 3
+app_handler_duration_seconds_sum{kind="counter"} 2.55
+app_handler_duration_seconds_count{kind="counter"} 3
+app_handler_duration_seconds_bucket{kind="odd \"kind\"",le="0.1"} 0
+app_handler_duration_seconds_bucket{kind="odd \"kind\"",le="1"} 0
+app_handler_duration_seconds_bucket{kind="odd \"kind\"",le="+Inf"} 0
+app_handler_duration_seconds_sum{kind="odd \"kind\""} 0
+app_handler_duration_seconds_count{kind="odd \"kind\""} 0
+`, scrape(t, p))
+}
+
+func TestGroupMetrics(t *testing.T) {
+	p := metrics.NewPrometheus()
+	restarted := make(chan struct{}, 1)
+	g := group.New[PrintableInt, counter]("counter", memory.NewStore[PrintableInt, counter](),
+		group.WithMetrics[PrintableInt, counter](p),
+		group.WithEventHandler[PrintableInt, counter](func(event group.Event[PrintableInt]) {
+			if event.Kind == group.Restarted {
+				restarted <- struct{}{}
+			}
+		}))
+	for _, id := range []PrintableInt{1, 2} {
+		_, err := group.Call(g, id, 1, add)
+		require.NoError(t, err)
+	}
+	_, err := group.Call(g, 1, 1, func(*counter, int) (int, error) {
+		return 0, errors.New("boom")
+	})
+	require.Error(t, err)
+	// the failed server is replaced, and the replacement handles messages
+	<-restarted
+	_, err = group.Call(g, 1, 1, add)
+	require.NoError(t, err)
+
+	body := scrape(t, p)
+	for _, line := range []string{
+		`genserver_messages_total{kind="counter"} 4`,
+		`genserver_handler_errors_total{kind="counter"} 1`,
+		`genserver_mailbox_depth{kind="counter"} 0`,
+		`genserver_active_servers{kind="counter"} 2`,
+		`genserver_restarts_total{kind="counter"} 1`,
+		`genserver_handler_duration_seconds_count{kind="counter"} 4`,
+	} {
+		require.Contains(t, strings.Split(body, "\n"), line)
+	}
+
+	require.NoError(t, g.Stop(context.Background()))
+	require.Eventually(t, func() bool {
+		return strings.Contains(scrape(t, p), `genserver_active_servers{kind="counter"} 0`)
+	}, time.Second, time.Millisecond)
+}
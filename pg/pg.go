@@ -0,0 +1,149 @@
+// Package pg groups servers of any state type under named topics, so a
+// message can be cast to every member of a topic
+package pg
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/hannahhoward/go-genserver/genserver"
+)
+
+// ErrAlreadyJoined is returned when a server joins a topic it is a member of
+var ErrAlreadyJoined = errors.New("already joined")
+
+// member is a server's membership of one topic. cast delivers a published
+// message with the handler the server joined with.
+type member struct {
+	cast       func(message any) error
+	terminated <-chan struct{}
+	left       chan struct{}
+}
+
+// Scope holds a set of topics and their members. Members are removed
+// automatically when their server terminates.
+type Scope struct {
+	lock   sync.Mutex
+	topics map[string]map[any]*member
+}
+
+// New returns a scope without topics
+func New() *Scope {
+	return &Scope{topics: make(map[string]map[any]*member)}
+}
+
+// Join adds server to topic. Messages published to topic are cast to server
+// with handler, and must be of type Message.
+func Join[ID fmt.Stringer, State any, Message any](s *Scope, topic string, server *genserver.GenServer[ID, State], handler genserver.CastHandler[State, Message]) error {
+	m := &member{
+		cast: func(message any) error {
+			typed, ok := message.(Message)
+			if !ok {
+				var want Message
+				return fmt.Errorf("server %s in topic %s takes %T messages, not %T", server.ID(), topic, want, message)
+			}
+			return genserver.Cast(server, typed, handler)
+		},
+		terminated: server.Terminated(),
+		left:       make(chan struct{}),
+	}
+	select {
+	case <-server.Terminated():
+		return fmt.Errorf("Join(%s): server %s has terminated", topic, server.ID())
+	default:
+	}
+	s.lock.Lock()
+	members, ok := s.topics[topic]
+	if !ok {
+		members = make(map[any]*member)
+		s.topics[topic] = members
+	}
+	if _, joined := members[server]; joined {
+		s.lock.Unlock()
+		return fmt.Errorf("Join(%s): server %s: %w", topic, server.ID(), ErrAlreadyJoined)
+	}
+	members[server] = m
+	s.lock.Unlock()
+	go func() {
+		select {
+		case <-server.Terminated():
+			s.remove(topic, server, m)
+		case <-m.left:
+		}
+	}()
+	return nil
+}
+
+// Leave removes server from topic, if it is a member
+func Leave[ID fmt.Stringer, State any](s *Scope, topic string, server *genserver.GenServer[ID, State]) {
+	s.lock.Lock()
+	m, ok := s.topics[topic][server]
+	s.lock.Unlock()
+	if ok && s.remove(topic, server, m) {
+		close(m.left)
+	}
+}
+
+// remove deletes the membership m of server, if it is current, and reports
+// whether it did
+func (s *Scope) remove(topic string, server any, m *member) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	members := s.topics[topic]
+	if members[server] != m {
+		return false
+	}
+	delete(members, server)
+	if len(members) == 0 {
+		delete(s.topics, topic)
+	}
+	return true
+}
+
+// Topics lists the topics with members, in order
+func (s *Scope) Topics() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	topics := make([]string, 0, len(s.topics))
+	for topic := range s.topics {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics)
+	return topics
+}
+
+// Members returns how many servers are members of topic
+func (s *Scope) Members(topic string) int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return len(s.topics[topic])
+}
+
+// Publish casts message to every member of topic, and returns how many it was
+// sent to. Members that terminated are skipped, and any other failures are
+// returned together.
+func Publish[Message any](s *Scope, topic string, message Message) (int, error) {
+	s.lock.Lock()
+	members := make([]*member, 0, len(s.topics[topic]))
+	for _, m := range s.topics[topic] {
+		members = append(members, m)
+	}
+	s.lock.Unlock()
+	sent := 0
+	var errs []error
+	for _, m := range members {
+		err := m.cast(message)
+		if err == nil {
+			sent++
+			continue
+		}
+		select {
+		case <-m.terminated:
+		default:
+			errs = append(errs, err)
+		}
+	}
+	return sent, errors.Join(errs...)
+}
@@ -0,0 +1,90 @@
+package pg_test
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/hannahhoward/go-genserver/genserver"
+	"github.com/hannahhoward/go-genserver/pg"
+	"github.com/hannahhoward/go-genserver/store/memory"
+	"github.com/stretchr/testify/require"
+)
+
+type PrintableInt int
+
+func (p PrintableInt) String() string {
+	return strconv.Itoa(int(p))
+}
+
+type session struct {
+	Notices []string
+}
+
+type tenant struct {
+	Changes int
+}
+
+type configChanged struct {
+	Setting string
+}
+
+func spawn[State any](t *testing.T, id PrintableInt) *genserver.GenServer[PrintableInt, State] {
+	store := memory.NewStore[PrintableInt, State]()
+	var state State
+	_, err := store.CreateIfNotExist(id, state)
+	require.NoError(t, err)
+	return genserver.Spawn("pg", id, store.Mutator(id))
+}
+
+func TestPublish(t *testing.T) {
+	scope := pg.New()
+	first, second := spawn[session](t, 1), spawn[session](t, 2)
+	owner := spawn[tenant](t, 3)
+	notify := func(s *session, c configChanged) error {
+		s.Notices = append(s.Notices, c.Setting)
+		return nil
+	}
+	require.NoError(t, pg.Join(scope, "tenant", first, notify))
+	require.NoError(t, pg.Join(scope, "tenant", second, notify))
+	require.ErrorIs(t, pg.Join(scope, "tenant", second, notify), pg.ErrAlreadyJoined)
+	require.NoError(t, pg.Join(scope, "tenant", owner, func(s *tenant, c configChanged) error {
+		s.Changes++
+		return nil
+	}))
+	require.NoError(t, pg.Join(scope, "other", first, notify))
+	require.Equal(t, []string{"other", "tenant"}, scope.Topics())
+	require.Equal(t, 3, scope.Members("tenant"))
+
+	sent, err := pg.Publish(scope, "tenant", configChanged{"theme"})
+	require.NoError(t, err)
+	require.Equal(t, 3, sent)
+	state, err := second.Get()
+	require.NoError(t, err)
+	require.Equal(t, []string{"theme"}, state.Notices)
+	owned, err := owner.Get()
+	require.NoError(t, err)
+	require.Equal(t, 1, owned.Changes)
+
+	// messages of the wrong type are refused
+	_, err = pg.Publish(scope, "tenant", "theme")
+	require.Error(t, err)
+
+	pg.Leave(scope, "tenant", second)
+	require.Equal(t, 2, scope.Members("tenant"))
+
+	// terminated servers leave every topic
+	require.NoError(t, genserver.Shutdown(first, genserver.Normal, func(session, genserver.ShutdownReason) error {
+		return nil
+	}, nil))
+	require.Eventually(t, func() bool {
+		return scope.Members("tenant") == 1 && scope.Members("other") == 0
+	}, time.Second, time.Millisecond)
+	require.Equal(t, []string{"tenant"}, scope.Topics())
+	sent, err = pg.Publish(scope, "tenant", configChanged{"locale"})
+	require.NoError(t, err)
+	require.Equal(t, 1, sent)
+	state, err = second.Get()
+	require.NoError(t, err)
+	require.Equal(t, []string{"theme"}, state.Notices)
+}
@@ -0,0 +1,114 @@
+// Package registry looks up running GenServers by name
+package registry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/hannahhoward/go-genserver/genserver"
+	"github.com/hannahhoward/go-genserver/sync"
+)
+
+// ErrAlreadyRegistered is returned when registering a name that is taken
+var ErrAlreadyRegistered = errors.New("name already registered")
+
+// ErrNotRegistered is returned when no server is registered under a name
+var ErrNotRegistered = errors.New("name not registered")
+
+// registration is a registered server. Each registration is distinct, so a
+// server registered again under the same name is not removed by the watcher
+// of its previous registration.
+type registration struct {
+	server any
+}
+
+// Registry maps unique names to servers of any state type. Servers are
+// unregistered automatically when they terminate.
+type Registry struct {
+	names sync.Map[string, *registration]
+}
+
+// New returns an empty registry
+func New() *Registry {
+	return &Registry{}
+}
+
+// Register registers server under name, until it terminates or is
+// unregistered
+func Register[ID fmt.Stringer, State any](r *Registry, name string, server *genserver.GenServer[ID, State]) error {
+	select {
+	case <-server.Terminated():
+		return fmt.Errorf("Register(%s): server %s has terminated", name, server.ID())
+	default:
+	}
+	reg := &registration{server}
+	_, loaded := r.names.LoadOrStore(name, reg)
+	if loaded {
+		return fmt.Errorf("Register(%s): %w", name, ErrAlreadyRegistered)
+	}
+	go func() {
+		<-server.Terminated()
+		r.names.CompareAndDelete(name, reg)
+	}()
+	return nil
+}
+
+// Unregister removes the server registered under name, if any. The server
+// keeps running.
+func (r *Registry) Unregister(name string) {
+	r.names.Delete(name)
+}
+
+// Names lists the registered names in order
+func (r *Registry) Names() []string {
+	var names []string
+	r.names.Range(func(name string, _ *registration) bool {
+		names = append(names, name)
+		return true
+	})
+	sort.Strings(names)
+	return names
+}
+
+// Lookup returns the server registered under name. It fails if there is none,
+// or if the server has a different identifier or state type.
+func Lookup[ID fmt.Stringer, State any](r *Registry, name string) (*genserver.GenServer[ID, State], error) {
+	reg, ok := r.names.Load(name)
+	if !ok {
+		return nil, fmt.Errorf("Lookup(%s): %w", name, ErrNotRegistered)
+	}
+	server, ok := reg.server.(*genserver.GenServer[ID, State])
+	if !ok {
+		return nil, fmt.Errorf("Lookup(%s): registered server is a %T", name, reg.server)
+	}
+	return server, nil
+}
+
+// CallName is like genserver.Call, but sends to the server registered under
+// name at the time of the call
+func CallName[ID fmt.Stringer, State any, Message any, Return any](r *Registry, name string, message Message, handler genserver.CallHandler[State, Message, Return]) (Return, error) {
+	return CallNameContext[ID](context.Background(), r, name, message, handler)
+}
+
+// CallNameContext is like CallName, but also stops waiting for a reply once
+// ctx is done
+func CallNameContext[ID fmt.Stringer, State any, Message any, Return any](ctx context.Context, r *Registry, name string, message Message, handler genserver.CallHandler[State, Message, Return]) (Return, error) {
+	server, err := Lookup[ID, State](r, name)
+	if err != nil {
+		var empty Return
+		return empty, err
+	}
+	return genserver.CallContext(ctx, server, message, handler)
+}
+
+// CastName is like genserver.Cast, but sends to the server registered under
+// name at the time of the cast
+func CastName[ID fmt.Stringer, State any, Message any](r *Registry, name string, message Message, handler genserver.CastHandler[State, Message]) error {
+	server, err := Lookup[ID, State](r, name)
+	if err != nil {
+		return err
+	}
+	return genserver.Cast(server, message, handler)
+}
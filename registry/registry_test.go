@@ -0,0 +1,87 @@
+package registry_test
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/hannahhoward/go-genserver/genserver"
+	"github.com/hannahhoward/go-genserver/registry"
+	"github.com/hannahhoward/go-genserver/store/memory"
+	"github.com/stretchr/testify/require"
+)
+
+type PrintableInt int
+
+func (p PrintableInt) String() string {
+	return strconv.Itoa(int(p))
+}
+
+type counter struct {
+	Current int
+}
+
+func add(c *counter, amt int) (int, error) {
+	c.Current += amt
+	return c.Current, nil
+}
+
+func addCast(c *counter, amt int) error {
+	c.Current += amt
+	return nil
+}
+
+func spawn(t *testing.T, id PrintableInt) *genserver.GenServer[PrintableInt, counter] {
+	store := memory.NewStore[PrintableInt, counter]()
+	_, err := store.CreateIfNotExist(id, counter{})
+	require.NoError(t, err)
+	return genserver.Spawn("counter", id, store.Mutator(id))
+}
+
+func stop(t *testing.T, server *genserver.GenServer[PrintableInt, counter]) {
+	require.NoError(t, genserver.Shutdown(server, genserver.Normal, func(counter, genserver.ShutdownReason) error {
+		return nil
+	}, nil))
+}
+
+func TestRegistry(t *testing.T) {
+	r := registry.New()
+	first, second := spawn(t, 1), spawn(t, 2)
+	require.NoError(t, registry.Register(r, "first", first))
+	require.ErrorIs(t, registry.Register(r, "first", second), registry.ErrAlreadyRegistered)
+	require.NoError(t, registry.Register(r, "second", second))
+	require.Equal(t, []string{"first", "second"}, r.Names())
+
+	server, err := registry.Lookup[PrintableInt, counter](r, "first")
+	require.NoError(t, err)
+	require.Same(t, first, server)
+	_, err = registry.Lookup[PrintableInt, string](r, "first")
+	require.Error(t, err)
+	_, err = registry.Lookup[PrintableInt, counter](r, "third")
+	require.ErrorIs(t, err, registry.ErrNotRegistered)
+
+	require.NoError(t, registry.CastName[PrintableInt](r, "first", 2, addCast))
+	current, err := registry.CallName[PrintableInt](r, "first", 3, add)
+	require.NoError(t, err)
+	require.Equal(t, 5, current)
+	_, err = registry.CallNameContext[PrintableInt](context.Background(), r, "third", 3, add)
+	require.ErrorIs(t, err, registry.ErrNotRegistered)
+	require.ErrorIs(t, registry.CastName[PrintableInt](r, "third", 1, addCast), registry.ErrNotRegistered)
+
+	// terminated servers are unregistered
+	stop(t, first)
+	require.Eventually(t, func() bool {
+		_, err := registry.Lookup[PrintableInt, counter](r, "first")
+		return err != nil
+	}, time.Second, time.Millisecond)
+	require.Error(t, registry.Register(r, "first", first))
+
+	// the name can be taken again, and the old watcher leaves it alone
+	r.Unregister("second")
+	require.NoError(t, registry.Register(r, "first", second))
+	current, err = registry.CallName[PrintableInt](r, "first", 1, add)
+	require.NoError(t, err)
+	require.Equal(t, 1, current)
+	stop(t, second)
+}
@@ -0,0 +1,199 @@
+package remote
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	gosync "sync"
+	"time"
+)
+
+type clientConfig struct {
+	callTimeout time.Duration
+}
+
+type Option func(*clientConfig)
+
+// WithCallTimeout sets how long calls wait for a reply before failing with
+// ErrTimeout. The remote node stops waiting for the server after the same
+// time. The default is DefaultCallTimeout.
+func WithCallTimeout(timeout time.Duration) Option {
+	return func(config *clientConfig) {
+		config.callTimeout = timeout
+	}
+}
+
+// Client sends messages to the servers of a node over a single connection.
+// It is safe for concurrent use.
+type Client struct {
+	conn   net.Conn
+	config clientConfig
+
+	writeLock gosync.Mutex
+
+	lock    gosync.Mutex
+	nextID  uint64
+	pending map[uint64]chan envelope
+	err     error
+	closed  chan struct{}
+}
+
+// Dial connects to the node listening on address
+func Dial(ctx context.Context, address string, options ...Option) (*Client, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	return NewClient(conn, options...), nil
+}
+
+// NewClient returns a client sending messages over conn, which it closes when
+// the client is closed
+func NewClient(conn net.Conn, options ...Option) *Client {
+	config := clientConfig{
+		callTimeout: DefaultCallTimeout,
+	}
+	for _, option := range options {
+		option(&config)
+	}
+	c := &Client{
+		conn:    conn,
+		config:  config,
+		pending: make(map[uint64]chan envelope),
+		closed:  make(chan struct{}),
+	}
+	go c.readLoop()
+	return c
+}
+
+// Close closes the connection. Messages waiting for a reply fail with
+// ErrClosed.
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+func (c *Client) readLoop() {
+	reader := bufio.NewReader(c.conn)
+	for {
+		reply, err := readFrame(reader)
+		if err != nil {
+			c.lock.Lock()
+			c.err = fmt.Errorf("%w: %s", ErrClosed, err)
+			c.lock.Unlock()
+			close(c.closed)
+			c.conn.Close()
+			return
+		}
+		c.lock.Lock()
+		replies, ok := c.pending[reply.ID]
+		delete(c.pending, reply.ID)
+		c.lock.Unlock()
+		if ok {
+			replies <- reply
+		}
+	}
+}
+
+// send sends request, and waits for the reply to it. Writing it fails once
+// the call times out or ctx is done, closing the connection.
+func (c *Client) send(ctx context.Context, request envelope, message any) ([]byte, error) {
+	body, err := json.Marshal(message)
+	if err != nil {
+		return nil, fmt.Errorf("Could not encode message for %s: %w", request.Handler, err)
+	}
+	request.Body = body
+	request.Timeout = c.config.callTimeout
+	replies := make(chan envelope, 1)
+	c.lock.Lock()
+	if c.err != nil {
+		err := c.err
+		c.lock.Unlock()
+		return nil, err
+	}
+	c.nextID++
+	request.ID = c.nextID
+	c.pending[request.ID] = replies
+	c.lock.Unlock()
+	defer func() {
+		c.lock.Lock()
+		delete(c.pending, request.ID)
+		c.lock.Unlock()
+	}()
+
+	timer := time.NewTimer(c.config.callTimeout)
+	defer timer.Stop()
+	deadline := time.Now().Add(c.config.callTimeout)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+
+	c.writeLock.Lock()
+	if err := ctx.Err(); err != nil {
+		c.writeLock.Unlock()
+		return nil, err
+	}
+	err = writeFrame(c.conn, request, deadline)
+	c.writeLock.Unlock()
+	switch {
+	case err == nil:
+	case ctx.Err() != nil:
+		return nil, ctx.Err()
+	case errors.Is(err, os.ErrDeadlineExceeded):
+		return nil, c.timeout(request)
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrClosed, err)
+	}
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-timer.C:
+		return nil, c.timeout(request)
+	case <-c.closed:
+		c.lock.Lock()
+		defer c.lock.Unlock()
+		return nil, c.err
+	case reply := <-replies:
+		if reply.Error != nil {
+			return nil, reply.Error
+		}
+		return reply.Body, nil
+	}
+}
+
+func (c *Client) timeout(request envelope) error {
+	return &Error{Code: codeTimeout, Message: fmt.Sprintf("no reply from %s to %s after %s", request.Server, request.Handler, c.config.callTimeout)}
+}
+
+// Call is like genserver.Call, but calls the server registered under server
+// on the remote node, with the call handler registered under handler
+func Call[Message any, Return any](c *Client, server string, handler string, message Message) (Return, error) {
+	return CallContext[Message, Return](context.Background(), c, server, handler, message)
+}
+
+// CallContext is like Call, but also stops waiting for a reply once ctx is
+// done
+func CallContext[Message any, Return any](ctx context.Context, c *Client, server string, handler string, message Message) (Return, error) {
+	var reply Return
+	body, err := c.send(ctx, envelope{Kind: kindCall, Server: server, Handler: handler}, message)
+	if err != nil {
+		return reply, err
+	}
+	if err := json.Unmarshal(body, &reply); err != nil {
+		return reply, fmt.Errorf("Could not decode reply from %s: %w", handler, err)
+	}
+	return reply, nil
+}
+
+// Cast is like genserver.Cast, but casts to the server registered under
+// server on the remote node, with the cast handler registered under handler.
+// It returns once the message is queued, or fails if it could not be.
+func Cast[Message any](c *Client, server string, handler string, message Message) error {
+	_, err := c.send(context.Background(), envelope{Kind: kindCast, Server: server, Handler: handler}, message)
+	return err
+}
@@ -0,0 +1,248 @@
+package remote
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	gosync "sync"
+	"time"
+
+	"github.com/hannahhoward/go-genserver/genserver"
+	"github.com/hannahhoward/go-genserver/registry"
+)
+
+// handler handles the body of one request for target, returning the body of
+// the reply
+type handler func(ctx context.Context, target string, body []byte) ([]byte, error)
+
+// Node serves calls and casts to the servers of a registry
+type Node struct {
+	registry *registry.Registry
+
+	lock      gosync.Mutex
+	calls     map[string]handler
+	casts     map[string]handler
+	listeners map[net.Listener]struct{}
+	conns     map[net.Conn]struct{}
+	closed    bool
+}
+
+// NewNode returns a node serving the servers registered in r
+func NewNode(r *registry.Registry) *Node {
+	return &Node{
+		registry:  r,
+		calls:     make(map[string]handler),
+		casts:     make(map[string]handler),
+		listeners: make(map[net.Listener]struct{}),
+		conns:     make(map[net.Conn]struct{}),
+	}
+}
+
+func (n *Node) handle(handlers map[string]handler, name string, h handler) error {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if _, ok := handlers[name]; ok {
+		return fmt.Errorf("handler %s is already registered", name)
+	}
+	handlers[name] = h
+	return nil
+}
+
+// HandleCall registers handler under name, so clients can call registered
+// servers with it. The servers must have identifiers of type ID and states of
+// type State.
+func HandleCall[ID fmt.Stringer, State any, Message any, Return any](n *Node, name string, handler genserver.CallHandler[State, Message, Return]) error {
+	return HandleCallFunc(n, name, func(ctx context.Context, target string, message Message) (Return, error) {
+		server, err := registry.Lookup[ID, State](n.registry, target)
+		if err != nil {
+			var empty Return
+			return empty, err
+		}
+		reply, err := genserver.CallContext(ctx, server, message, handler)
+		var timeout genserver.CallTimeoutError[ID]
+		if errors.As(err, &timeout) {
+			return reply, fmt.Errorf("%w: %s", ErrTimeout, err)
+		}
+		return reply, err
+	})
+}
+
+// HandleCast registers handler under name, so clients can cast to registered
+// servers with it. The servers must have identifiers of type ID and states of
+// type State.
+func HandleCast[ID fmt.Stringer, State any, Message any](n *Node, name string, handler genserver.CastHandler[State, Message]) error {
+	return HandleCastFunc(n, name, func(ctx context.Context, target string, message Message) error {
+		server, err := registry.Lookup[ID, State](n.registry, target)
+		if err != nil {
+			return err
+		}
+		return genserver.Cast(server, message, handler)
+	})
+}
+
+// HandleCallFunc registers f under name, to handle calls itself rather than
+// pass them to a registered server. f receives the server name the client
+// gave as target. Errors matching ErrTimeout or registry.ErrNotRegistered
+// still match them on the client.
+func HandleCallFunc[Message any, Return any](n *Node, name string, f func(ctx context.Context, target string, message Message) (Return, error)) error {
+	return n.handle(n.calls, name, func(ctx context.Context, target string, body []byte) ([]byte, error) {
+		var message Message
+		if err := json.Unmarshal(body, &message); err != nil {
+			return nil, fmt.Errorf("Could not decode message for %s: %w", name, err)
+		}
+		reply, err := f(ctx, target, message)
+		if err != nil {
+			return nil, err
+		}
+		return json.Marshal(reply)
+	})
+}
+
+// HandleCastFunc is like HandleCallFunc, for casts. Casts are acknowledged
+// once f returns.
+func HandleCastFunc[Message any](n *Node, name string, f func(ctx context.Context, target string, message Message) error) error {
+	return n.handle(n.casts, name, func(ctx context.Context, target string, body []byte) ([]byte, error) {
+		var message Message
+		if err := json.Unmarshal(body, &message); err != nil {
+			return nil, fmt.Errorf("Could not decode message for %s: %w", name, err)
+		}
+		return nil, f(ctx, target, message)
+	})
+}
+
+// Serve accepts connections from l until the node is closed, and returns nil
+// once it is
+func (n *Node) Serve(l net.Listener) error {
+	n.lock.Lock()
+	if n.closed {
+		n.lock.Unlock()
+		l.Close()
+		return nil
+	}
+	n.listeners[l] = struct{}{}
+	n.lock.Unlock()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			n.lock.Lock()
+			closed := n.closed
+			delete(n.listeners, l)
+			n.lock.Unlock()
+			if closed {
+				return nil
+			}
+			return err
+		}
+		n.lock.Lock()
+		if n.closed {
+			n.lock.Unlock()
+			conn.Close()
+			continue
+		}
+		n.conns[conn] = struct{}{}
+		n.lock.Unlock()
+		go n.serveConn(conn)
+	}
+}
+
+// Close stops every Serve, and closes their connections. Calls in progress
+// stop waiting for their servers.
+func (n *Node) Close() error {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.closed = true
+	for l := range n.listeners {
+		l.Close()
+	}
+	for conn := range n.conns {
+		conn.Close()
+	}
+	return nil
+}
+
+// serveConn handles each request on conn in its own goroutine, so a slow
+// call does not hold up the others. Casts are acknowledged once queued, so a
+// client sending one message after another still has them handled in order.
+func (n *Node) serveConn(conn net.Conn) {
+	ctx, cancel := context.WithCancel(context.Background())
+	var writeLock gosync.Mutex
+	var requests gosync.WaitGroup
+	defer func() {
+		cancel()
+		requests.Wait()
+		conn.Close()
+		n.lock.Lock()
+		delete(n.conns, conn)
+		n.lock.Unlock()
+	}()
+	reader := bufio.NewReader(conn)
+	for {
+		request, err := readFrame(reader)
+		if err != nil {
+			return
+		}
+		requests.Add(1)
+		go func() {
+			defer requests.Done()
+			reply := n.serve(ctx, request)
+			timeout := request.Timeout
+			if timeout <= 0 {
+				timeout = DefaultCallTimeout
+			}
+			writeLock.Lock()
+			defer writeLock.Unlock()
+			// the client has stopped waiting by the time the write fails, and
+			// writeFrame closes the connection, which stops the read loop too
+			writeFrame(conn, reply, time.Now().Add(timeout))
+		}()
+	}
+}
+
+// serve runs the handler request names, and returns the reply to it
+func (n *Node) serve(ctx context.Context, request envelope) envelope {
+	reply := envelope{ID: request.ID, Kind: kindReply}
+	n.lock.Lock()
+	var h handler
+	var ok bool
+	switch request.Kind {
+	case kindCall:
+		h, ok = n.calls[request.Handler]
+	case kindCast:
+		h, ok = n.casts[request.Handler]
+	}
+	n.lock.Unlock()
+	if !ok {
+		reply.Error = &Error{Code: codeUnknownHandler, Message: fmt.Sprintf("no %s handler %s", request.Kind, request.Handler)}
+		return reply
+	}
+	if request.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, request.Timeout)
+		defer cancel()
+	}
+	body, err := h(ctx, request.Server, request.Body)
+	if err != nil {
+		reply.Error = toError(err)
+		return reply
+	}
+	reply.Body = body
+	return reply
+}
+
+// toError converts err to be sent to the client
+func toError(err error) *Error {
+	var remoteErr *Error
+	switch {
+	case errors.As(err, &remoteErr):
+		return remoteErr
+	case errors.Is(err, ErrTimeout), errors.Is(err, context.DeadlineExceeded):
+		return &Error{Code: codeTimeout, Message: err.Error()}
+	case errors.Is(err, registry.ErrNotRegistered):
+		return &Error{Code: codeNotRegistered, Message: err.Error()}
+	default:
+		return &Error{Code: codeFailed, Message: err.Error()}
+	}
+}
@@ -0,0 +1,183 @@
+package remote_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/hannahhoward/go-genserver/genserver"
+	"github.com/hannahhoward/go-genserver/registry"
+	"github.com/hannahhoward/go-genserver/remote"
+	"github.com/hannahhoward/go-genserver/store/memory"
+	"github.com/stretchr/testify/require"
+)
+
+type PrintableInt int
+
+func (p PrintableInt) String() string {
+	return strconv.Itoa(int(p))
+}
+
+type counter struct {
+	Current int
+}
+
+type Add struct {
+	Amount int
+}
+
+type Total struct {
+	Current int
+}
+
+func add(c *counter, msg Add) (Total, error) {
+	if msg.Amount < 0 {
+		return Total{}, errors.New("negative amount")
+	}
+	c.Current += msg.Amount
+	return Total{c.Current}, nil
+}
+
+func addCast(c *counter, msg Add) error {
+	c.Current += msg.Amount
+	return nil
+}
+
+// setup serves a registry holding a counter named "counter" over loopback,
+// and returns a client connected to it
+func setup(t *testing.T, options ...remote.Option) (*remote.Node, *remote.Client) {
+	store := memory.NewStore[PrintableInt, counter]()
+	_, err := store.CreateIfNotExist(1, counter{})
+	require.NoError(t, err)
+	server := genserver.Spawn("counter", PrintableInt(1), store.Mutator(1))
+	r := registry.New()
+	require.NoError(t, registry.Register(r, "counter", server))
+
+	node := remote.NewNode(r)
+	require.NoError(t, remote.HandleCall[PrintableInt](node, "add", add))
+	require.NoError(t, remote.HandleCast[PrintableInt](node, "add", addCast))
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	served := make(chan error, 1)
+	go func() {
+		served <- node.Serve(l)
+	}()
+	client, err := remote.Dial(context.Background(), l.Addr().String(), options...)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		client.Close()
+		node.Close()
+		require.NoError(t, <-served)
+	})
+	return node, client
+}
+
+func TestCallAndCast(t *testing.T) {
+	_, client := setup(t)
+	total, err := remote.Call[Add, Total](client, "counter", "add", Add{5})
+	require.NoError(t, err)
+	require.Equal(t, Total{5}, total)
+	require.NoError(t, remote.Cast(client, "counter", "add", Add{2}))
+	total, err = remote.Call[Add, Total](client, "counter", "add", Add{1})
+	require.NoError(t, err)
+	require.Equal(t, Total{8}, total)
+
+	// concurrent calls share the connection, and replies find their callers
+	results := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		go func() {
+			_, err := remote.Call[Add, Total](client, "counter", "add", Add{1})
+			results <- err
+		}()
+	}
+	for i := 0; i < 10; i++ {
+		require.NoError(t, <-results)
+	}
+	total, err = remote.Call[Add, Total](client, "counter", "add", Add{0})
+	require.NoError(t, err)
+	require.Equal(t, Total{18}, total)
+}
+
+func TestErrors(t *testing.T) {
+	testCases := map[string]struct {
+		server  string
+		handler string
+		message Add
+		is      error
+	}{
+		"handler error": {
+			server:  "counter",
+			handler: "add",
+			message: Add{-1},
+		},
+		"unknown handler": {
+			server:  "counter",
+			handler: "subtract",
+			is:      remote.ErrUnknownHandler,
+		},
+		"unknown server": {
+			server:  "missing",
+			handler: "add",
+			is:      registry.ErrNotRegistered,
+		},
+	}
+	for testCase, data := range testCases {
+		t.Run(testCase, func(t *testing.T) {
+			_, client := setup(t)
+			_, err := remote.Call[Add, Total](client, data.server, data.handler, data.message)
+			var remoteErr *remote.Error
+			require.ErrorAs(t, err, &remoteErr)
+			if data.is != nil {
+				require.ErrorIs(t, err, data.is)
+			}
+		})
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	node, client := setup(t, remote.WithCallTimeout(50*time.Millisecond))
+	release := make(chan struct{})
+	defer close(release)
+	require.NoError(t, remote.HandleCall[PrintableInt](node, "stuck", func(c *counter, msg Add) (Total, error) {
+		<-release
+		return Total{c.Current}, nil
+	}))
+	_, err := remote.Call[Add, Total](client, "counter", "stuck", Add{})
+	require.ErrorIs(t, err, remote.ErrTimeout)
+}
+
+func TestClosed(t *testing.T) {
+	node, client := setup(t)
+	_, err := remote.Call[Add, Total](client, "counter", "add", Add{1})
+	require.NoError(t, err)
+	require.NoError(t, node.Close())
+	require.Eventually(t, func() bool {
+		_, err := remote.Call[Add, Total](client, "counter", "add", Add{1})
+		return errors.Is(err, remote.ErrClosed)
+	}, time.Second, time.Millisecond)
+}
+
+func TestStalledPeer(t *testing.T) {
+	// the peer never reads, so writes to it block
+	conn, peer := net.Pipe()
+	defer peer.Close()
+	client := remote.NewClient(conn, remote.WithCallTimeout(time.Minute))
+	defer client.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err := remote.CallContext[Add, Total](ctx, client, "counter", "add", Add{1})
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	// the connection is closed rather than left with a frame cut off partway
+	_, err = remote.Call[Add, Total](client, "counter", "add", Add{1})
+	require.ErrorIs(t, err, remote.ErrClosed)
+
+	conn, peer = net.Pipe()
+	defer peer.Close()
+	client = remote.NewClient(conn, remote.WithCallTimeout(50*time.Millisecond))
+	defer client.Close()
+	_, err = remote.Call[Add, Total](client, "counter", "add", Add{1})
+	require.ErrorIs(t, err, remote.ErrTimeout)
+}
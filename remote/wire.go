@@ -0,0 +1,132 @@
+// Package remote calls and casts to GenServers in another process over TCP.
+//
+// A Node serves the servers of a registry.Registry. Handlers are registered on
+// the node by name, so only their messages and replies, encoded as JSON, cross
+// the network. A Client connects to a node, and sends it messages naming the
+// registered server and handler they are for.
+package remote
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/hannahhoward/go-genserver/registry"
+)
+
+// maxFrame is the largest frame accepted, so a corrupt length cannot make
+// either side allocate without bound
+const maxFrame = 16 << 20
+
+// DefaultCallTimeout is how long calls wait for a reply, unless configured
+// otherwise. It matches the deadlock timeout of a GenServer.
+const DefaultCallTimeout = 30 * time.Second
+
+const (
+	kindCall  = "call"
+	kindCast  = "cast"
+	kindReply = "reply"
+)
+
+const (
+	codeFailed         = "failed"
+	codeTimeout        = "timeout"
+	codeNotRegistered  = "not_registered"
+	codeUnknownHandler = "unknown_handler"
+)
+
+// ErrTimeout is matched by errors from calls that did not get a reply in
+// time, whether the client stopped waiting or the remote server was stuck
+var ErrTimeout = errors.New("remote call timed out")
+
+// ErrUnknownHandler is matched by errors from messages naming a handler the
+// node has not registered
+var ErrUnknownHandler = errors.New("unknown handler")
+
+// ErrClosed is returned by clients after their connection is closed
+var ErrClosed = errors.New("connection closed")
+
+// Error is an error returned by the remote node. Errors for servers that are
+// not registered match registry.ErrNotRegistered.
+type Error struct {
+	Code    string
+	Message string
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+func (e *Error) Is(target error) bool {
+	switch e.Code {
+	case codeTimeout:
+		return target == ErrTimeout
+	case codeNotRegistered:
+		return target == registry.ErrNotRegistered
+	case codeUnknownHandler:
+		return target == ErrUnknownHandler
+	default:
+		return false
+	}
+}
+
+// envelope is a single frame. Requests carry an ID, which the reply to them
+// repeats, so replies can arrive in any order.
+type envelope struct {
+	ID      uint64          `json:"id"`
+	Kind    string          `json:"kind"`
+	Server  string          `json:"server,omitempty"`
+	Handler string          `json:"handler,omitempty"`
+	Timeout time.Duration   `json:"timeout,omitempty"`
+	Body    json.RawMessage `json:"body,omitempty"`
+	Error   *Error          `json:"error,omitempty"`
+}
+
+// writeFrame writes e to conn prefixed by its length, failing if the write
+// has not finished by deadline. A failed write closes conn, since the peer may
+// have stopped reading, and a frame cut off partway leaves it unreadable.
+func writeFrame(conn net.Conn, e envelope, deadline time.Time) error {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if len(body) > maxFrame {
+		return fmt.Errorf("frame of %d bytes exceeds %d", len(body), maxFrame)
+	}
+	frame := make([]byte, 4+len(body))
+	binary.BigEndian.PutUint32(frame, uint32(len(body)))
+	copy(frame[4:], body)
+	if err := conn.SetWriteDeadline(deadline); err != nil {
+		conn.Close()
+		return err
+	}
+	if _, err := conn.Write(frame); err != nil {
+		conn.Close()
+		return err
+	}
+	return nil
+}
+
+// readFrame reads the next envelope written by writeFrame
+func readFrame(r *bufio.Reader) (envelope, error) {
+	var e envelope
+	var length [4]byte
+	if _, err := io.ReadFull(r, length[:]); err != nil {
+		return e, err
+	}
+	size := binary.BigEndian.Uint32(length[:])
+	if size > maxFrame {
+		return e, fmt.Errorf("frame of %d bytes exceeds %d", size, maxFrame)
+	}
+	body := make([]byte, size)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return e, err
+	}
+	err := json.Unmarshal(body, &e)
+	return e, err
+}
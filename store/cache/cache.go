@@ -0,0 +1,446 @@
+// Package cache is a group.Store decorator that keeps recently used states in
+// memory, and writes mutations back to the store it wraps in the background
+package cache
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"reflect"
+	gosync "sync"
+	"time"
+
+	"github.com/hannahhoward/go-genserver/genserver"
+	"github.com/hannahhoward/go-genserver/group"
+	"github.com/hannahhoward/go-genserver/store/expiry"
+	"github.com/hannahhoward/go-genserver/sync"
+)
+
+const (
+	defaultCapacity      = 1024
+	defaultFlushInterval = time.Second
+)
+
+type storeConfig struct {
+	capacity      int
+	flushInterval time.Duration
+}
+
+type Option func(*storeConfig)
+
+// WithCapacity sets how many states are kept in memory. The least recently
+// used state is written back and dropped when there are more. States being
+// mutated are skipped, so the cache can briefly hold more while handlers
+// load other states. The default is 1024.
+func WithCapacity(capacity int) Option {
+	return func(config *storeConfig) {
+		config.capacity = capacity
+	}
+}
+
+// WithFlushInterval sets how often changed states are written back in the
+// background. Zero disables background writes, leaving them to eviction,
+// Flush and Close. The default is one second.
+func WithFlushInterval(interval time.Duration) Option {
+	return func(config *storeConfig) {
+		config.flushInterval = interval
+	}
+}
+
+// entry is a cached state. Mutations hold mutate for their duration, and
+// writing back holds it too, so a state is never written back half changed.
+type entry[ID fmt.Stringer, State any] struct {
+	id      ID
+	key     string
+	element *list.Element
+
+	mutate  gosync.Mutex
+	lock    gosync.RWMutex
+	state   State
+	version uint64
+	dirty   bool
+	// dropped is set once the entry is no longer cached, because it was
+	// deleted or evicted
+	dropped bool
+}
+
+func (e *entry[ID, State]) load() (State, uint64, bool) {
+	e.lock.RLock()
+	defer e.lock.RUnlock()
+	return e.state, e.version, !e.dropped
+}
+
+func (e *entry[ID, State]) drop() {
+	e.lock.Lock()
+	e.dropped = true
+	e.lock.Unlock()
+}
+
+// Store caches the states of another store. Creating and deleting states
+// goes straight to the wrapped store, while mutations only change the cache
+// and are written back later, coalescing any made in between into a single
+// write.
+//
+// Versions count mutations made through the cache, starting from the version
+// in the wrapped store, which only sees one new version per write back. The
+// cache should be the only writer to the states it wraps.
+//
+// Mutations leaving the state deeply equal to what they loaded are neither
+// versioned nor written back, so handlers must replace the maps, slices and
+// pointers in a state rather than change what they point to.
+type Store[ID fmt.Stringer, State any] struct {
+	backing group.Store[ID, State]
+	config  storeConfig
+	// locks serializes loads, creates and deletes of each ID.String()
+	locks sync.KeyedMutex[string]
+
+	lock    gosync.Mutex
+	entries map[string]*entry[ID, State]
+	recent  *list.List
+
+	listeners expiry.Listeners[ID]
+	done      chan struct{}
+	stopped   chan struct{}
+	closeOnce gosync.Once
+}
+
+var _ group.Store[fmt.Stringer, any] = (*Store[fmt.Stringer, any])(nil)
+
+var _ group.Flusher = (*Store[fmt.Stringer, any])(nil)
+
+// NewStore returns a cache in front of backing. If backing expires states,
+// they are dropped from the cache as they expire.
+func NewStore[ID fmt.Stringer, State any](backing group.Store[ID, State], options ...Option) *Store[ID, State] {
+	config := storeConfig{
+		capacity:      defaultCapacity,
+		flushInterval: defaultFlushInterval,
+	}
+	for _, option := range options {
+		option(&config)
+	}
+	s := &Store[ID, State]{
+		backing: backing,
+		config:  config,
+		entries: make(map[string]*entry[ID, State]),
+		recent:  list.New(),
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	if expirer, ok := backing.(group.Expirer[ID]); ok {
+		expirer.OnExpire(s.expired)
+	}
+	go s.flushLoop()
+	return s
+}
+
+func (s *Store[ID, State]) flushLoop() {
+	defer close(s.stopped)
+	if s.config.flushInterval <= 0 {
+		<-s.done
+		return
+	}
+	ticker := time.NewTicker(s.config.flushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			// failed writes stay dirty, and are retried on the next tick
+			s.Flush(context.Background())
+		}
+	}
+}
+
+// cached returns the entry for key if it is cached, marking it recently used
+func (s *Store[ID, State]) cached(key string) (*entry[ID, State], bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	e, ok := s.entries[key]
+	if ok {
+		s.recent.MoveToFront(e.element)
+	}
+	return e, ok
+}
+
+// entry returns the cached entry for id, loading it from the wrapped store if
+// needed
+func (s *Store[ID, State]) entry(id ID) (*entry[ID, State], error) {
+	key := id.String()
+	if e, ok := s.cached(key); ok {
+		return e, nil
+	}
+	defer s.locks.Lock(key)()
+	if e, ok := s.cached(key); ok {
+		return e, nil
+	}
+	state, version, err := s.backing.LoadVersion(id)
+	if err != nil {
+		return nil, err
+	}
+	e := &entry[ID, State]{id: id, key: key, state: state, version: version}
+	s.lock.Lock()
+	e.element = s.recent.PushFront(e)
+	s.entries[key] = e
+	s.lock.Unlock()
+	s.trim(e)
+	return e, nil
+}
+
+// trim evicts the least recently used states other than keep, until the
+// cache is back within capacity
+func (s *Store[ID, State]) trim(keep *entry[ID, State]) {
+	for {
+		victim := s.victim(keep)
+		if victim == nil {
+			return
+		}
+		err := s.write(victim)
+		if err == nil {
+			s.remove(victim)
+		}
+		victim.mutate.Unlock()
+		if err != nil {
+			// the victim stays cached, to be written back later
+			return
+		}
+	}
+}
+
+// victim returns the least recently used state other than keep with its
+// mutate lock held, or nil if the cache is within capacity. States being
+// mutated are skipped rather than waited for, as their handler may be the
+// one loading keep.
+func (s *Store[ID, State]) victim(keep *entry[ID, State]) *entry[ID, State] {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.recent.Len() <= s.config.capacity {
+		return nil
+	}
+	for element := s.recent.Back(); element != nil; element = element.Prev() {
+		e := element.Value.(*entry[ID, State])
+		if e != keep && e.mutate.TryLock() {
+			return e
+		}
+	}
+	return nil
+}
+
+// remove drops e from the cache, if it is still cached
+func (s *Store[ID, State]) remove(e *entry[ID, State]) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.entries[e.key] != e {
+		return
+	}
+	delete(s.entries, e.key)
+	s.recent.Remove(e.element)
+	e.drop()
+}
+
+// write writes back e if it changed. The caller holds e.mutate.
+func (s *Store[ID, State]) write(e *entry[ID, State]) error {
+	state, _, ok := e.load()
+	if !ok || !e.dirty {
+		return nil
+	}
+	_, err := s.backing.Mutator(e.id)(func(stored *State) (func(), error) {
+		*stored = state
+		return func() {}, nil
+	})
+	if err != nil {
+		return fmt.Errorf("Could not write back state for ID %s: %w", e.id, err)
+	}
+	e.dirty = false
+	return nil
+}
+
+// Flush writes back every changed state, and returns the first error. States
+// that fail to write stay cached and changed.
+func (s *Store[ID, State]) Flush(ctx context.Context) error {
+	s.lock.Lock()
+	entries := make([]*entry[ID, State], 0, len(s.entries))
+	for _, e := range s.entries {
+		entries = append(entries, e)
+	}
+	s.lock.Unlock()
+	var flushErr error
+	for _, e := range entries {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		e.mutate.Lock()
+		err := s.write(e)
+		e.mutate.Unlock()
+		if err != nil && flushErr == nil {
+			flushErr = err
+		}
+	}
+	return flushErr
+}
+
+// Invalidate writes back and drops every cached state whose identifier f
+// returns true for, so they are loaded from the wrapped store when next used.
+// States that fail to write back stay cached, and the first error is
+// returned.
+func (s *Store[ID, State]) Invalidate(ctx context.Context, f func(id ID) bool) error {
+	s.lock.Lock()
+	entries := make([]*entry[ID, State], 0, len(s.entries))
+	for _, e := range s.entries {
+		entries = append(entries, e)
+	}
+	s.lock.Unlock()
+	var invalidateErr error
+	for _, e := range entries {
+		if !f(e.id) {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		e.mutate.Lock()
+		err := s.write(e)
+		if err == nil {
+			s.remove(e)
+		}
+		e.mutate.Unlock()
+		if err != nil && invalidateErr == nil {
+			invalidateErr = err
+		}
+	}
+	return invalidateErr
+}
+
+// Close stops writing back in the background, then flushes every changed
+// state
+func (s *Store[ID, State]) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.done)
+	})
+	<-s.stopped
+	return s.Flush(context.Background())
+}
+
+// expired drops a state the wrapped store expired, and tells listeners
+func (s *Store[ID, State]) expired(id ID) {
+	if e, ok := s.cached(id.String()); ok {
+		s.remove(e)
+	}
+	s.listeners.Expired(id)
+}
+
+// OnExpire registers f to be called for each state the wrapped store expires.
+// It is never called if the wrapped store does not expire states.
+func (s *Store[ID, State]) OnExpire(f func(id ID)) {
+	s.listeners.Add(f)
+}
+
+func (s *Store[ID, State]) Has(id ID) (bool, error) {
+	if e, ok := s.cached(id.String()); ok {
+		if _, _, ok := e.load(); ok {
+			return true, nil
+		}
+	}
+	return s.backing.Has(id)
+}
+
+func (s *Store[ID, State]) Load(id ID) (State, error) {
+	state, _, err := s.LoadVersion(id)
+	return state, err
+}
+
+func (s *Store[ID, State]) LoadVersion(id ID) (State, uint64, error) {
+	for {
+		e, err := s.entry(id)
+		if err != nil {
+			var state State
+			return state, 0, err
+		}
+		if state, version, ok := e.load(); ok {
+			return state, version, nil
+		}
+		// evicted or deleted since it was looked up
+	}
+}
+
+func (s *Store[ID, State]) CreateIfNotExist(id ID, state State) (bool, error) {
+	key := id.String()
+	defer s.locks.Lock(key)()
+	if e, ok := s.cached(key); ok {
+		if _, _, ok := e.load(); ok {
+			return true, nil
+		}
+	}
+	return s.backing.CreateIfNotExist(id, state)
+}
+
+func (s *Store[ID, State]) Delete(id ID) error {
+	key := id.String()
+	defer s.locks.Lock(key)()
+	if e, ok := s.cached(key); ok {
+		e.mutate.Lock()
+		s.remove(e)
+		e.mutate.Unlock()
+	}
+	return s.backing.Delete(id)
+}
+
+func (s *Store[ID, State]) IDs(cursor string, f func(id ID) bool) error {
+	return s.backing.IDs(cursor, f)
+}
+
+// Iterate lists the states of the wrapped store, replaced by their cached
+// versions where they have changed
+func (s *Store[ID, State]) Iterate(cursor string, f func(id ID, state State) bool) error {
+	return s.backing.Iterate(cursor, func(id ID, state State) bool {
+		if e, ok := s.cached(id.String()); ok {
+			if cached, _, ok := e.load(); ok {
+				state = cached
+			}
+		}
+		return f(id, state)
+	})
+}
+
+// Mutator changes the cached state only, leaving the write back for later
+func (s *Store[ID, State]) Mutator(id ID) genserver.StateMutator[State] {
+	return func(modifier genserver.StateMutatorFn[State]) (func(), error) {
+		for {
+			e, err := s.entry(id)
+			if err != nil {
+				return nil, err
+			}
+			returnValue, ok, err := s.mutate(e, modifier)
+			if ok {
+				return returnValue, err
+			}
+			// evicted or deleted while waiting to mutate it
+		}
+	}
+}
+
+// mutate runs modifier against a copy of the state in e, keeping the result
+// if it succeeds and changed the state. It reports false if e is no longer
+// cached.
+func (s *Store[ID, State]) mutate(e *entry[ID, State], modifier genserver.StateMutatorFn[State]) (func(), bool, error) {
+	e.mutate.Lock()
+	defer e.mutate.Unlock()
+	state, version, ok := e.load()
+	if !ok {
+		return nil, false, nil
+	}
+	old := state
+	returnValue, err := modifier(&state)
+	if err != nil {
+		return nil, true, err
+	}
+	if reflect.DeepEqual(old, state) {
+		return returnValue, true, nil
+	}
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.state = state
+	e.version = version + 1
+	e.dirty = true
+	return returnValue, true, nil
+}
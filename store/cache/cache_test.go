@@ -0,0 +1,131 @@
+package cache_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/hannahhoward/go-genserver/group"
+	"github.com/hannahhoward/go-genserver/store/cache"
+	"github.com/hannahhoward/go-genserver/store/memory"
+	"github.com/hannahhoward/go-genserver/store/storetest"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConformance(t *testing.T) {
+	capacities := map[string]int{
+		"evicting": 2,
+		"roomy":    1024,
+	}
+	for name, capacity := range capacities {
+		t.Run(name, func(t *testing.T) {
+			storetest.Run(t, func(t *testing.T) group.Store[storetest.ID, storetest.State] {
+				store := cache.NewStore[storetest.ID, storetest.State](memory.NewStore[storetest.ID, storetest.State](),
+					cache.WithCapacity(capacity), cache.WithFlushInterval(time.Millisecond))
+				t.Cleanup(func() { store.Close() })
+				return store
+			})
+		})
+	}
+}
+
+func increment(s *storetest.State) (func(), error) {
+	s.Count++
+	return func() {}, nil
+}
+
+func TestWriteBehind(t *testing.T) {
+	backing := memory.NewStore[storetest.ID, storetest.State]()
+	store := cache.NewStore[storetest.ID, storetest.State](backing, cache.WithCapacity(1), cache.WithFlushInterval(0))
+	defer store.Close()
+	_, err := store.CreateIfNotExist("a", storetest.State{})
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		_, err = store.Mutator("a")(increment)
+		require.NoError(t, err)
+	}
+	state, version, err := store.LoadVersion("a")
+	require.NoError(t, err)
+	require.Equal(t, storetest.State{Count: 3}, state)
+	require.Equal(t, uint64(4), version)
+	state, version, err = backing.LoadVersion("a")
+	require.NoError(t, err)
+	require.Equal(t, storetest.State{}, state)
+	require.Equal(t, uint64(1), version)
+
+	// the three mutations are written back together
+	require.NoError(t, store.Flush(context.Background()))
+	state, version, err = backing.LoadVersion("a")
+	require.NoError(t, err)
+	require.Equal(t, storetest.State{Count: 3}, state)
+	require.Equal(t, uint64(2), version)
+
+	// loading another state evicts a, writing it back first
+	_, err = store.Mutator("a")(increment)
+	require.NoError(t, err)
+	_, err = store.CreateIfNotExist("b", storetest.State{})
+	require.NoError(t, err)
+	_, err = store.Load("b")
+	require.NoError(t, err)
+	state, err = backing.Load("a")
+	require.NoError(t, err)
+	require.Equal(t, storetest.State{Count: 4}, state)
+}
+
+func TestBackgroundFlush(t *testing.T) {
+	backing := memory.NewStore[storetest.ID, storetest.State]()
+	store := cache.NewStore[storetest.ID, storetest.State](backing, cache.WithFlushInterval(time.Millisecond))
+	defer store.Close()
+	_, err := store.CreateIfNotExist("a", storetest.State{})
+	require.NoError(t, err)
+	_, err = store.Mutator("a")(increment)
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		state, err := backing.Load("a")
+		return err == nil && state.Count == 1
+	}, 5*time.Second, time.Millisecond)
+}
+
+func TestGroupStopFlushes(t *testing.T) {
+	backing := memory.NewStore[storetest.ID, storetest.State]()
+	store := cache.NewStore[storetest.ID, storetest.State](backing, cache.WithFlushInterval(0))
+	defer store.Close()
+	g := group.New[storetest.ID, storetest.State]("counter", store)
+	_, err := group.Call(g, "a", 5, func(s *storetest.State, amount int) (int, error) {
+		s.Count += amount
+		return s.Count, nil
+	})
+	require.NoError(t, err)
+	state, err := backing.Load("a")
+	require.NoError(t, err)
+	require.Equal(t, storetest.State{}, state)
+
+	require.NoError(t, g.Stop(context.Background()))
+	state, err = backing.Load("a")
+	require.NoError(t, err)
+	require.Equal(t, storetest.State{Count: 5}, state)
+}
+
+func TestEvictionDuringMutation(t *testing.T) {
+	backing := memory.NewStore[storetest.ID, storetest.State]()
+	store := cache.NewStore[storetest.ID, storetest.State](backing, cache.WithCapacity(1), cache.WithFlushInterval(0))
+	defer store.Close()
+	for _, id := range []storetest.ID{"a", "b"} {
+		_, err := store.CreateIfNotExist(id, storetest.State{})
+		require.NoError(t, err)
+	}
+
+	// loading b would evict a, but a is being mutated by the handler loading b
+	_, err := store.Mutator("a")(func(s *storetest.State) (func(), error) {
+		_, err := store.Mutator("b")(increment)
+		s.Count++
+		return func() {}, err
+	})
+	require.NoError(t, err)
+	require.NoError(t, store.Flush(context.Background()))
+	for _, id := range []storetest.ID{"a", "b"} {
+		state, err := backing.Load(id)
+		require.NoError(t, err)
+		require.Equal(t, storetest.State{Count: 1}, state)
+	}
+}
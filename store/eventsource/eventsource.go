@@ -0,0 +1,419 @@
+// Package eventsource is a group.Store that records every handled message as
+// an event, and rebuilds states by replaying events through their handlers.
+//
+// Handlers are registered by name with Call and Cast, which return handlers
+// to pass to group.Call and group.Cast in place of the originals:
+//
+//	deposit := eventsource.Call(store, "deposit", depositHandler)
+//	balance, err := group.Call(g, id, 10, deposit)
+//
+// A message handled by an unregistered handler that changes the state is
+// recorded as a StateEvent holding the whole new state.
+//
+// Unlike the other persistent stores, states never expire: a history is kept
+// until it is deleted, so the store takes no expiry.Config and is not a
+// group.Expirer. Keep session-like states in a store with a TTL instead.
+package eventsource
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	gosync "sync"
+	"time"
+
+	"github.com/hannahhoward/go-genserver/codec"
+	"github.com/hannahhoward/go-genserver/genserver"
+	"github.com/hannahhoward/go-genserver/group"
+	"github.com/hannahhoward/go-genserver/sync"
+)
+
+const defaultSnapshotEvery = 100
+
+type storeConfig struct {
+	codec         any
+	snapshotEvery uint64
+}
+
+type Option func(*storeConfig)
+
+// WithCodec sets how states are encoded in snapshots and StateEvents. The
+// default is versioned JSON.
+func WithCodec[State any](c codec.Codec[State]) Option {
+	return func(config *storeConfig) {
+		config.codec = c
+	}
+}
+
+// WithSnapshotEvery snapshots a state after every n events, so rebuilding it
+// replays at most n events. Zero disables snapshots after creation.
+func WithSnapshotEvery(n uint64) Option {
+	return func(config *storeConfig) {
+		config.snapshotEvery = n
+	}
+}
+
+type replayer[State any] func(state *State, message []byte) error
+
+type current[ID fmt.Stringer, State any] struct {
+	id    ID
+	state State
+	seq   uint64
+}
+
+// Store keeps the current state of each identifier in memory, and its
+// history in a Journal
+type Store[ID fmt.Stringer, State any] struct {
+	journal Journal
+	parseID func(string) (ID, error)
+	codec   codec.Codec[State]
+	config  storeConfig
+	// locks serializes changes to each ID.String(), including mutations
+	// while their handler runs, and rebuilds of states that are not cached
+	locks sync.KeyedMutex[string]
+
+	lock      gosync.RWMutex
+	handlers  map[string]replayer[State]
+	states    map[string]*current[ID, State]
+	recording map[*State][]Event
+}
+
+var _ group.Store[fmt.Stringer, any] = (*Store[fmt.Stringer, any])(nil)
+
+// NewStore returns a store keeping its histories in journal. parseID turns
+// the result of ID.String() back into an ID.
+func NewStore[ID fmt.Stringer, State any](journal Journal, parseID func(string) (ID, error), options ...Option) (*Store[ID, State], error) {
+	config := storeConfig{
+		snapshotEvery: defaultSnapshotEvery,
+	}
+	for _, option := range options {
+		option(&config)
+	}
+	stateCodec, err := codec.For[State](config.codec)
+	if err != nil {
+		return nil, err
+	}
+	return &Store[ID, State]{
+		journal:   journal,
+		parseID:   parseID,
+		codec:     stateCodec,
+		config:    config,
+		handlers:  make(map[string]replayer[State]),
+		states:    make(map[string]*current[ID, State]),
+		recording: make(map[*State][]Event),
+	}, nil
+}
+
+func (s *Store[ID, State]) register(name string, replay replayer[State]) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if _, ok := s.handlers[name]; ok || name == StateEvent {
+		panic(fmt.Sprintf("eventsource: handler %q registered twice", name))
+	}
+	s.handlers[name] = replay
+}
+
+// record adds an event to the mutation in progress for state
+func (s *Store[ID, State]) record(state *State, name string, data []byte) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	events, ok := s.recording[state]
+	if !ok {
+		return fmt.Errorf("eventsource: %s handler used outside of its store", name)
+	}
+	s.recording[state] = append(events, Event{Name: name, Message: data, Time: time.Now()})
+	return nil
+}
+
+// resolveMessageCodec returns the codec passed to Call or Cast, if any, or
+// versioned JSON
+func resolveMessageCodec[Message any](codecs []codec.Codec[Message]) codec.Codec[Message] {
+	if len(codecs) > 0 {
+		return codecs[0]
+	}
+	return codec.Versioned(1, codec.JSON[Message]())
+}
+
+// Call registers a call handler under name, and returns a handler that
+// records each message it handles successfully. Messages are encoded with
+// messageCodec if given, and versioned JSON otherwise.
+func Call[ID fmt.Stringer, State any, Message any, Return any](s *Store[ID, State], name string, handler genserver.CallHandler[State, Message, Return], messageCodec ...codec.Codec[Message]) genserver.CallHandler[State, Message, Return] {
+	c := resolveMessageCodec(messageCodec)
+	s.register(name, func(state *State, data []byte) error {
+		var message Message
+		err := c.Unmarshal(data, &message)
+		if err != nil {
+			return err
+		}
+		_, err = handler(state, message)
+		return err
+	})
+	return func(state *State, message Message) (Return, error) {
+		r, err := handler(state, message)
+		if err != nil {
+			return r, err
+		}
+		data, err := c.Marshal(message)
+		if err != nil {
+			return r, fmt.Errorf("encoding %s message: %w", name, err)
+		}
+		return r, s.record(state, name, data)
+	}
+}
+
+// Cast registers a cast handler under name, and returns a handler that
+// records each message it handles successfully. Messages are encoded with
+// messageCodec if given, and versioned JSON otherwise.
+func Cast[ID fmt.Stringer, State any, Message any](s *Store[ID, State], name string, handler genserver.CastHandler[State, Message], messageCodec ...codec.Codec[Message]) genserver.CastHandler[State, Message] {
+	c := resolveMessageCodec(messageCodec)
+	s.register(name, func(state *State, data []byte) error {
+		var message Message
+		err := c.Unmarshal(data, &message)
+		if err != nil {
+			return err
+		}
+		return handler(state, message)
+	})
+	return func(state *State, message Message) error {
+		err := handler(state, message)
+		if err != nil {
+			return err
+		}
+		data, err := c.Marshal(message)
+		if err != nil {
+			return fmt.Errorf("encoding %s message: %w", name, err)
+		}
+		return s.record(state, name, data)
+	}
+}
+
+// rebuild replays the history of id on top of its latest snapshot
+func (s *Store[ID, State]) rebuild(id ID) (*current[ID, State], error) {
+	key := id.String()
+	seq, data, ok, err := s.journal.LoadSnapshot(key)
+	if err != nil {
+		return nil, fmt.Errorf("Could not load snapshot for ID %s: %w", id, err)
+	}
+	if !ok {
+		return nil, fmt.Errorf("Could not load state for ID %s: %w", id, group.ErrNotFound)
+	}
+	cur := &current[ID, State]{id: id, seq: seq}
+	err = s.codec.Unmarshal(data, &cur.state)
+	if err != nil {
+		return nil, fmt.Errorf("Could not decode snapshot for ID %s: %w", id, err)
+	}
+	var replayErr error
+	err = s.journal.Events(key, seq+1, func(event Event) bool {
+		replayErr = s.replay(&cur.state, event)
+		cur.seq = event.Seq
+		return replayErr == nil
+	})
+	if err == nil {
+		err = replayErr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Could not replay events for ID %s: %w", id, err)
+	}
+	return cur, nil
+}
+
+func (s *Store[ID, State]) replay(state *State, event Event) error {
+	if event.Name == StateEvent {
+		var replaced State
+		err := s.codec.Unmarshal(event.Message, &replaced)
+		*state = replaced
+		return err
+	}
+	s.lock.RLock()
+	replay, ok := s.handlers[event.Name]
+	s.lock.RUnlock()
+	if !ok {
+		return fmt.Errorf("no handler registered for event %d %q", event.Seq, event.Name)
+	}
+	return replay(state, event.Message)
+}
+
+// cached returns the current state of key, if it is cached. Cached states
+// are replaced rather than changed, so they can be read without the key lock.
+func (s *Store[ID, State]) cached(key string) (*current[ID, State], bool) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	cur, ok := s.states[key]
+	return cur, ok
+}
+
+// load returns the current state of id, rebuilding it if it is not cached.
+// Callers hold the key lock.
+func (s *Store[ID, State]) load(id ID) (*current[ID, State], error) {
+	key := id.String()
+	if cur, ok := s.cached(key); ok {
+		return cur, nil
+	}
+	cur, err := s.rebuild(id)
+	if err != nil {
+		return nil, err
+	}
+	s.lock.Lock()
+	s.states[key] = cur
+	s.lock.Unlock()
+	return cur, nil
+}
+
+// History calls f for each recorded event of id, oldest first, until f
+// returns false. Events from before the latest snapshot are included.
+func (s *Store[ID, State]) History(id ID, f func(Event) bool) error {
+	return s.journal.Events(id.String(), 0, f)
+}
+
+func (s *Store[ID, State]) Has(id ID) (bool, error) {
+	_, _, ok, err := s.journal.LoadSnapshot(id.String())
+	return ok, err
+}
+
+func (s *Store[ID, State]) Load(id ID) (State, error) {
+	state, _, err := s.LoadVersion(id)
+	return state, err
+}
+
+// LoadVersion returns the state with its version, which is one more than the
+// sequence number of its last event. Only states that are not cached wait for
+// mutations in progress, so handlers can load the state they are mutating.
+func (s *Store[ID, State]) LoadVersion(id ID) (State, uint64, error) {
+	key := id.String()
+	cur, ok := s.cached(key)
+	if !ok {
+		var err error
+		unlock := s.locks.Lock(key)
+		cur, err = s.load(id)
+		unlock()
+		if err != nil {
+			var state State
+			return state, 0, err
+		}
+	}
+	return cur.state, cur.seq + 1, nil
+}
+
+func (s *Store[ID, State]) CreateIfNotExist(id ID, state State) (bool, error) {
+	key := id.String()
+	defer s.locks.Lock(key)()
+	data, err := s.codec.Marshal(state)
+	if err != nil {
+		return false, fmt.Errorf("Could not encode state for ID %s: %w", id, err)
+	}
+	return s.journal.Create(key, data)
+}
+
+func (s *Store[ID, State]) Delete(id ID) error {
+	key := id.String()
+	defer s.locks.Lock(key)()
+	s.lock.Lock()
+	delete(s.states, key)
+	s.lock.Unlock()
+	return s.journal.Delete(key)
+}
+
+func (s *Store[ID, State]) IDs(cursor string, f func(id ID) bool) error {
+	var parseErr error
+	err := s.journal.Keys(cursor, func(key string) bool {
+		var id ID
+		id, parseErr = s.parseID(key)
+		return parseErr == nil && f(id)
+	})
+	if err != nil {
+		return err
+	}
+	return parseErr
+}
+
+func (s *Store[ID, State]) Iterate(cursor string, f func(id ID, state State) bool) error {
+	var loadErr error
+	err := s.IDs(cursor, func(id ID) bool {
+		var state State
+		state, loadErr = s.Load(id)
+		if errors.Is(loadErr, group.ErrNotFound) {
+			loadErr = nil
+			return true
+		}
+		return loadErr == nil && f(id, state)
+	})
+	if err != nil {
+		return err
+	}
+	return loadErr
+}
+
+// Mutator appends the events recorded by registered handlers when modifier
+// succeeds. If no events were recorded but the state changed, it appends a
+// StateEvent instead. modifier runs against a copy decoded from the cached
+// state, so neither failed handlers nor the comparison see its changes leak
+// into the cache through maps, slices or pointers.
+func (s *Store[ID, State]) Mutator(id ID) genserver.StateMutator[State] {
+	return func(modifier genserver.StateMutatorFn[State]) (func(), error) {
+		key := id.String()
+		defer s.locks.Lock(key)()
+		cur, err := s.load(id)
+		if err != nil {
+			return nil, err
+		}
+		before, err := s.codec.Marshal(cur.state)
+		if err != nil {
+			return nil, fmt.Errorf("Could not encode state for ID %s: %w", id, err)
+		}
+		var state State
+		err = s.codec.Unmarshal(before, &state)
+		if err != nil {
+			return nil, fmt.Errorf("Could not decode state for ID %s: %w", id, err)
+		}
+
+		s.lock.Lock()
+		s.recording[&state] = []Event{}
+		s.lock.Unlock()
+		returnValue, err := modifier(&state)
+		s.lock.Lock()
+		events := s.recording[&state]
+		delete(s.recording, &state)
+		s.lock.Unlock()
+		if err != nil {
+			return nil, err
+		}
+
+		if len(events) == 0 {
+			after, err := s.codec.Marshal(state)
+			if err != nil {
+				return nil, fmt.Errorf("Could not encode state for ID %s: %w", id, err)
+			}
+			if bytes.Equal(before, after) {
+				return returnValue, nil
+			}
+			events = []Event{{Name: StateEvent, Message: after, Time: time.Now()}}
+		}
+		for i := range events {
+			events[i].Seq = cur.seq + uint64(i) + 1
+		}
+		err = s.journal.Append(key, events)
+		if err != nil {
+			if errors.Is(err, genserver.ErrConflict) {
+				// another writer extended the history, so rebuild it on retry
+				s.lock.Lock()
+				delete(s.states, key)
+				s.lock.Unlock()
+			}
+			return nil, fmt.Errorf("Could not append events for ID %s: %w", id, err)
+		}
+		next := &current[ID, State]{id: id, state: state, seq: cur.seq + uint64(len(events))}
+		s.lock.Lock()
+		s.states[key] = next
+		s.lock.Unlock()
+
+		every := s.config.snapshotEvery
+		if every > 0 && next.seq/every > cur.seq/every {
+			// the events are already durable, so a failed snapshot only
+			// makes the next rebuild slower
+			if data, err := s.codec.Marshal(state); err == nil {
+				s.journal.SaveSnapshot(key, next.seq, data)
+			}
+		}
+		return returnValue, nil
+	}
+}
@@ -0,0 +1,214 @@
+package eventsource_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/hannahhoward/go-genserver/genserver"
+	"github.com/hannahhoward/go-genserver/group"
+	"github.com/hannahhoward/go-genserver/store/eventsource"
+	"github.com/hannahhoward/go-genserver/store/storetest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func parseID(s string) (storetest.ID, error) {
+	return storetest.ID(s), nil
+}
+
+func TestConformance(t *testing.T) {
+	journals := map[string]func(t *testing.T) eventsource.Journal{
+		"memory": func(t *testing.T) eventsource.Journal {
+			return eventsource.NewMemoryJournal()
+		},
+		"file": func(t *testing.T) eventsource.Journal {
+			journal, err := eventsource.NewFileJournal(t.TempDir())
+			require.NoError(t, err)
+			return journal
+		},
+	}
+	for name, journal := range journals {
+		t.Run(name, func(t *testing.T) {
+			storetest.Run(t, func(t *testing.T) group.Store[storetest.ID, storetest.State] {
+				store, err := eventsource.NewStore[storetest.ID, storetest.State](journal(t), parseID, eventsource.WithSnapshotEvery(7))
+				require.NoError(t, err)
+				return store
+			})
+		})
+	}
+}
+
+type account struct {
+	Balance int
+	Owner   string
+}
+
+func newAccounts(t *testing.T, journal eventsource.Journal) (*eventsource.Store[storetest.ID, account], func(*account, int) (int, error), func(*account, string) error) {
+	store, err := eventsource.NewStore[storetest.ID, account](journal, parseID, eventsource.WithSnapshotEvery(3))
+	require.NoError(t, err)
+	deposit := eventsource.Call(store, "deposit", func(a *account, amount int) (int, error) {
+		a.Balance += amount
+		return a.Balance, nil
+	})
+	rename := eventsource.Cast(store, "rename", func(a *account, owner string) error {
+		a.Owner = owner
+		return nil
+	})
+	return store, deposit, rename
+}
+
+func TestReplay(t *testing.T) {
+	dir := t.TempDir()
+	journal, err := eventsource.NewFileJournal(dir)
+	require.NoError(t, err)
+	store, deposit, rename := newAccounts(t, journal)
+	g := group.New[storetest.ID, account]("account", store)
+
+	for i := 1; i <= 5; i++ {
+		balance, err := group.Call(g, "a", i, deposit)
+		require.NoError(t, err)
+		require.Equal(t, i*(i+1)/2, balance)
+	}
+	require.NoError(t, group.Cast(g, "a", "alice", rename))
+	// an unregistered handler is recorded as a whole state
+	_, err = group.Call(g, "a", 0, func(a *account, _ int) (int, error) {
+		a.Balance *= 2
+		return a.Balance, nil
+	})
+	require.NoError(t, err)
+	require.NoError(t, g.Stop(context.Background()))
+
+	var names []string
+	err = store.History("a", func(event eventsource.Event) bool {
+		require.Equal(t, uint64(len(names)+1), event.Seq)
+		names = append(names, event.Name)
+		return true
+	})
+	require.NoError(t, err)
+	require.Equal(t, []string{"deposit", "deposit", "deposit", "deposit", "deposit", "rename", eventsource.StateEvent}, names)
+
+	// a crash can leave a partial event behind
+	events, err := os.OpenFile(filepath.Join(dir, "61", "events.log"), os.O_WRONLY|os.O_APPEND, 0)
+	require.NoError(t, err)
+	_, err = events.Write([]byte(`{"Seq":8,"Na`))
+	require.NoError(t, err)
+	require.NoError(t, events.Close())
+
+	journal, err = eventsource.NewFileJournal(dir)
+	require.NoError(t, err)
+	store, deposit, _ = newAccounts(t, journal)
+	state, err := store.Load("a")
+	require.NoError(t, err)
+	require.Equal(t, account{Balance: 30, Owner: "alice"}, state)
+
+	g = group.New[storetest.ID, account]("account", store)
+	balance, err := group.Call(g, "a", 1, deposit)
+	require.NoError(t, err)
+	require.Equal(t, 31, balance)
+	require.NoError(t, g.Stop(context.Background()))
+}
+
+type tags struct {
+	Tags map[string]int
+}
+
+func TestSharedReferences(t *testing.T) {
+	journal := eventsource.NewMemoryJournal()
+	store, err := eventsource.NewStore[storetest.ID, tags](journal, parseID)
+	require.NoError(t, err)
+	_, err = store.CreateIfNotExist("a", tags{Tags: map[string]int{}})
+	require.NoError(t, err)
+
+	// changes to maps are recorded, though the cached state shares the map
+	// with what the handler would get from a plain copy
+	_, err = store.Mutator("a")(func(s *tags) (func(), error) {
+		s.Tags["x"] = 1
+		return func() {}, nil
+	})
+	require.NoError(t, err)
+	// a failed handler leaves the state as it was
+	_, err = store.Mutator("a")(func(s *tags) (func(), error) {
+		s.Tags["y"] = 2
+		return nil, errors.New("boom")
+	})
+	require.Error(t, err)
+	state, err := store.Load("a")
+	require.NoError(t, err)
+	require.Equal(t, map[string]int{"x": 1}, state.Tags)
+
+	// a store reopened on the journal replays the change
+	store, err = eventsource.NewStore[storetest.ID, tags](journal, parseID)
+	require.NoError(t, err)
+	state, err = store.Load("a")
+	require.NoError(t, err)
+	require.Equal(t, map[string]int{"x": 1}, state.Tags)
+}
+
+func TestConflict(t *testing.T) {
+	journals := map[string]eventsource.Journal{
+		"memory": eventsource.NewMemoryJournal(),
+	}
+	fileJournal, err := eventsource.NewFileJournal(t.TempDir())
+	require.NoError(t, err)
+	journals["file"] = fileJournal
+	for name, journal := range journals {
+		t.Run(name, func(t *testing.T) {
+			// two stores on one journal stand in for two processes
+			first, deposit, _ := newAccounts(t, journal)
+			second, _, _ := newAccounts(t, journal)
+			_, err := first.CreateIfNotExist("a", account{})
+			require.NoError(t, err)
+			_, err = second.Load("a")
+			require.NoError(t, err)
+
+			g := group.New[storetest.ID, account]("account", first)
+			_, err = group.Call(g, "a", 1, deposit)
+			require.NoError(t, err)
+			require.NoError(t, g.Stop(context.Background()))
+
+			// the second store's cached state is one event behind
+			_, err = second.Mutator("a")(func(a *account) (func(), error) {
+				a.Owner = "second"
+				return func() {}, nil
+			})
+			require.ErrorIs(t, err, genserver.ErrConflict)
+			// and is rebuilt to retry
+			_, err = second.Mutator("a")(func(a *account) (func(), error) {
+				a.Owner = "second"
+				return func() {}, nil
+			})
+			require.NoError(t, err)
+			state, err := second.Load("a")
+			require.NoError(t, err)
+			require.Equal(t, account{Balance: 1, Owner: "second"}, state)
+		})
+	}
+}
+
+func TestFileJournalCreate(t *testing.T) {
+	// journals sharing a directory stand in for processes
+	const journals = 8
+	dir := t.TempDir()
+	var created atomic.Int32
+	var wg sync.WaitGroup
+	for i := 0; i < journals; i++ {
+		journal, err := eventsource.NewFileJournal(dir)
+		require.NoError(t, err)
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			exists, err := journal.Create("a", []byte{byte(i)})
+			assert.NoError(t, err)
+			if !exists {
+				created.Add(1)
+			}
+		}(i)
+	}
+	wg.Wait()
+	require.Equal(t, int32(1), created.Load())
+}
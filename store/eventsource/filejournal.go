@@ -0,0 +1,284 @@
+package eventsource
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/hannahhoward/go-genserver/genserver"
+	"github.com/hannahhoward/go-genserver/sync"
+)
+
+const (
+	eventsFile   = "events.log"
+	snapshotFile = "snapshot.json"
+	lockFile     = "append.lock"
+)
+
+// FileJournal keeps the history of each key in its own directory, as an
+// append-only file of JSON lines next to its latest snapshot. Creates and
+// appends hold a lock file for their key, so journals in several processes
+// can share a directory.
+type FileJournal struct {
+	dir string
+}
+
+var _ Journal = (*FileJournal)(nil)
+
+type fileSnapshot struct {
+	Seq   uint64
+	State []byte
+}
+
+// NewFileJournal opens a journal in dir, creating the directory if needed
+func NewFileJournal(dir string) (*FileJournal, error) {
+	err := os.MkdirAll(dir, 0o755)
+	if err != nil {
+		return nil, err
+	}
+	return &FileJournal{dir}, nil
+}
+
+// path returns the directory of key. Hex encoding keeps keys safe as file
+// names, and directory order the same as key order.
+func (fj *FileJournal) path(key string, name ...string) string {
+	return filepath.Join(append([]string{fj.dir, hex.EncodeToString([]byte(key))}, name...)...)
+}
+
+// Create holds the lock file appends use while it checks for and writes the
+// first snapshot, so only one process creates key
+func (fj *FileJournal) Create(key string, state []byte) (bool, error) {
+	err := os.MkdirAll(fj.path(key), 0o755)
+	if err != nil {
+		return false, err
+	}
+	err = syncDir(fj.dir)
+	if err != nil {
+		return false, err
+	}
+	unlock, err := sync.LockFile(fj.path(key, lockFile))
+	if err != nil {
+		return false, err
+	}
+	defer unlock()
+	_, _, ok, err := fj.LoadSnapshot(key)
+	if err != nil || ok {
+		return ok, err
+	}
+	return false, fj.SaveSnapshot(key, 0, state)
+}
+
+// syncDir makes the entries renamed or created in dir durable
+func syncDir(dir string) error {
+	file, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return file.Sync()
+}
+
+// repair drops a partial line left at the end of the file by a crash
+func repair(file *os.File) error {
+	info, err := file.Stat()
+	if err != nil || info.Size() == 0 {
+		return err
+	}
+	last := make([]byte, 1)
+	_, err = file.ReadAt(last, info.Size()-1)
+	if err != nil || last[0] == '\n' {
+		return err
+	}
+	data, err := io.ReadAll(io.NewSectionReader(file, 0, info.Size()))
+	if err != nil {
+		return err
+	}
+	return file.Truncate(int64(bytes.LastIndexByte(data, '\n') + 1))
+}
+
+// lastLine returns the last complete line of file, without its newline
+func lastLine(file *os.File) ([]byte, error) {
+	info, err := file.Stat()
+	if err != nil || info.Size() == 0 {
+		return nil, err
+	}
+	// read backwards from before the final newline, until the one before it
+	var line []byte
+	chunk := make([]byte, 4096)
+	end := info.Size() - 1
+	for end > 0 {
+		start := max(0, end-int64(len(chunk)))
+		n := int(end - start)
+		_, err := file.ReadAt(chunk[:n], start)
+		if err != nil {
+			return nil, err
+		}
+		i := bytes.LastIndexByte(chunk[:n], '\n')
+		line = append(append([]byte{}, chunk[i+1:n]...), line...)
+		if i >= 0 {
+			break
+		}
+		end = start
+	}
+	return line, nil
+}
+
+// lastSeq returns the sequence number of the last event in file, or of the
+// snapshot of key if there are no events
+func (fj *FileJournal) lastSeq(key string, file *os.File) (uint64, error) {
+	line, err := lastLine(file)
+	if err != nil {
+		return 0, err
+	}
+	if len(line) == 0 {
+		seq, _, _, err := fj.LoadSnapshot(key)
+		return seq, err
+	}
+	var event Event
+	err = json.Unmarshal(line, &event)
+	return event.Seq, err
+}
+
+func (fj *FileJournal) Append(key string, events []Event) error {
+	if len(events) == 0 {
+		return nil
+	}
+	unlock, err := sync.LockFile(fj.path(key, lockFile))
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	file, err := os.OpenFile(fj.path(key, eventsFile), os.O_CREATE|os.O_RDWR|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	err = repair(file)
+	if err != nil {
+		return err
+	}
+	last, err := fj.lastSeq(key, file)
+	if err != nil {
+		return err
+	}
+	if events[0].Seq != last+1 {
+		return genserver.ConflictError{ID: key, Version: events[0].Seq}
+	}
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	for _, event := range events {
+		err := encoder.Encode(event)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = file.Write(buf.Bytes())
+	if err != nil {
+		return err
+	}
+	return file.Sync()
+}
+
+func (fj *FileJournal) Events(key string, from uint64, f func(Event) bool) error {
+	file, err := os.Open(fj.path(key, eventsFile))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			// a line without its newline was torn by a crash
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		var event Event
+		err = json.Unmarshal(line, &event)
+		if err != nil {
+			return err
+		}
+		if event.Seq >= from && !f(event) {
+			return nil
+		}
+	}
+}
+
+func (fj *FileJournal) SaveSnapshot(key string, seq uint64, state []byte) error {
+	data, err := json.Marshal(fileSnapshot{seq, state})
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(fj.path(key), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmp.Name(), fj.path(key, snapshotFile))
+	if err != nil {
+		return err
+	}
+	return syncDir(fj.path(key))
+}
+
+func (fj *FileJournal) LoadSnapshot(key string) (uint64, []byte, bool, error) {
+	data, err := os.ReadFile(fj.path(key, snapshotFile))
+	if errors.Is(err, fs.ErrNotExist) {
+		return 0, nil, false, nil
+	}
+	if err != nil {
+		return 0, nil, false, err
+	}
+	var snapshot fileSnapshot
+	err = json.Unmarshal(data, &snapshot)
+	if err != nil {
+		return 0, nil, false, err
+	}
+	return snapshot.Seq, snapshot.State, true, nil
+}
+
+func (fj *FileJournal) Keys(cursor string, f func(key string) bool) error {
+	entries, err := os.ReadDir(fj.dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		key, err := hex.DecodeString(entry.Name())
+		if err != nil || !entry.IsDir() || string(key) <= cursor {
+			continue
+		}
+		// a directory without a snapshot was never fully created
+		if _, err := os.Stat(filepath.Join(fj.dir, entry.Name(), snapshotFile)); err != nil {
+			continue
+		}
+		if !f(string(key)) {
+			break
+		}
+	}
+	return nil
+}
+
+func (fj *FileJournal) Delete(key string) error {
+	return os.RemoveAll(fj.path(key))
+}
@@ -0,0 +1,154 @@
+package eventsource
+
+import (
+	"sort"
+	gosync "sync"
+	"time"
+
+	"github.com/hannahhoward/go-genserver/genserver"
+)
+
+// Event records one successfully handled message for an identifier
+type Event struct {
+	// Seq numbers the events of an identifier from 1, without gaps
+	Seq uint64
+	// Name is the name the handler was registered under, or StateEvent
+	Name string
+	// Message is the encoded message, or the encoded state for StateEvent
+	Message []byte
+	Time    time.Time
+}
+
+// StateEvent names events that replace the whole state. They are recorded
+// when a message handled by an unregistered handler changes the state.
+const StateEvent = "$state"
+
+// Journal durably holds the events and snapshots of every identifier
+type Journal interface {
+	// Create starts the history of key with an initial snapshot at sequence
+	// zero, and reports whether key already had one
+	Create(key string, state []byte) (bool, error)
+	// Append adds events to the history of key. It fails with a
+	// genserver.ConflictError unless the first event directly follows the
+	// last event or snapshot of key, so concurrent writers cannot interleave.
+	Append(key string, events []Event) error
+	// Events calls f for each event of key with a sequence number of at
+	// least from, in order, until f returns false
+	Events(key string, from uint64, f func(Event) bool) error
+	// SaveSnapshot stores the state of key as of event seq
+	SaveSnapshot(key string, seq uint64, state []byte) error
+	// LoadSnapshot returns the latest snapshot of key, if key exists
+	LoadSnapshot(key string) (seq uint64, state []byte, ok bool, err error)
+	// Keys calls f for each key that sorts after cursor, in order, until f
+	// returns false
+	Keys(cursor string, f func(key string) bool) error
+	// Delete removes the history of key
+	Delete(key string) error
+}
+
+type memoryHistory struct {
+	events       []Event
+	snapshotSeq  uint64
+	snapshotData []byte
+}
+
+// MemoryJournal keeps histories in memory, for tests and for audit trails
+// that do not need to survive a restart
+type MemoryJournal struct {
+	lock      gosync.Mutex
+	histories map[string]*memoryHistory
+}
+
+var _ Journal = (*MemoryJournal)(nil)
+
+func NewMemoryJournal() *MemoryJournal {
+	return &MemoryJournal{histories: make(map[string]*memoryHistory)}
+}
+
+func (mj *MemoryJournal) Create(key string, state []byte) (bool, error) {
+	mj.lock.Lock()
+	defer mj.lock.Unlock()
+	if _, ok := mj.histories[key]; ok {
+		return true, nil
+	}
+	mj.histories[key] = &memoryHistory{snapshotData: state}
+	return false, nil
+}
+
+func (mj *MemoryJournal) Append(key string, events []Event) error {
+	mj.lock.Lock()
+	defer mj.lock.Unlock()
+	history, ok := mj.histories[key]
+	if !ok || len(events) == 0 {
+		return nil
+	}
+	last := history.snapshotSeq
+	if n := len(history.events); n > 0 {
+		last = max(last, history.events[n-1].Seq)
+	}
+	if events[0].Seq != last+1 {
+		return genserver.ConflictError{ID: key, Version: events[0].Seq}
+	}
+	history.events = append(history.events, events...)
+	return nil
+}
+
+func (mj *MemoryJournal) Events(key string, from uint64, f func(Event) bool) error {
+	mj.lock.Lock()
+	var events []Event
+	if history, ok := mj.histories[key]; ok {
+		events = history.events
+	}
+	mj.lock.Unlock()
+	for _, event := range events {
+		if event.Seq >= from && !f(event) {
+			break
+		}
+	}
+	return nil
+}
+
+func (mj *MemoryJournal) SaveSnapshot(key string, seq uint64, state []byte) error {
+	mj.lock.Lock()
+	defer mj.lock.Unlock()
+	if history, ok := mj.histories[key]; ok {
+		history.snapshotSeq = seq
+		history.snapshotData = state
+	}
+	return nil
+}
+
+func (mj *MemoryJournal) LoadSnapshot(key string) (uint64, []byte, bool, error) {
+	mj.lock.Lock()
+	defer mj.lock.Unlock()
+	history, ok := mj.histories[key]
+	if !ok {
+		return 0, nil, false, nil
+	}
+	return history.snapshotSeq, history.snapshotData, true, nil
+}
+
+func (mj *MemoryJournal) Keys(cursor string, f func(key string) bool) error {
+	mj.lock.Lock()
+	var keys []string
+	for key := range mj.histories {
+		if key > cursor {
+			keys = append(keys, key)
+		}
+	}
+	mj.lock.Unlock()
+	sort.Strings(keys)
+	for _, key := range keys {
+		if !f(key) {
+			break
+		}
+	}
+	return nil
+}
+
+func (mj *MemoryJournal) Delete(key string) error {
+	mj.lock.Lock()
+	defer mj.lock.Unlock()
+	delete(mj.histories, key)
+	return nil
+}
@@ -0,0 +1,140 @@
+// Package expiry holds the time to live settings and background sweeper
+// shared by stores whose states expire
+package expiry
+
+import (
+	"sync"
+	"time"
+)
+
+// DefaultSweepInterval is how often expired states are deleted, unless
+// configured otherwise
+const DefaultSweepInterval = time.Second
+
+// Config controls how the states of a store expire
+type Config struct {
+	// TTL is how long new states live. Zero means they never expire, unless
+	// given a TTL of their own.
+	TTL time.Duration
+	// Refresh restarts the TTL of a state each time a mutation that changes it
+	// is kept
+	Refresh bool
+	// SweepInterval is how often expired states are deleted. The default is
+	// DefaultSweepInterval.
+	SweepInterval time.Duration
+	// Clock is the clock deadlines are measured against. The default is
+	// time.Now.
+	Clock func() time.Time
+}
+
+// Now returns the current time of the config's clock
+func (c Config) Now() time.Time {
+	if c.Clock == nil {
+		return time.Now()
+	}
+	return c.Clock()
+}
+
+// Start returns the TTL of a state created now
+func (c Config) Start() TTL {
+	return c.After(c.TTL)
+}
+
+// After returns a TTL of duration starting now. A zero duration never expires.
+func (c Config) After(duration time.Duration) TTL {
+	if duration <= 0 {
+		return TTL{}
+	}
+	return TTL{Duration: duration, Deadline: c.Now().Add(duration).UnixNano()}
+}
+
+// Touch returns ttl restarted now if the config refreshes TTLs, and ttl
+// unchanged otherwise
+func (c Config) Touch(ttl TTL) TTL {
+	if !c.Refresh {
+		return ttl
+	}
+	return c.After(ttl.Duration)
+}
+
+// Expired reports whether ttl has run out
+func (c Config) Expired(ttl TTL) bool {
+	return ttl.Deadline != 0 && c.Now().UnixNano() >= ttl.Deadline
+}
+
+// TTL is the expiry of a single state
+type TTL struct {
+	// Duration is how long the state lives after it is written or refreshed
+	Duration time.Duration
+	// Deadline is when the state expires, in Unix nanoseconds. Zero means
+	// never.
+	Deadline int64
+}
+
+// Sweeper periodically calls a sweep function in the background, once started
+type Sweeper struct {
+	interval time.Duration
+	sweep    func()
+	start    sync.Once
+	stop     sync.Once
+	done     chan struct{}
+}
+
+// NewSweeper returns a sweeper calling sweep every interval, or every
+// DefaultSweepInterval if interval is zero
+func NewSweeper(interval time.Duration, sweep func()) *Sweeper {
+	if interval <= 0 {
+		interval = DefaultSweepInterval
+	}
+	return &Sweeper{interval: interval, sweep: sweep, done: make(chan struct{})}
+}
+
+// Start starts sweeping. Starting a running or stopped sweeper does nothing.
+func (s *Sweeper) Start() {
+	s.start.Do(func() {
+		go func() {
+			ticker := time.NewTicker(s.interval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-s.done:
+					return
+				case <-ticker.C:
+					s.sweep()
+				}
+			}
+		}()
+	})
+}
+
+// Stop stops sweeping for good
+func (s *Sweeper) Stop() {
+	s.stop.Do(func() {
+		// a sweeper stopped before it starts must never start
+		s.start.Do(func() {})
+		close(s.done)
+	})
+}
+
+// Listeners calls registered functions for each expired identifier
+type Listeners[ID any] struct {
+	lock      sync.RWMutex
+	listeners []func(id ID)
+}
+
+// Add registers f to be called for each expired identifier
+func (l *Listeners[ID]) Add(f func(id ID)) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.listeners = append(l.listeners, f)
+}
+
+// Expired calls every registered function with id
+func (l *Listeners[ID]) Expired(id ID) {
+	l.lock.RLock()
+	listeners := l.listeners
+	l.lock.RUnlock()
+	for _, f := range listeners {
+		f(id)
+	}
+}
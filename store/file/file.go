@@ -0,0 +1,532 @@
+// Package file is a group.Store that keeps each state in its own file
+package file
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/hannahhoward/go-genserver/codec"
+	"github.com/hannahhoward/go-genserver/genserver"
+	"github.com/hannahhoward/go-genserver/group"
+	"github.com/hannahhoward/go-genserver/store/expiry"
+	"github.com/hannahhoward/go-genserver/sync"
+)
+
+// SyncPolicy controls when writes are flushed to stable storage
+type SyncPolicy uint64
+
+const (
+	// SyncAlways fsyncs every state file and the directory after each write,
+	// so a completed mutation survives a power loss
+	SyncAlways SyncPolicy = iota
+	// SyncNever leaves flushing to the operating system. Writes are still
+	// atomic, but the latest mutations may be lost on a power loss.
+	SyncNever
+)
+
+const (
+	suffix     = ".state"
+	lockSuffix = ".lock"
+	tmpGlob    = ".tmp-*"
+)
+
+type storeConfig struct {
+	codec  any
+	sync   SyncPolicy
+	expiry expiry.Config
+}
+
+type Option func(*storeConfig)
+
+// WithCodec sets how states are encoded on disk. The default is versioned
+// JSON.
+func WithCodec[State any](c codec.Codec[State]) Option {
+	return func(config *storeConfig) {
+		config.codec = c
+	}
+}
+
+// WithExpiry sets how states expire. By default they never do. Deadlines are
+// kept in each file, so they survive reopening the store.
+func WithExpiry(config expiry.Config) Option {
+	return func(storeConfig *storeConfig) {
+		storeConfig.expiry = config
+	}
+}
+
+// WithSync sets when writes are flushed to disk. The default is SyncAlways.
+func WithSync(policy SyncPolicy) Option {
+	return func(config *storeConfig) {
+		config.sync = policy
+	}
+}
+
+// Store keeps one file per identifier in a directory. File names are the hex
+// encoded ID.String(), which keeps directory order the same as ID order.
+type Store[ID fmt.Stringer, State any] struct {
+	dir     string
+	parseID func(string) (ID, error)
+	codec   codec.Codec[State]
+	config  storeConfig
+	// locks guards the file of each ID.String() while it is written, and
+	// while handlers mutate its state. Lock files guard checks and writes
+	// against other processes sharing the directory.
+	locks sync.KeyedMutex[string]
+
+	sweeper   *expiry.Sweeper
+	listeners expiry.Listeners[ID]
+}
+
+var _ group.Store[fmt.Stringer, any] = (*Store[fmt.Stringer, any])(nil)
+
+var _ group.Expirer[fmt.Stringer] = (*Store[fmt.Stringer, any])(nil)
+
+// NewStore opens a store in dir, creating the directory if needed. parseID
+// turns the result of ID.String() back into an ID.
+func NewStore[ID fmt.Stringer, State any](dir string, parseID func(string) (ID, error), options ...Option) (*Store[ID, State], error) {
+	config := storeConfig{
+		sync: SyncAlways,
+	}
+	for _, option := range options {
+		option(&config)
+	}
+	stateCodec, err := codec.For[State](config.codec)
+	if err != nil {
+		return nil, err
+	}
+	err = os.MkdirAll(dir, 0o755)
+	if err != nil {
+		return nil, fmt.Errorf("creating store directory: %w", err)
+	}
+	// temp files left by a crash mid-write were never renamed into place
+	leftovers, err := filepath.Glob(filepath.Join(dir, tmpGlob))
+	if err != nil {
+		return nil, err
+	}
+	for _, leftover := range leftovers {
+		os.Remove(leftover)
+	}
+	s := &Store[ID, State]{
+		dir:     dir,
+		parseID: parseID,
+		codec:   stateCodec,
+		config:  config,
+	}
+	s.sweeper = expiry.NewSweeper(config.expiry.SweepInterval, func() { s.Sweep() })
+	if config.expiry.TTL > 0 {
+		s.sweeper.Start()
+	}
+	return s, nil
+}
+
+func (s *Store[ID, State]) path(key string) string {
+	return filepath.Join(s.dir, hex.EncodeToString([]byte(key))+suffix)
+}
+
+// lockFile locks the file of key across processes, for as long as it takes
+// to check the file and replace it
+func (s *Store[ID, State]) lockFile(key string) (func(), error) {
+	return sync.LockFile(filepath.Join(s.dir, hex.EncodeToString([]byte(key))+lockSuffix))
+}
+
+// Each file starts with a header holding the version of the state, and the
+// duration and deadline of its TTL, as 8 big endian bytes each. The encoded
+// state follows.
+const headerSize = 24
+
+// errExpired is returned, wrapped, for states whose TTL ran out before they
+// were swept. It wraps group.ErrNotFound.
+var errExpired = fmt.Errorf("state expired: %w", group.ErrNotFound)
+
+// stored is a state read from its file
+type stored[State any] struct {
+	state State
+	// data is the state as encoded in the file
+	data    []byte
+	version uint64
+	ttl     expiry.TTL
+	// outdated is set when the state was encoded in an older format than the
+	// codec writes
+	outdated bool
+}
+
+// parseHeader returns the version and TTL at the start of data
+func (s *Store[ID, State]) parseHeader(id ID, data []byte) (uint64, expiry.TTL, error) {
+	if len(data) < headerSize {
+		return 0, expiry.TTL{}, fmt.Errorf("Could not decode state for ID %s: file too short", id)
+	}
+	ttl := expiry.TTL{
+		Duration: time.Duration(binary.BigEndian.Uint64(data[8:16])),
+		Deadline: int64(binary.BigEndian.Uint64(data[16:24])),
+	}
+	if s.config.expiry.Expired(ttl) {
+		return 0, ttl, fmt.Errorf("Could not load state for ID %s: %w", id, errExpired)
+	}
+	return binary.BigEndian.Uint64(data[:8]), ttl, nil
+}
+
+// readHeader returns the version and TTL of the state for id, without reading
+// the state itself
+func (s *Store[ID, State]) readHeader(id ID) (uint64, expiry.TTL, error) {
+	file, err := os.Open(s.path(id.String()))
+	if errors.Is(err, fs.ErrNotExist) {
+		return 0, expiry.TTL{}, fmt.Errorf("Could not load state for ID %s: %w", id, group.ErrNotFound)
+	}
+	if err != nil {
+		return 0, expiry.TTL{}, fmt.Errorf("Could not load state for ID %s: %w", id, err)
+	}
+	defer file.Close()
+	header := make([]byte, headerSize)
+	_, err = io.ReadFull(file, header)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return 0, expiry.TTL{}, fmt.Errorf("Could not load state for ID %s: %w", id, err)
+	}
+	return s.parseHeader(id, header)
+}
+
+func (s *Store[ID, State]) read(id ID) (stored[State], error) {
+	var st stored[State]
+	data, err := os.ReadFile(s.path(id.String()))
+	if errors.Is(err, fs.ErrNotExist) {
+		return st, fmt.Errorf("Could not load state for ID %s: %w", id, group.ErrNotFound)
+	}
+	if err != nil {
+		return st, fmt.Errorf("Could not load state for ID %s: %w", id, err)
+	}
+	st.version, st.ttl, err = s.parseHeader(id, data)
+	if err != nil {
+		return st, err
+	}
+	st.data = data[headerSize:]
+	err = s.codec.Unmarshal(st.data, &st.state)
+	if err != nil {
+		return st, fmt.Errorf("Could not decode state for ID %s: %w", id, err)
+	}
+	st.outdated = codec.Outdated(s.codec, data[headerSize:])
+	return st, nil
+}
+
+// upgrade writes back a state that was read in an older format, unless it
+// changed since. It is best effort: a failure leaves the old file in place,
+// to be upgraded by the next load or mutation. It skips states being
+// mutated, whose handler may be the one loading the state.
+func (s *Store[ID, State]) upgrade(id ID, st stored[State]) {
+	unlock, ok := s.locks.TryLock(id.String())
+	if !ok {
+		return
+	}
+	defer unlock()
+	encoded, err := s.encode(id, st.state)
+	if err != nil {
+		return
+	}
+	unlockFile, err := s.lockFile(id.String())
+	if err != nil {
+		return
+	}
+	defer unlockFile()
+	current, err := s.read(id)
+	if err != nil || current.version != st.version || !current.outdated {
+		return
+	}
+	s.write(id, encoded, st.version, current.ttl)
+}
+
+func (s *Store[ID, State]) encode(id ID, state State) ([]byte, error) {
+	encoded, err := s.codec.Marshal(state)
+	if err != nil {
+		return nil, fmt.Errorf("Could not encode state for ID %s: %w", id, err)
+	}
+	return encoded, nil
+}
+
+// write replaces the file for id with an encoded state in a single rename,
+// so readers and crashes only ever see the old or the new state
+func (s *Store[ID, State]) write(id ID, encoded []byte, version uint64, ttl expiry.TTL) error {
+	data := make([]byte, headerSize, headerSize+len(encoded))
+	binary.BigEndian.PutUint64(data[:8], version)
+	binary.BigEndian.PutUint64(data[8:16], uint64(ttl.Duration))
+	binary.BigEndian.PutUint64(data[16:24], uint64(ttl.Deadline))
+	data = append(data, encoded...)
+	tmp, err := os.CreateTemp(s.dir, tmpGlob)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(data)
+	if err == nil && s.config.sync == SyncAlways {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("Could not write state for ID %s: %w", id, err)
+	}
+	err = os.Rename(tmp.Name(), s.path(id.String()))
+	if err != nil {
+		return fmt.Errorf("Could not write state for ID %s: %w", id, err)
+	}
+	return s.syncDir()
+}
+
+func (s *Store[ID, State]) syncDir() error {
+	if s.config.sync != SyncAlways {
+		return nil
+	}
+	dir, err := os.Open(s.dir)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+func (s *Store[ID, State]) Has(id ID) (bool, error) {
+	_, _, err := s.readHeader(id)
+	if errors.Is(err, group.ErrNotFound) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (s *Store[ID, State]) Load(id ID) (State, error) {
+	state, _, err := s.LoadVersion(id)
+	return state, err
+}
+
+// LoadVersion writes back states stored in an older format, once they have
+// been migrated by the codec
+func (s *Store[ID, State]) LoadVersion(id ID) (State, uint64, error) {
+	st, err := s.read(id)
+	if err == nil && st.outdated {
+		s.upgrade(id, st)
+	}
+	return st.state, st.version, err
+}
+
+func (s *Store[ID, State]) CreateIfNotExist(id ID, state State) (bool, error) {
+	exists, expired, err := s.create(id, state)
+	if expired {
+		s.listeners.Expired(id)
+	}
+	return exists, err
+}
+
+// create writes state for id unless there is a live state already. It reports
+// whether it replaced a state that had expired.
+func (s *Store[ID, State]) create(id ID, state State) (bool, bool, error) {
+	defer s.locks.Lock(id.String())()
+	encoded, err := s.encode(id, state)
+	if err != nil {
+		return false, false, err
+	}
+	unlock, err := s.lockFile(id.String())
+	if err != nil {
+		return false, false, err
+	}
+	defer unlock()
+	_, _, err = s.readHeader(id)
+	if err == nil {
+		return true, false, nil
+	}
+	if !errors.Is(err, group.ErrNotFound) {
+		return false, false, err
+	}
+	return false, errors.Is(err, errExpired), s.write(id, encoded, 1, s.config.expiry.Start())
+}
+
+func (s *Store[ID, State]) Delete(id ID) error {
+	defer s.locks.Lock(id.String())()
+	return s.remove(id)
+}
+
+func (s *Store[ID, State]) remove(id ID) error {
+	err := os.Remove(s.path(id.String()))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return s.syncDir()
+}
+
+// SetTTL sets how long the state for id lives from now, replacing the TTL it
+// was created with. A zero ttl means it never expires.
+func (s *Store[ID, State]) SetTTL(id ID, ttl time.Duration) error {
+	defer s.locks.Lock(id.String())()
+	unlock, err := s.lockFile(id.String())
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	st, err := s.read(id)
+	if err != nil {
+		return err
+	}
+	err = s.write(id, st.data, st.version, s.config.expiry.After(ttl))
+	if err != nil {
+		return err
+	}
+	if ttl > 0 {
+		s.sweeper.Start()
+	}
+	return nil
+}
+
+// OnExpire registers f to be called for each state the store expires
+func (s *Store[ID, State]) OnExpire(f func(id ID)) {
+	s.listeners.Add(f)
+}
+
+// Sweep deletes every expired state. It runs in the background once a TTL is
+// configured or set, and may also be called directly.
+func (s *Store[ID, State]) Sweep() error {
+	var expired []ID
+	err := s.ids("", func(id ID) bool {
+		defer s.locks.Lock(id.String())()
+		unlock, err := s.lockFile(id.String())
+		if err != nil {
+			return true
+		}
+		defer unlock()
+		_, _, err = s.readHeader(id)
+		if errors.Is(err, errExpired) && s.remove(id) == nil {
+			expired = append(expired, id)
+		}
+		return true
+	})
+	for _, id := range expired {
+		s.listeners.Expired(id)
+	}
+	return err
+}
+
+// Close stops sweeping expired states
+func (s *Store[ID, State]) Close() error {
+	s.sweeper.Stop()
+	return nil
+}
+
+// ids calls f for every file in the directory after cursor, whether or not
+// its state has expired
+func (s *Store[ID, State]) ids(cursor string, f func(id ID) bool) error {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return err
+	}
+	// ReadDir sorts by file name, and hex encoding preserves order
+	for _, entry := range entries {
+		name, ok := strings.CutSuffix(entry.Name(), suffix)
+		if !ok {
+			continue
+		}
+		key, err := hex.DecodeString(name)
+		if err != nil || string(key) <= cursor {
+			continue
+		}
+		id, err := s.parseID(string(key))
+		if err != nil {
+			return fmt.Errorf("parsing ID %q: %w", key, err)
+		}
+		if !f(id) {
+			break
+		}
+	}
+	return nil
+}
+
+func (s *Store[ID, State]) IDs(cursor string, f func(id ID) bool) error {
+	var idsErr error
+	err := s.ids(cursor, func(id ID) bool {
+		_, _, err := s.readHeader(id)
+		if errors.Is(err, group.ErrNotFound) {
+			// deleted since the directory was read, or expired
+			return true
+		}
+		if err != nil {
+			idsErr = err
+			return false
+		}
+		return f(id)
+	})
+	if err != nil {
+		return err
+	}
+	return idsErr
+}
+
+func (s *Store[ID, State]) Iterate(cursor string, f func(id ID, state State) bool) error {
+	var iterErr error
+	err := s.ids(cursor, func(id ID) bool {
+		st, err := s.read(id)
+		if errors.Is(err, group.ErrNotFound) {
+			// deleted since the directory was read, or expired
+			return true
+		}
+		if err != nil {
+			iterErr = err
+			return false
+		}
+		return f(id, st.state)
+	})
+	if err != nil {
+		return err
+	}
+	return iterErr
+}
+
+// Mutator only writes the state back when modifier succeeds and changes it,
+// so failed handlers and handlers that only read never touch the disk.
+// Mutations hold a lock for their ID only, so handlers can mutate other
+// states. Before writing, the mutator checks the version on disk is still the
+// one it loaded, holding a lock file for the ID across the check and the
+// rename, so other processes sharing the directory cannot slip a write in
+// between.
+func (s *Store[ID, State]) Mutator(id ID) genserver.StateMutator[State] {
+	return func(modifier genserver.StateMutatorFn[State]) (func(), error) {
+		defer s.locks.Lock(id.String())()
+		st, err := s.read(id)
+		if err != nil {
+			return nil, err
+		}
+		returnValue, err := modifier(&st.state)
+		if err != nil {
+			return nil, err
+		}
+		encoded, err := s.encode(id, st.state)
+		if err != nil {
+			return nil, err
+		}
+		if bytes.Equal(encoded, st.data) {
+			return returnValue, nil
+		}
+		unlock, err := s.lockFile(id.String())
+		if err != nil {
+			return nil, err
+		}
+		defer unlock()
+		current, _, err := s.readHeader(id)
+		if err != nil {
+			return nil, err
+		}
+		if current != st.version {
+			return nil, genserver.ConflictError{ID: id.String(), Version: st.version}
+		}
+		err = s.write(id, encoded, st.version+1, s.config.expiry.Touch(st.ttl))
+		if err != nil {
+			return nil, err
+		}
+		return returnValue, nil
+	}
+}
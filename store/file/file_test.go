@@ -0,0 +1,184 @@
+package file_test
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hannahhoward/go-genserver/codec"
+	"github.com/hannahhoward/go-genserver/genserver"
+	"github.com/hannahhoward/go-genserver/group"
+	"github.com/hannahhoward/go-genserver/store/expiry"
+	"github.com/hannahhoward/go-genserver/store/file"
+	"github.com/hannahhoward/go-genserver/store/storetest"
+	"github.com/stretchr/testify/require"
+)
+
+func parseID(s string) (storetest.ID, error) {
+	return storetest.ID(s), nil
+}
+
+func TestConformance(t *testing.T) {
+	codecs := map[string]codec.Codec[storetest.State]{
+		"json": codec.Versioned(1, codec.JSON[storetest.State]()),
+		"gob":  codec.Versioned(1, codec.Gob[storetest.State]()),
+	}
+	for name, c := range codecs {
+		t.Run(name, func(t *testing.T) {
+			storetest.Run(t, func(t *testing.T) group.Store[storetest.ID, storetest.State] {
+				store, err := file.NewStore[storetest.ID, storetest.State](t.TempDir(), parseID, file.WithCodec(c), file.WithSync(file.SyncNever))
+				require.NoError(t, err)
+				return store
+			})
+		})
+	}
+}
+
+func TestExpiry(t *testing.T) {
+	storetest.RunExpiry(t, func(t *testing.T, config expiry.Config) storetest.ExpiringStore {
+		store, err := file.NewStore[storetest.ID, storetest.State](t.TempDir(), parseID, file.WithExpiry(config), file.WithSync(file.SyncNever))
+		require.NoError(t, err)
+		return store
+	})
+}
+
+func TestDurability(t *testing.T) {
+	dir := t.TempDir()
+	store, err := file.NewStore[storetest.ID, storetest.State](dir, parseID)
+	require.NoError(t, err)
+	_, err = store.CreateIfNotExist("a/b", storetest.State{Count: 1})
+	require.NoError(t, err)
+	_, err = store.Mutator("a/b")(func(s *storetest.State) (func(), error) {
+		s.Count = 2
+		return func() {}, nil
+	})
+	require.NoError(t, err)
+
+	before, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	_, err = store.Mutator("a/b")(func(s *storetest.State) (func(), error) {
+		s.Count = 100
+		return func() {}, errors.New("failed")
+	})
+	require.Error(t, err)
+	after, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Equal(t, len(before), len(after))
+
+	// a crash mid-write leaves a temp file behind, which reopening discards
+	require.NoError(t, os.WriteFile(filepath.Join(dir, ".tmp-123"), []byte("{"), 0o644))
+	reopened, err := file.NewStore[storetest.ID, storetest.State](dir, parseID)
+	require.NoError(t, err)
+	state, err := reopened.Load("a/b")
+	require.NoError(t, err)
+	require.Equal(t, storetest.State{Count: 2}, state)
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+}
+
+func TestConflict(t *testing.T) {
+	dir := t.TempDir()
+	// two stores on one directory stand in for two processes
+	first, err := file.NewStore[storetest.ID, storetest.State](dir, parseID)
+	require.NoError(t, err)
+	second, err := file.NewStore[storetest.ID, storetest.State](dir, parseID)
+	require.NoError(t, err)
+	_, err = first.CreateIfNotExist("a", storetest.State{})
+	require.NoError(t, err)
+
+	_, err = first.Mutator("a")(func(s *storetest.State) (func(), error) {
+		_, err := second.Mutator("a")(func(s *storetest.State) (func(), error) {
+			s.Name = "second"
+			return func() {}, nil
+		})
+		require.NoError(t, err)
+		s.Name = "first"
+		return func() {}, nil
+	})
+	require.ErrorIs(t, err, genserver.ErrConflict)
+	state, version, err := first.LoadVersion("a")
+	require.NoError(t, err)
+	require.Equal(t, "second", state.Name)
+	require.Equal(t, uint64(2), version)
+}
+
+type renamed struct {
+	Total int
+	Name  string
+}
+
+func TestMigration(t *testing.T) {
+	dir := t.TempDir()
+	old, err := file.NewStore[storetest.ID, storetest.State](dir, parseID)
+	require.NoError(t, err)
+	_, err = old.CreateIfNotExist("a", storetest.State{Count: 3, Name: "a"})
+	require.NoError(t, err)
+
+	migrations := codec.NewMigrations().Register(1, func(payload []byte) ([]byte, error) {
+		var v map[string]any
+		if err := json.Unmarshal(payload, &v); err != nil {
+			return nil, err
+		}
+		if v["Count"] == nil {
+			return nil, errors.New("missing Count")
+		}
+		v["Total"] = v["Count"]
+		delete(v, "Count")
+		return json.Marshal(v)
+	})
+	store, err := file.NewStore[storetest.ID, renamed](dir, parseID,
+		file.WithCodec(codec.Migrating(2, codec.JSON[renamed](), migrations)))
+	require.NoError(t, err)
+	state, version, err := store.LoadVersion("a")
+	require.NoError(t, err)
+	require.Equal(t, renamed{Total: 3, Name: "a"}, state)
+	require.Equal(t, uint64(1), version)
+
+	// the upgraded state was written back at the same version
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	data, err := os.ReadFile(filepath.Join(dir, entries[0].Name()))
+	require.NoError(t, err)
+	header, _, err := codec.ReadHeader(data[24:])
+	require.NoError(t, err)
+	require.Equal(t, codec.Header{Codec: "json", Version: 2}, header)
+
+	// a state that cannot be migrated fails calls, rather than handing the
+	// handler a zero state
+	require.NoError(t, os.WriteFile(filepath.Join(dir, entries[0].Name()), append(data[:24:24], []byte("\xc0\x04json\x01{}")...), 0o644))
+	g := group.New[storetest.ID, renamed]("renamed", store)
+	_, err = group.Call(g, "a", 1, func(s *renamed, n int) (int, error) {
+		s.Total += n
+		return s.Total, nil
+	})
+	var migrationErr codec.MigrationError
+	require.ErrorAs(t, err, &migrationErr)
+	require.Equal(t, uint64(1), migrationErr.From)
+}
+
+func TestUnchanged(t *testing.T) {
+	dir := t.TempDir()
+	store, err := file.NewStore[storetest.ID, storetest.State](dir, parseID)
+	require.NoError(t, err)
+	_, err = store.CreateIfNotExist("a", storetest.State{Count: 1})
+	require.NoError(t, err)
+	path := filepath.Join(dir, "61.state")
+	before, err := os.Stat(path)
+	require.NoError(t, err)
+
+	// a handler that only reads leaves the file alone
+	_, err = store.Mutator("a")(func(s *storetest.State) (func(), error) {
+		return func() {}, nil
+	})
+	require.NoError(t, err)
+	_, version, err := store.LoadVersion("a")
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), version)
+	after, err := os.Stat(path)
+	require.NoError(t, err)
+	require.True(t, os.SameFile(before, after))
+}
@@ -0,0 +1,137 @@
+// Package index keeps the identifiers of a store in order, for stores that
+// hold their states in maps, so they can list them a page at a time without
+// sorting every identifier for each page
+package index
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// blockSize is how many identifiers a block holds after splitting. Blocks
+// grow to twice this before they split.
+const blockSize = 512
+
+// PageSize is how many identifiers Each reads under its lock at a time
+const PageSize = 256
+
+type key[ID fmt.Stringer] struct {
+	key string
+	id  ID
+}
+
+// Keys is a set of identifiers, ordered by ID.String(). Identifiers are kept
+// in blocks of sorted keys, so adding or removing one only moves the keys in
+// its block. It is not safe for concurrent use.
+type Keys[ID fmt.Stringer] struct {
+	// blocks are never empty, and the last key of each comes before the first
+	// key of the next
+	blocks [][]key[ID]
+}
+
+// search returns the block and position of the first key at or after k. The
+// block is len(blocks) if there is no such key.
+func (ks *Keys[ID]) search(k string) (int, int) {
+	b := sort.Search(len(ks.blocks), func(b int) bool {
+		block := ks.blocks[b]
+		return block[len(block)-1].key >= k
+	})
+	if b == len(ks.blocks) {
+		return b, 0
+	}
+	block := ks.blocks[b]
+	return b, sort.Search(len(block), func(i int) bool {
+		return block[i].key >= k
+	})
+}
+
+// Add adds id, replacing any identifier with the same key
+func (ks *Keys[ID]) Add(id ID) {
+	k := id.String()
+	b, i := ks.search(k)
+	switch {
+	case len(ks.blocks) == 0:
+		ks.blocks = [][]key[ID]{{{k, id}}}
+		return
+	case b == len(ks.blocks):
+		// after every key, so it goes at the end of the last block
+		b--
+		i = len(ks.blocks[b])
+	case ks.blocks[b][i].key == k:
+		ks.blocks[b][i].id = id
+		return
+	}
+	block := append(ks.blocks[b], key[ID]{})
+	copy(block[i+1:], block[i:])
+	block[i] = key[ID]{k, id}
+	if len(block) <= 2*blockSize {
+		ks.blocks[b] = block
+		return
+	}
+	split := append([]key[ID](nil), block[blockSize:]...)
+	clear(block[blockSize:])
+	ks.blocks[b] = block[:blockSize]
+	ks.blocks = append(ks.blocks, nil)
+	copy(ks.blocks[b+2:], ks.blocks[b+1:])
+	ks.blocks[b+1] = split
+}
+
+// Remove removes the identifier whose String() is k, if there is one
+func (ks *Keys[ID]) Remove(k string) {
+	b, i := ks.search(k)
+	if b == len(ks.blocks) || ks.blocks[b][i].key != k {
+		return
+	}
+	block := ks.blocks[b]
+	copy(block[i:], block[i+1:])
+	block[len(block)-1] = key[ID]{}
+	block = block[:len(block)-1]
+	if len(block) > 0 {
+		ks.blocks[b] = block
+		return
+	}
+	copy(ks.blocks[b:], ks.blocks[b+1:])
+	ks.blocks[len(ks.blocks)-1] = nil
+	ks.blocks = ks.blocks[:len(ks.blocks)-1]
+}
+
+// After returns up to limit identifiers whose String() comes after cursor,
+// in order
+func (ks *Keys[ID]) After(cursor string, limit int) []ID {
+	var ids []ID
+	b, i := ks.search(cursor)
+	if b < len(ks.blocks) && ks.blocks[b][i].key == cursor {
+		i++
+	}
+	for ; b < len(ks.blocks) && len(ids) < limit; b, i = b+1, 0 {
+		for _, k := range ks.blocks[b][i:] {
+			if len(ids) == limit {
+				break
+			}
+			ids = append(ids, k.id)
+		}
+	}
+	return ids
+}
+
+// Each calls f with each identifier whose String() comes after cursor, in
+// order, until f returns false. It holds lock, which guards ks, only while
+// reading each page of PageSize identifiers, so f may change ks, and sees the
+// changes made after the page it is in was read.
+func (ks *Keys[ID]) Each(lock sync.Locker, cursor string, f func(id ID) bool) {
+	for {
+		lock.Lock()
+		ids := ks.After(cursor, PageSize)
+		lock.Unlock()
+		for _, id := range ids {
+			if !f(id) {
+				return
+			}
+		}
+		if len(ids) < PageSize {
+			return
+		}
+		cursor = ids[len(ids)-1].String()
+	}
+}
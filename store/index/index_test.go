@@ -0,0 +1,67 @@
+package index_test
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/hannahhoward/go-genserver/store/index"
+	"github.com/stretchr/testify/require"
+)
+
+type ID string
+
+func (id ID) String() string {
+	return string(id)
+}
+
+func TestKeys(t *testing.T) {
+	// enough keys to split and empty blocks
+	const count = 5000
+	var keys index.Keys[ID]
+	want := map[string]bool{}
+	random := rand.New(rand.NewSource(1))
+	for i := 0; i < 4*count; i++ {
+		k := fmt.Sprintf("%05d", random.Intn(count))
+		if random.Intn(3) == 0 {
+			keys.Remove(k)
+			delete(want, k)
+		} else {
+			keys.Add(ID(k))
+			want[k] = true
+		}
+	}
+	sorted := make([]ID, 0, len(want))
+	for k := range want {
+		sorted = append(sorted, ID(k))
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	require.Equal(t, sorted, keys.After("", 2*count))
+	require.Equal(t, sorted[:10], keys.After("", 10))
+	require.Equal(t, sorted[101:111], keys.After(string(sorted[100]), 10))
+	require.Equal(t, sorted[:5], keys.After("0", 5))
+	require.Empty(t, keys.After(string(sorted[len(sorted)-1]), 10))
+
+	var lock sync.Mutex
+	var listed []ID
+	keys.Each(&lock, "", func(id ID) bool {
+		listed = append(listed, id)
+		return true
+	})
+	require.Equal(t, sorted, listed)
+
+	listed = nil
+	keys.Each(&lock, string(sorted[10]), func(id ID) bool {
+		listed = append(listed, id)
+		return len(listed) < index.PageSize+1
+	})
+	require.Equal(t, sorted[11:11+index.PageSize+1], listed)
+
+	for _, id := range sorted {
+		keys.Remove(string(id))
+	}
+	require.Empty(t, keys.After("", count))
+}
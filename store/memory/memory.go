@@ -1,61 +1,291 @@
 package memory
 
 import (
+	"context"
 	"fmt"
+	"reflect"
+	gosync "sync"
+	"time"
 
 	"github.com/hannahhoward/go-genserver/genserver"
+	"github.com/hannahhoward/go-genserver/group"
+	"github.com/hannahhoward/go-genserver/store/expiry"
+	"github.com/hannahhoward/go-genserver/store/index"
+	"github.com/hannahhoward/go-genserver/store/watch"
 	"github.com/hannahhoward/go-genserver/sync"
 )
 
+type storeConfig struct {
+	expiry expiry.Config
+	watch  watch.Config
+}
+
+type Option func(*storeConfig)
+
+// WithExpiry sets how states expire. By default they never do.
+func WithExpiry(config expiry.Config) Option {
+	return func(storeConfig *storeConfig) {
+		storeConfig.expiry = config
+	}
+}
+
+// WithWatch sets how changes are delivered to watchers. By default each
+// watcher buffers watch.DefaultBuffer changes, and is disconnected if it
+// falls further behind.
+func WithWatch(config watch.Config) Option {
+	return func(storeConfig *storeConfig) {
+		storeConfig.watch = config
+	}
+}
+
 type Store[ID fmt.Stringer, State any] struct {
-	store sync.Map[ID, *State]
+	store  sync.Map[ID, *storedState[State]]
+	config storeConfig
+	// keysLock guards keys, and is held while states are stored or
+	// removed, so keys lists exactly the stored states in order
+	keysLock gosync.Mutex
+	keys     index.Keys[ID]
+
+	sweeper   *expiry.Sweeper
+	listeners expiry.Listeners[ID]
+	watchers  *watch.Hub[ID, State]
 }
 
-func NewStore[ID fmt.Stringer, State any]() *Store[ID, State] {
-	return &Store[ID, State]{}
+var _ group.Store[fmt.Stringer, any] = (*Store[fmt.Stringer, any])(nil)
+
+var _ group.Expirer[fmt.Stringer] = (*Store[fmt.Stringer, any])(nil)
+
+func NewStore[ID fmt.Stringer, State any](options ...Option) *Store[ID, State] {
+	s := &Store[ID, State]{}
+	for _, option := range options {
+		option(&s.config)
+	}
+	s.watchers = watch.NewHub[ID, State](s.config.watch)
+	s.sweeper = expiry.NewSweeper(s.config.expiry.SweepInterval, func() { s.Sweep() })
+	if s.config.expiry.TTL > 0 {
+		s.sweeper.Start()
+	}
+	return s
+}
+
+// storedState guards a single state. Mutations run against a copy while
+// holding mutate, so reads never wait for a handler or observe a mutation in
+// progress. States holding maps, slices or pointers share them with the copy.
+// Mutations leaving the copy deeply equal to the state commit nothing, so
+// changes made in place through those shared fields are neither versioned nor
+// published; handlers should replace what they point to instead.
+type storedState[State any] struct {
+	mutate  gosync.Mutex
+	lock    gosync.RWMutex
+	state   State
+	version uint64
+	ttl     expiry.TTL
+	deleted bool
+}
+
+func (s *Store[ID, State]) load(ss *storedState[State]) (State, uint64, bool) {
+	ss.lock.RLock()
+	defer ss.lock.RUnlock()
+	return ss.state, ss.version, !ss.deleted && !s.config.expiry.Expired(ss.ttl)
+}
+
+// remove deletes ss, if it is still the state stored for id
+func (s *Store[ID, State]) remove(id ID, ss *storedState[State]) bool {
+	s.keysLock.Lock()
+	deleted := s.store.CompareAndDelete(id, ss)
+	if deleted {
+		s.keys.Remove(id.String())
+	}
+	s.keysLock.Unlock()
+	if !deleted {
+		return false
+	}
+	ss.lock.Lock()
+	ss.deleted = true
+	ss.lock.Unlock()
+	return true
 }
 
 func (s *Store[ID, State]) Has(id ID) (bool, error) {
-	_, has := s.store.Load(id)
-	return has, nil
+	ss, exists := s.store.Load(id)
+	if !exists {
+		return false, nil
+	}
+	_, _, ok := s.load(ss)
+	return ok, nil
+}
+
+func (s *Store[ID, State]) Load(id ID) (State, error) {
+	state, _, err := s.LoadVersion(id)
+	return state, err
+}
+
+func (s *Store[ID, State]) LoadVersion(id ID) (State, uint64, error) {
+	ss, exists := s.store.Load(id)
+	if exists {
+		if state, version, ok := s.load(ss); ok {
+			return state, version, nil
+		}
+	}
+	var zeroState State
+	return zeroState, 0, fmt.Errorf("Could not load state for ID %s: %w", id, group.ErrNotFound)
 }
 
 func (s *Store[ID, State]) List() ([]State, error) {
 	var list []State
-	s.store.Range(func(_ ID, value *State) bool {
-		list = append(list, *value)
+	err := s.Iterate("", func(_ ID, state State) bool {
+		list = append(list, state)
 		return true
 	})
-	return list, nil
+	return list, err
 }
 
-func (s *Store[ID, State]) CreateIfNotExist(id ID, state State) (bool, error) {
-	_, exists := s.store.LoadOrStore(id, &state)
-	return exists, nil
+func (s *Store[ID, State]) IDs(cursor string, f func(id ID) bool) error {
+	return s.Iterate(cursor, func(id ID, _ State) bool {
+		return f(id)
+	})
 }
 
-func (s *Store[ID, State]) Get(id ID) (State, error) {
-	return &storedState[ID, State]{&s.store, id}
+func (s *Store[ID, State]) Iterate(cursor string, f func(id ID, state State) bool) error {
+	s.keys.Each(&s.keysLock, cursor, func(id ID) bool {
+		ss, exists := s.store.Load(id)
+		if !exists {
+			return true
+		}
+		state, _, ok := s.load(ss)
+		if !ok {
+			return true
+		}
+		return f(id, state)
+	})
+	return nil
 }
 
-type storedState[ID fmt.Stringer, State any] struct {
-	store *sync.Map[ID, *State]
-	id    ID
+func (s *Store[ID, State]) CreateIfNotExist(id ID, state State) (bool, error) {
+	created := &storedState[State]{state: state, version: 1, ttl: s.config.expiry.Start()}
+	for {
+		s.keysLock.Lock()
+		ss, exists := s.store.LoadOrStore(id, created)
+		if !exists {
+			s.keys.Add(id)
+		}
+		s.keysLock.Unlock()
+		if !exists {
+			return false, nil
+		}
+		if _, _, ok := s.load(ss); ok {
+			return true, nil
+		}
+		// replace a state that expired before it was swept
+		if s.remove(id, ss) {
+			s.listeners.Expired(id)
+		}
+	}
 }
 
-func (ss *storedState[ID, State]) Get() (State, error) {
-	val, exists := ss.store.Load(ss.id)
-	if !exists {
-		var zeroState State
-		return zeroState, fmt.Errorf("Could not load state for ID %s", ss.id)
+func (s *Store[ID, State]) Delete(id ID) error {
+	ss, exists := s.store.Load(id)
+	if exists {
+		s.remove(id, ss)
 	}
-	return *val, nil
+	return nil
 }
 
-func (ss *storedState[ID, State]) ModifyState(modifier genserver.StateMutatorFn[State]) (func(), error) {
-	val, exists := ss.store.Load(ss.id)
+// SetTTL sets how long the state for id lives from now, replacing the TTL it
+// was created with. A zero ttl means it never expires.
+func (s *Store[ID, State]) SetTTL(id ID, ttl time.Duration) error {
+	ss, exists := s.store.Load(id)
 	if !exists {
-		return nil, fmt.Errorf("Could not load state for ID %s", ss.id)
+		return fmt.Errorf("Could not load state for ID %s: %w", id, group.ErrNotFound)
+	}
+	ss.lock.Lock()
+	defer ss.lock.Unlock()
+	if ss.deleted || s.config.expiry.Expired(ss.ttl) {
+		return fmt.Errorf("Could not load state for ID %s: %w", id, group.ErrNotFound)
+	}
+	ss.ttl = s.config.expiry.After(ttl)
+	if ttl > 0 {
+		s.sweeper.Start()
+	}
+	return nil
+}
+
+// OnExpire registers f to be called for each state the store expires
+func (s *Store[ID, State]) OnExpire(f func(id ID)) {
+	s.listeners.Add(f)
+}
+
+// Sweep deletes every expired state. It runs in the background once a TTL is
+// configured or set, and may also be called directly.
+func (s *Store[ID, State]) Sweep() error {
+	var expired []ID
+	s.store.Range(func(id ID, ss *storedState[State]) bool {
+		ss.lock.RLock()
+		ttl := ss.ttl
+		ss.lock.RUnlock()
+		if s.config.expiry.Expired(ttl) && s.remove(id, ss) {
+			expired = append(expired, id)
+		}
+		return true
+	})
+	for _, id := range expired {
+		s.listeners.Expired(id)
+	}
+	return nil
+}
+
+// Close stops sweeping expired states
+func (s *Store[ID, State]) Close() error {
+	s.sweeper.Stop()
+	return nil
+}
+
+// Watch returns a channel receiving each change to the state for id, until
+// ctx is done and the channel is closed. See WithWatch for what happens to
+// watchers that fall behind.
+func (s *Store[ID, State]) Watch(ctx context.Context, id ID) <-chan watch.Change[ID, State] {
+	return s.watchers.Watch(ctx, id)
+}
+
+// WatchAll is like Watch, but receives changes to every state
+func (s *Store[ID, State]) WatchAll(ctx context.Context) <-chan watch.Change[ID, State] {
+	return s.watchers.WatchAll(ctx)
+}
+
+func (s *Store[ID, State]) Mutator(id ID) genserver.StateMutator[State] {
+	return func(modifier genserver.StateMutatorFn[State]) (func(), error) {
+		ss, exists := s.store.Load(id)
+		if !exists {
+			return nil, fmt.Errorf("Could not load state for ID %s: %w", id, group.ErrNotFound)
+		}
+		ss.mutate.Lock()
+		defer ss.mutate.Unlock()
+		// mutate a copy, so a failed modifier leaves the stored state untouched
+		state, version, ok := s.load(ss)
+		if !ok {
+			return nil, fmt.Errorf("Could not load state for ID %s: %w", id, group.ErrNotFound)
+		}
+		old := state
+		returnValue, err := modifier(&state)
+		if err != nil {
+			return nil, err
+		}
+		if reflect.DeepEqual(old, state) {
+			return returnValue, nil
+		}
+		ss.lock.Lock()
+		if ss.deleted {
+			ss.lock.Unlock()
+			return nil, fmt.Errorf("Could not store state for ID %s: %w", id, group.ErrNotFound)
+		}
+		ss.state = state
+		ss.version = version + 1
+		ss.ttl = s.config.expiry.Touch(ss.ttl)
+		ss.lock.Unlock()
+		// still holding mutate, so watchers see changes to id in order
+		if s.watchers.Watching() {
+			s.watchers.Publish(watch.Change[ID, State]{ID: id, Old: old, New: state, Version: version + 1})
+		}
+		return returnValue, nil
 	}
-	return modifier(val)
 }
@@ -1,10 +1,17 @@
 package memory_test
 
 import (
+	"context"
+	"errors"
 	"strconv"
 	"testing"
 
+	"github.com/hannahhoward/go-genserver/group"
+	"github.com/hannahhoward/go-genserver/store/expiry"
 	"github.com/hannahhoward/go-genserver/store/memory"
+	"github.com/hannahhoward/go-genserver/store/storetest"
+	"github.com/hannahhoward/go-genserver/store/watch"
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
@@ -18,6 +25,18 @@ type value struct {
 	i int
 }
 
+func TestConformance(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) group.Store[storetest.ID, storetest.State] {
+		return memory.NewStore[storetest.ID, storetest.State]()
+	})
+}
+
+func TestExpiry(t *testing.T) {
+	storetest.RunExpiry(t, func(t *testing.T, config expiry.Config) storetest.ExpiringStore {
+		return memory.NewStore[storetest.ID, storetest.State](memory.WithExpiry(config))
+	})
+}
+
 func TestThreadSafety(t *testing.T) {
 	store := memory.NewStore[PrintableInt, value]()
 	has, err := store.Has(PrintableInt(5))
@@ -25,31 +44,71 @@ func TestThreadSafety(t *testing.T) {
 	require.Nil(t, err)
 	readDone := make(chan struct{}, 1)
 	writeDone := make(chan struct{}, 1)
-	ss := store.Get(PrintableInt(5))
+	mutator := store.Mutator(PrintableInt(5))
 	go func() {
+		last := 0
 		for i := 0; i < 100; i++ {
-			val, err := ss.Get()
-			if err == nil {
-				t.Logf("read val: %d", val.i)
+			val, err := store.Load(PrintableInt(5))
+			if err != nil {
+				assert.ErrorIs(t, err, group.ErrNotFound)
+				continue
 			}
+			// reads see whole writes, in order
+			assert.GreaterOrEqual(t, val.i, last)
+			assert.LessOrEqual(t, val.i, 104)
+			last = val.i
 		}
 		readDone <- struct{}{}
 	}()
 	go func() {
 		store.CreateIfNotExist(PrintableInt(5), value{5})
 		for i := 0; i < 100; i++ {
-			returnValFunc, err := ss.ModifyState(func(a *value) (func(), error) {
+			returnValFunc, err := mutator(func(a *value) (func(), error) {
 				a.i = i + 5
 				return func() {
 					t.Logf("write val: %d", i+5)
 				}, nil
 			})
-			if err == nil {
-				returnValFunc()
-			}
+			assert.NoError(t, err)
+			returnValFunc()
 		}
 		writeDone <- struct{}{}
 	}()
 	<-writeDone
 	<-readDone
+	val, err := store.Load(PrintableInt(5))
+	require.NoError(t, err)
+	require.Equal(t, 104, val.i)
+}
+
+func TestWatch(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	store := memory.NewStore[PrintableInt, value]()
+	one := store.Watch(ctx, PrintableInt(1))
+	all := store.WatchAll(ctx)
+	for _, id := range []PrintableInt{1, 2} {
+		_, err := store.CreateIfNotExist(id, value{})
+		require.NoError(t, err)
+		_, err = store.Mutator(id)(func(v *value) (func(), error) {
+			v.i = int(id) * 10
+			return func() {}, nil
+		})
+		require.NoError(t, err)
+	}
+	// failed mutations are not changes
+	_, err := store.Mutator(PrintableInt(1))(func(v *value) (func(), error) {
+		v.i = 100
+		return func() {}, errors.New("failed")
+	})
+	require.Error(t, err)
+
+	require.Equal(t, watch.Change[PrintableInt, value]{ID: 1, Old: value{}, New: value{10}, Version: 2}, <-one)
+	require.Equal(t, watch.Change[PrintableInt, value]{ID: 1, Old: value{}, New: value{10}, Version: 2}, <-all)
+	require.Equal(t, watch.Change[PrintableInt, value]{ID: 2, Old: value{}, New: value{20}, Version: 2}, <-all)
+	select {
+	case c := <-one:
+		require.FailNow(t, "unexpected change", "%v", c)
+	default:
+	}
 }
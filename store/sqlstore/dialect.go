@@ -0,0 +1,41 @@
+package sqlstore
+
+import "strconv"
+
+// Dialect holds the parts of SQL that differ between databases
+type Dialect struct {
+	// Placeholder returns the bind parameter for the nth argument, from 1
+	Placeholder func(n int) string
+	// KeyType is the column type of identifiers. It must sort by bytes, so
+	// listings match the order of ID.String().
+	KeyType string
+	// StateType is the column type of encoded states
+	StateType string
+}
+
+func questionMark(int) string {
+	return "?"
+}
+
+// SQLite uses ? placeholders
+var SQLite = Dialect{
+	Placeholder: questionMark,
+	KeyType:     "TEXT",
+	StateType:   "BLOB",
+}
+
+// Postgres uses numbered placeholders
+var Postgres = Dialect{
+	Placeholder: func(n int) string {
+		return "$" + strconv.Itoa(n)
+	},
+	KeyType:   `TEXT COLLATE "C"`,
+	StateType: "BYTEA",
+}
+
+// MySQL uses ? placeholders
+var MySQL = Dialect{
+	Placeholder: questionMark,
+	KeyType:     "VARCHAR(255) COLLATE utf8mb4_bin",
+	StateType:   "LONGBLOB",
+}
@@ -0,0 +1,196 @@
+package sqlstore_test
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// fakeDB is an in-process database/sql driver that understands exactly the
+// statements sqlstore issues. Statements apply immediately and transactions
+// provide no isolation, which is enough to exercise the version checks.
+type fakeDB struct {
+	lock sync.Mutex
+	rows map[string]fakeRow
+}
+
+type fakeRow struct {
+	state     []byte
+	version   int64
+	ttl       int64
+	expiresAt int64
+}
+
+func newFakeDB() *fakeDB {
+	return &fakeDB{rows: make(map[string]fakeRow)}
+}
+
+func (db *fakeDB) Connect(context.Context) (driver.Conn, error) {
+	return &fakeConn{db}, nil
+}
+
+func (db *fakeDB) Driver() driver.Driver {
+	return nil
+}
+
+type fakeConn struct {
+	db *fakeDB
+}
+
+func (c *fakeConn) Prepare(query string) (driver.Stmt, error) {
+	return &fakeStmt{c.db, query}, nil
+}
+
+func (c *fakeConn) Close() error {
+	return nil
+}
+
+func (c *fakeConn) Begin() (driver.Tx, error) {
+	return fakeTx{}, nil
+}
+
+type fakeTx struct{}
+
+func (fakeTx) Commit() error {
+	return nil
+}
+
+func (fakeTx) Rollback() error {
+	return nil
+}
+
+type fakeStmt struct {
+	db    *fakeDB
+	query string
+}
+
+func (s *fakeStmt) Close() error {
+	return nil
+}
+
+func (s *fakeStmt) NumInput() int {
+	return -1
+}
+
+func (s *fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	s.db.lock.Lock()
+	defer s.db.lock.Unlock()
+	switch {
+	case strings.HasPrefix(s.query, "CREATE TABLE IF NOT EXISTS"):
+		return driver.RowsAffected(0), nil
+	case strings.HasPrefix(s.query, "INSERT INTO"):
+		key := args[0].(string)
+		if _, ok := s.db.rows[key]; ok {
+			return nil, errors.New("UNIQUE constraint failed")
+		}
+		s.db.rows[key] = fakeRow{args[1].([]byte), 1, args[2].(int64), args[3].(int64)}
+		return driver.RowsAffected(1), nil
+	case strings.HasPrefix(s.query, "UPDATE"):
+		key := args[4].(string)
+		row, ok := s.db.rows[key]
+		if !ok || row.version != args[5].(int64) {
+			return driver.RowsAffected(0), nil
+		}
+		s.db.rows[key] = fakeRow{args[0].([]byte), args[1].(int64), args[2].(int64), args[3].(int64)}
+		return driver.RowsAffected(1), nil
+	case strings.HasPrefix(s.query, "DELETE FROM"):
+		key := args[0].(string)
+		row, ok := s.db.rows[key]
+		if ok && strings.Contains(s.query, "AND version") && row.version != args[1].(int64) {
+			ok = false
+		}
+		if ok {
+			delete(s.db.rows, key)
+		}
+		if ok {
+			return driver.RowsAffected(1), nil
+		}
+		return driver.RowsAffected(0), nil
+	}
+	return nil, fmt.Errorf("fakeDB cannot exec %q", s.query)
+}
+
+func (s *fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	s.db.lock.Lock()
+	defer s.db.lock.Unlock()
+	switch {
+	case strings.HasPrefix(s.query, "SELECT expires_at FROM"):
+		if row, ok := s.db.rows[args[0].(string)]; ok {
+			return &fakeRows{[]string{"expires_at"}, [][]driver.Value{{row.expiresAt}}}, nil
+		}
+		return &fakeRows{[]string{"expires_at"}, nil}, nil
+	case strings.HasPrefix(s.query, "SELECT state, version, ttl, expires_at FROM"):
+		columns := []string{"state", "version", "ttl", "expires_at"}
+		if row, ok := s.db.rows[args[0].(string)]; ok {
+			return &fakeRows{columns, [][]driver.Value{{row.state, row.version, row.ttl, row.expiresAt}}}, nil
+		}
+		return &fakeRows{columns, nil}, nil
+	case strings.HasPrefix(s.query, "SELECT id, version FROM"):
+		rows := &fakeRows{columns: []string{"id", "version"}}
+		for key, row := range s.db.rows {
+			if row.expiresAt > 0 && row.expiresAt <= args[0].(int64) {
+				rows.values = append(rows.values, []driver.Value{key, row.version})
+			}
+		}
+		return rows, nil
+	case strings.HasPrefix(s.query, "SELECT id, expires_at FROM"), strings.HasPrefix(s.query, "SELECT id, state, expires_at FROM"):
+		withState := strings.HasPrefix(s.query, "SELECT id, state")
+		var limit int
+		_, err := fmt.Sscanf(s.query[strings.LastIndex(s.query, "LIMIT"):], "LIMIT %d", &limit)
+		if err != nil {
+			return nil, err
+		}
+		var keys []string
+		for key := range s.db.rows {
+			if key > args[0].(string) {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+		if len(keys) > limit {
+			keys = keys[:limit]
+		}
+		rows := &fakeRows{columns: []string{"id"}}
+		if withState {
+			rows.columns = append(rows.columns, "state")
+		}
+		rows.columns = append(rows.columns, "expires_at")
+		for _, key := range keys {
+			values := []driver.Value{key}
+			if withState {
+				values = append(values, s.db.rows[key].state)
+			}
+			values = append(values, s.db.rows[key].expiresAt)
+			rows.values = append(rows.values, values)
+		}
+		return rows, nil
+	}
+	return nil, fmt.Errorf("fakeDB cannot query %q", s.query)
+}
+
+type fakeRows struct {
+	columns []string
+	values  [][]driver.Value
+}
+
+func (r *fakeRows) Columns() []string {
+	return r.columns
+}
+
+func (r *fakeRows) Close() error {
+	return nil
+}
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if len(r.values) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.values[0])
+	r.values = r.values[1:]
+	return nil
+}
@@ -0,0 +1,520 @@
+// Package sqlstore is a group.Store that keeps encoded states in a
+// database/sql table keyed by ID.String().
+//
+// The tests run against an in-process fake driver that understands exactly
+// the statements of the SQLite dialect, since the module depends on no
+// database driver. The Postgres and MySQL dialects are not exercised by them.
+package sqlstore
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"regexp"
+	"time"
+
+	"github.com/hannahhoward/go-genserver/codec"
+	"github.com/hannahhoward/go-genserver/genserver"
+	"github.com/hannahhoward/go-genserver/group"
+	"github.com/hannahhoward/go-genserver/store/expiry"
+	"github.com/hannahhoward/go-genserver/sync"
+)
+
+const (
+	defaultTable     = "genserver_states"
+	defaultBatchSize = 100
+)
+
+var validTable = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+type storeConfig struct {
+	table     string
+	dialect   Dialect
+	codec     any
+	batchSize int
+	expiry    expiry.Config
+}
+
+type Option func(*storeConfig)
+
+// WithTable sets the name of the table states are kept in
+func WithTable(table string) Option {
+	return func(config *storeConfig) {
+		config.table = table
+	}
+}
+
+// WithDialect sets the SQL dialect of the database. The default is SQLite.
+func WithDialect(dialect Dialect) Option {
+	return func(config *storeConfig) {
+		config.dialect = dialect
+	}
+}
+
+// WithCodec sets how states are encoded. The default is versioned JSON.
+func WithCodec[State any](c codec.Codec[State]) Option {
+	return func(config *storeConfig) {
+		config.codec = c
+	}
+}
+
+// WithExpiry sets how states expire. By default they never do. Deadlines are
+// kept in the table, so they are shared by every process using it.
+func WithExpiry(config expiry.Config) Option {
+	return func(storeConfig *storeConfig) {
+		storeConfig.expiry = config
+	}
+}
+
+// WithBatchSize sets how many rows IDs and Iterate read per query. It must
+// be positive.
+func WithBatchSize(batchSize int) Option {
+	return func(config *storeConfig) {
+		config.batchSize = batchSize
+	}
+}
+
+type statements struct {
+	has, load, insert, update, delete, expire, expired, ids, iterate string
+}
+
+// Store keeps one row per identifier, with the encoded state and a version
+// that increases with every mutation
+type Store[ID fmt.Stringer, State any] struct {
+	db      *sql.DB
+	parseID func(string) (ID, error)
+	codec   codec.Codec[State]
+	config  storeConfig
+	sql     statements
+	// locks serializes changes to each ID.String() within this process,
+	// including mutations while their handler runs
+	locks sync.KeyedMutex[string]
+
+	sweeper   *expiry.Sweeper
+	listeners expiry.Listeners[ID]
+}
+
+var _ group.Store[fmt.Stringer, any] = (*Store[fmt.Stringer, any])(nil)
+
+var _ group.Expirer[fmt.Stringer] = (*Store[fmt.Stringer, any])(nil)
+
+// NewStore returns a store using db, creating its table if it does not exist.
+// parseID turns the result of ID.String() back into an ID.
+func NewStore[ID fmt.Stringer, State any](ctx context.Context, db *sql.DB, parseID func(string) (ID, error), options ...Option) (*Store[ID, State], error) {
+	config := storeConfig{
+		table:     defaultTable,
+		dialect:   SQLite,
+		batchSize: defaultBatchSize,
+	}
+	for _, option := range options {
+		option(&config)
+	}
+	if !validTable.MatchString(config.table) {
+		return nil, fmt.Errorf("invalid table name %q", config.table)
+	}
+	if config.batchSize <= 0 {
+		return nil, fmt.Errorf("invalid batch size %d", config.batchSize)
+	}
+	stateCodec, err := codec.For[State](config.codec)
+	if err != nil {
+		return nil, err
+	}
+	p := config.dialect.Placeholder
+	t := config.table
+	s := &Store[ID, State]{
+		db:      db,
+		parseID: parseID,
+		codec:   stateCodec,
+		config:  config,
+		sql: statements{
+			has:     fmt.Sprintf("SELECT expires_at FROM %s WHERE id = %s", t, p(1)),
+			load:    fmt.Sprintf("SELECT state, version, ttl, expires_at FROM %s WHERE id = %s", t, p(1)),
+			insert:  fmt.Sprintf("INSERT INTO %s (id, state, version, ttl, expires_at) VALUES (%s, %s, 1, %s, %s)", t, p(1), p(2), p(3), p(4)),
+			update:  fmt.Sprintf("UPDATE %s SET state = %s, version = %s, ttl = %s, expires_at = %s WHERE id = %s AND version = %s", t, p(1), p(2), p(3), p(4), p(5), p(6)),
+			delete:  fmt.Sprintf("DELETE FROM %s WHERE id = %s", t, p(1)),
+			expire:  fmt.Sprintf("DELETE FROM %s WHERE id = %s AND version = %s", t, p(1), p(2)),
+			expired: fmt.Sprintf("SELECT id, version FROM %s WHERE expires_at > 0 AND expires_at <= %s", t, p(1)),
+			ids:     fmt.Sprintf("SELECT id, expires_at FROM %s WHERE id > %s ORDER BY id LIMIT %d", t, p(1), config.batchSize),
+			iterate: fmt.Sprintf("SELECT id, state, expires_at FROM %s WHERE id > %s ORDER BY id LIMIT %d", t, p(1), config.batchSize),
+		},
+	}
+	// ttl is in nanoseconds and expires_at in Unix nanoseconds, zero when the
+	// state never expires
+	schema := fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (id %s PRIMARY KEY, state %s NOT NULL, version BIGINT NOT NULL, ttl BIGINT NOT NULL DEFAULT 0, expires_at BIGINT NOT NULL DEFAULT 0)",
+		t, config.dialect.KeyType, config.dialect.StateType)
+	_, err = db.ExecContext(ctx, schema)
+	if err != nil {
+		return nil, fmt.Errorf("creating table %s: %w", t, err)
+	}
+	s.sweeper = expiry.NewSweeper(config.expiry.SweepInterval, func() { s.Sweep() })
+	if config.expiry.TTL > 0 {
+		s.sweeper.Start()
+	}
+	return s, nil
+}
+
+// expired reports whether a row with the given expires_at has expired
+func (s *Store[ID, State]) expired(expiresAt int64) bool {
+	return s.config.expiry.Expired(expiry.TTL{Deadline: expiresAt})
+}
+
+func (s *Store[ID, State]) decode(id ID, data []byte) (State, error) {
+	var state State
+	err := s.codec.Unmarshal(data, &state)
+	if err != nil {
+		return state, fmt.Errorf("Could not decode state for ID %s: %w", id, err)
+	}
+	return state, nil
+}
+
+func (s *Store[ID, State]) Has(id ID) (bool, error) {
+	var expiresAt int64
+	err := s.db.QueryRow(s.sql.has, id.String()).Scan(&expiresAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	return err == nil && !s.expired(expiresAt), err
+}
+
+func (s *Store[ID, State]) Load(id ID) (State, error) {
+	state, _, err := s.LoadVersion(id)
+	return state, err
+}
+
+// row is a state as stored in the table
+type row struct {
+	data    []byte
+	version int64
+	ttl     expiry.TTL
+}
+
+type scanner interface {
+	Scan(dest ...any) error
+}
+
+// scanRow reads the result of the load statement, treating expired rows as
+// missing
+func (s *Store[ID, State]) scanRow(id ID, query scanner) (row, error) {
+	var r row
+	var ttl int64
+	err := query.Scan(&r.data, &r.version, &ttl, &r.ttl.Deadline)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && s.expired(r.ttl.Deadline)) {
+		return r, fmt.Errorf("Could not load state for ID %s: %w", id, group.ErrNotFound)
+	}
+	if err != nil {
+		return r, fmt.Errorf("Could not load state for ID %s: %w", id, err)
+	}
+	r.ttl.Duration = time.Duration(ttl)
+	return r, nil
+}
+
+func (s *Store[ID, State]) LoadVersion(id ID) (State, uint64, error) {
+	var state State
+	r, err := s.scanRow(id, s.db.QueryRow(s.sql.load, id.String()))
+	if err != nil {
+		return state, 0, err
+	}
+	state, err = s.decode(id, r.data)
+	if err == nil && codec.Outdated(s.codec, r.data) {
+		s.upgrade(id, state, r)
+	}
+	return state, uint64(r.version), err
+}
+
+// upgrade writes back a state that was stored in an older format, at the same
+// version, unless it changed since. It is best effort: a failure leaves the
+// old row in place, to be upgraded by the next load or mutation.
+func (s *Store[ID, State]) upgrade(id ID, state State, r row) {
+	data, err := s.codec.Marshal(state)
+	if err != nil {
+		return
+	}
+	s.db.Exec(s.sql.update, data, r.version, int64(r.ttl.Duration), r.ttl.Deadline, id.String(), r.version)
+}
+
+func (s *Store[ID, State]) CreateIfNotExist(id ID, state State) (bool, error) {
+	exists, expired, err := s.create(id, state)
+	if expired {
+		s.listeners.Expired(id)
+	}
+	return exists, err
+}
+
+// create inserts state for id unless there is a live state already. It
+// reports whether it replaced a state that had expired.
+func (s *Store[ID, State]) create(id ID, state State) (bool, bool, error) {
+	key := id.String()
+	defer s.locks.Lock(key)()
+	r, err := s.scanRow(id, s.db.QueryRow(s.sql.load, key))
+	if err == nil {
+		return true, false, nil
+	}
+	if !errors.Is(err, group.ErrNotFound) {
+		return false, false, err
+	}
+	expired := false
+	if r.version != 0 {
+		// the row expired before it was swept
+		expired, err = s.expire(key, r.version)
+		if err != nil {
+			return false, false, fmt.Errorf("Could not create state for ID %s: %w", id, err)
+		}
+	}
+	data, err := s.codec.Marshal(state)
+	if err != nil {
+		return false, expired, fmt.Errorf("Could not encode state for ID %s: %w", id, err)
+	}
+	ttl := s.config.expiry.Start()
+	_, err = s.db.Exec(s.sql.insert, key, data, int64(ttl.Duration), ttl.Deadline)
+	if err != nil {
+		// another process may have inserted the row first
+		if has, hasErr := s.Has(id); hasErr == nil && has {
+			return true, expired, nil
+		}
+		return false, expired, fmt.Errorf("Could not create state for ID %s: %w", id, err)
+	}
+	return false, expired, nil
+}
+
+// expire deletes the row for key if it is still at version, and reports
+// whether it did
+func (s *Store[ID, State]) expire(key string, version int64) (bool, error) {
+	result, err := s.db.Exec(s.sql.expire, key, version)
+	if err != nil {
+		return false, err
+	}
+	deleted, err := result.RowsAffected()
+	return deleted > 0, err
+}
+
+func (s *Store[ID, State]) Delete(id ID) error {
+	key := id.String()
+	defer s.locks.Lock(key)()
+	_, err := s.db.Exec(s.sql.delete, key)
+	if err != nil {
+		return fmt.Errorf("Could not delete state for ID %s: %w", id, err)
+	}
+	return nil
+}
+
+// SetTTL sets how long the state for id lives from now, replacing the TTL it
+// was created with. A zero ttl means it never expires.
+func (s *Store[ID, State]) SetTTL(id ID, ttl time.Duration) error {
+	key := id.String()
+	defer s.locks.Lock(key)()
+	r, err := s.scanRow(id, s.db.QueryRow(s.sql.load, key))
+	if err != nil {
+		return err
+	}
+	expires := s.config.expiry.After(ttl)
+	result, err := s.db.Exec(s.sql.update, r.data, r.version, int64(expires.Duration), expires.Deadline, key, r.version)
+	if err != nil {
+		return fmt.Errorf("Could not store state for ID %s: %w", id, err)
+	}
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("Could not store state for ID %s: %w", id, err)
+	}
+	if updated == 0 {
+		return genserver.ConflictError{ID: key, Version: uint64(r.version)}
+	}
+	if ttl > 0 {
+		s.sweeper.Start()
+	}
+	return nil
+}
+
+// OnExpire registers f to be called for each state the store expires
+func (s *Store[ID, State]) OnExpire(f func(id ID)) {
+	s.listeners.Add(f)
+}
+
+// Sweep deletes every expired state. It runs in the background once a TTL is
+// configured or set, and may also be called directly. Rows expired by other
+// processes sharing the table are only reported by the process that deletes
+// them.
+func (s *Store[ID, State]) Sweep() error {
+	type candidate struct {
+		key     string
+		version int64
+	}
+	var candidates []candidate
+	rows, err := s.db.Query(s.sql.expired, s.config.expiry.Now().UnixNano())
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var c candidate
+		err = rows.Scan(&c.key, &c.version)
+		if err != nil {
+			break
+		}
+		candidates = append(candidates, c)
+	}
+	if err == nil {
+		err = rows.Err()
+	}
+	rows.Close()
+	if err != nil {
+		return err
+	}
+	for _, c := range candidates {
+		id, err := s.parseID(c.key)
+		if err != nil {
+			return fmt.Errorf("parsing ID %q: %w", c.key, err)
+		}
+		unlock := s.locks.Lock(c.key)
+		expired, err := s.expire(c.key, c.version)
+		unlock()
+		if err != nil {
+			return fmt.Errorf("Could not delete state for ID %s: %w", id, err)
+		}
+		if expired {
+			s.listeners.Expired(id)
+		}
+	}
+	return nil
+}
+
+// Close stops sweeping expired states. It does not close the database.
+func (s *Store[ID, State]) Close() error {
+	s.sweeper.Stop()
+	return nil
+}
+
+// page reads up to a batch of rows after cursor with query, returning the
+// last key read
+func (s *Store[ID, State]) page(query string, cursor string, scan func(rows *sql.Rows) (string, error)) (string, int, error) {
+	rows, err := s.db.Query(query, cursor)
+	if err != nil {
+		return cursor, 0, err
+	}
+	defer rows.Close()
+	n := 0
+	for rows.Next() {
+		cursor, err = scan(rows)
+		if err != nil {
+			return cursor, n, err
+		}
+		n++
+	}
+	return cursor, n, rows.Err()
+}
+
+func (s *Store[ID, State]) IDs(cursor string, f func(id ID) bool) error {
+	for {
+		var ids []ID
+		next, n, err := s.page(s.sql.ids, cursor, func(rows *sql.Rows) (string, error) {
+			var key string
+			var expiresAt int64
+			err := rows.Scan(&key, &expiresAt)
+			if err != nil || s.expired(expiresAt) {
+				return key, err
+			}
+			id, err := s.parseID(key)
+			if err != nil {
+				return key, fmt.Errorf("parsing ID %q: %w", key, err)
+			}
+			ids = append(ids, id)
+			return key, nil
+		})
+		if err != nil {
+			return err
+		}
+		// rows are closed before calling f, so f may use the store
+		for _, id := range ids {
+			if !f(id) {
+				return nil
+			}
+		}
+		if n < s.config.batchSize {
+			return nil
+		}
+		cursor = next
+	}
+}
+
+func (s *Store[ID, State]) Iterate(cursor string, f func(id ID, state State) bool) error {
+	for {
+		var entries []group.Entry[ID, State]
+		next, n, err := s.page(s.sql.iterate, cursor, func(rows *sql.Rows) (string, error) {
+			var key string
+			var data []byte
+			var expiresAt int64
+			err := rows.Scan(&key, &data, &expiresAt)
+			if err != nil || s.expired(expiresAt) {
+				return key, err
+			}
+			id, err := s.parseID(key)
+			if err != nil {
+				return key, fmt.Errorf("parsing ID %q: %w", key, err)
+			}
+			state, err := s.decode(id, data)
+			if err != nil {
+				return key, err
+			}
+			entries = append(entries, group.Entry[ID, State]{ID: id, State: state})
+			return key, nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if !f(entry.ID, entry.State) {
+				return nil
+			}
+		}
+		if n < s.config.batchSize {
+			return nil
+		}
+		cursor = next
+	}
+}
+
+// Mutator reads the state, runs modifier without holding a transaction or
+// connection, then writes the state back if modifier changed it and its
+// version is unchanged.
+// Concurrent writers from other processes are detected and fail with a
+// genserver.ConflictError rather than being overwritten.
+func (s *Store[ID, State]) Mutator(id ID) genserver.StateMutator[State] {
+	return func(modifier genserver.StateMutatorFn[State]) (func(), error) {
+		key := id.String()
+		defer s.locks.Lock(key)()
+		r, err := s.scanRow(id, s.db.QueryRow(s.sql.load, key))
+		if err != nil {
+			return nil, err
+		}
+		state, err := s.decode(id, r.data)
+		if err != nil {
+			return nil, err
+		}
+		returnValue, err := modifier(&state)
+		if err != nil {
+			return nil, err
+		}
+		data, err := s.codec.Marshal(state)
+		if err != nil {
+			return nil, fmt.Errorf("Could not encode state for ID %s: %w", id, err)
+		}
+		if bytes.Equal(data, r.data) {
+			// nothing to write for handlers that only read
+			return returnValue, nil
+		}
+		version := r.version
+		ttl := s.config.expiry.Touch(r.ttl)
+		result, err := s.db.Exec(s.sql.update, data, version+1, int64(ttl.Duration), ttl.Deadline, key, version)
+		if err != nil {
+			return nil, fmt.Errorf("Could not store state for ID %s: %w", id, err)
+		}
+		updated, err := result.RowsAffected()
+		if err != nil {
+			return nil, fmt.Errorf("Could not store state for ID %s: %w", id, err)
+		}
+		if updated == 0 {
+			return nil, genserver.ConflictError{ID: key, Version: uint64(version)}
+		}
+		return returnValue, nil
+	}
+}
@@ -0,0 +1,147 @@
+package sqlstore_test
+
+import (
+	"context"
+	"database/sql"
+	"sync/atomic"
+	"testing"
+
+	"github.com/hannahhoward/go-genserver/genserver"
+	"github.com/hannahhoward/go-genserver/group"
+	"github.com/hannahhoward/go-genserver/store/expiry"
+	"github.com/hannahhoward/go-genserver/store/sqlstore"
+	"github.com/hannahhoward/go-genserver/store/storetest"
+	"github.com/stretchr/testify/require"
+)
+
+func parseID(s string) (storetest.ID, error) {
+	return storetest.ID(s), nil
+}
+
+func newStore(t *testing.T, db *sql.DB) *sqlstore.Store[storetest.ID, storetest.State] {
+	store, err := sqlstore.NewStore[storetest.ID, storetest.State](context.Background(), db, parseID, sqlstore.WithBatchSize(3))
+	require.NoError(t, err)
+	return store
+}
+
+func TestConformance(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) group.Store[storetest.ID, storetest.State] {
+		db := sql.OpenDB(newFakeDB())
+		t.Cleanup(func() { db.Close() })
+		return newStore(t, db)
+	})
+}
+
+func TestExpiry(t *testing.T) {
+	storetest.RunExpiry(t, func(t *testing.T, config expiry.Config) storetest.ExpiringStore {
+		db := sql.OpenDB(newFakeDB())
+		t.Cleanup(func() { db.Close() })
+		store, err := sqlstore.NewStore[storetest.ID, storetest.State](context.Background(), db, parseID, sqlstore.WithExpiry(config), sqlstore.WithBatchSize(3))
+		require.NoError(t, err)
+		return store
+	})
+}
+
+func TestVersionCheck(t *testing.T) {
+	db := sql.OpenDB(newFakeDB())
+	defer db.Close()
+	// two stores on one database stand in for two processes
+	first, second := newStore(t, db), newStore(t, db)
+	_, err := first.CreateIfNotExist("a", storetest.State{})
+	require.NoError(t, err)
+
+	_, err = first.Mutator("a")(func(s *storetest.State) (func(), error) {
+		_, err := second.Mutator("a")(func(s *storetest.State) (func(), error) {
+			s.Name = "second"
+			return func() {}, nil
+		})
+		require.NoError(t, err)
+		s.Name = "first"
+		return func() {}, nil
+	})
+	require.ErrorIs(t, err, genserver.ErrConflict)
+
+	state, err := first.Load("a")
+	require.NoError(t, err)
+	require.Equal(t, "second", state.Name)
+}
+
+func TestConflictRetries(t *testing.T) {
+	db := sql.OpenDB(newFakeDB())
+	defer db.Close()
+	first := group.New[storetest.ID, storetest.State]("counter", newStore(t, db))
+	second := newStore(t, db)
+	_, err := second.CreateIfNotExist("a", storetest.State{})
+	require.NoError(t, err)
+
+	var attempts int32
+	count, err := group.Call(first, "a", 1, func(s *storetest.State, amount int) (int, error) {
+		if atomic.AddInt32(&attempts, 1) == 1 {
+			// another process changes the state while this handler runs
+			_, err := second.Mutator("a")(func(s *storetest.State) (func(), error) {
+				s.Count += 10
+				return func() {}, nil
+			})
+			require.NoError(t, err)
+		}
+		s.Count += amount
+		return s.Count, nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, 11, count)
+	require.Equal(t, int32(2), atomic.LoadInt32(&attempts))
+	require.NoError(t, first.Stop(context.Background()))
+}
+
+func TestBatchSize(t *testing.T) {
+	db := sql.OpenDB(newFakeDB())
+	defer db.Close()
+	for _, batchSize := range []int{0, -1} {
+		_, err := sqlstore.NewStore[storetest.ID, storetest.State](context.Background(), db, parseID, sqlstore.WithBatchSize(batchSize))
+		require.Error(t, err)
+	}
+}
+
+func TestSingleConnection(t *testing.T) {
+	db := sql.OpenDB(newFakeDB())
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+	store := newStore(t, db)
+	for _, id := range []storetest.ID{"a", "b"} {
+		_, err := store.CreateIfNotExist(id, storetest.State{})
+		require.NoError(t, err)
+	}
+
+	// a handler mutates another state while its own mutation is in progress
+	_, err := store.Mutator("a")(func(s *storetest.State) (func(), error) {
+		_, err := store.Mutator("b")(func(s *storetest.State) (func(), error) {
+			s.Count++
+			return func() {}, nil
+		})
+		s.Count++
+		return func() {}, err
+	})
+	require.NoError(t, err)
+	for _, id := range []storetest.ID{"a", "b"} {
+		state, err := store.Load(id)
+		require.NoError(t, err)
+		require.Equal(t, 1, state.Count)
+	}
+}
+
+func TestUnchanged(t *testing.T) {
+	db := sql.OpenDB(newFakeDB())
+	defer db.Close()
+	store := newStore(t, db)
+	_, err := store.CreateIfNotExist("a", storetest.State{Count: 1})
+	require.NoError(t, err)
+
+	// a handler that only reads writes nothing, so keeps the version
+	_, err = store.Mutator("a")(func(s *storetest.State) (func(), error) {
+		return func() {}, nil
+	})
+	require.NoError(t, err)
+	_, version, err := store.LoadVersion("a")
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), version)
+}
@@ -0,0 +1,217 @@
+package storetest
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hannahhoward/go-genserver/group"
+	"github.com/hannahhoward/go-genserver/store/expiry"
+	"github.com/stretchr/testify/require"
+)
+
+// ExpiringStore is a store whose states expire
+type ExpiringStore interface {
+	group.Store[ID, State]
+	group.Expirer[ID]
+	SetTTL(id ID, ttl time.Duration) error
+	Sweep() error
+	Close() error
+}
+
+// ExpiringFactory returns a new, empty store for a single test, that expires
+// states according to config
+type ExpiringFactory func(t *testing.T, config expiry.Config) ExpiringStore
+
+// clock is a fake clock that only moves when advanced
+type clock struct {
+	now atomic.Int64
+}
+
+func (c *clock) Now() time.Time {
+	return time.Unix(0, c.now.Load())
+}
+
+func (c *clock) Advance(d time.Duration) {
+	c.now.Add(int64(d))
+}
+
+// expired records the identifiers a store reports as expired
+type expired struct {
+	lock sync.Mutex
+	ids  []ID
+}
+
+func (e *expired) add(id ID) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.ids = append(e.ids, id)
+}
+
+func (e *expired) get() []ID {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return append([]ID(nil), e.ids...)
+}
+
+func increment(s *State) (func(), error) {
+	s.Count++
+	return func() {}, nil
+}
+
+// RunExpiry checks that stores made by factory expire states
+func RunExpiry(t *testing.T, factory ExpiringFactory) {
+	testCases := map[string]struct {
+		config expiry.Config
+		test   func(*testing.T, ExpiringStore, *clock, *expired)
+	}{
+		"expires after ttl": {
+			config: expiry.Config{TTL: time.Minute},
+			test: func(t *testing.T, store ExpiringStore, clock *clock, expired *expired) {
+				_, err := store.CreateIfNotExist("a", State{Count: 1})
+				require.NoError(t, err)
+				clock.Advance(59 * time.Second)
+				has, err := store.Has("a")
+				require.NoError(t, err)
+				require.True(t, has)
+
+				clock.Advance(time.Second)
+				has, err = store.Has("a")
+				require.NoError(t, err)
+				require.False(t, has)
+				_, err = store.Load("a")
+				require.ErrorIs(t, err, group.ErrNotFound)
+				_, err = store.Mutator("a")(increment)
+				require.ErrorIs(t, err, group.ErrNotFound)
+				require.NoError(t, store.IDs("", func(id ID) bool {
+					require.FailNow(t, "listed an expired state")
+					return false
+				}))
+
+				require.NoError(t, store.Sweep())
+				require.Equal(t, []ID{"a"}, expired.get())
+				require.NoError(t, store.Sweep())
+				require.Equal(t, []ID{"a"}, expired.get())
+			},
+		},
+		"refresh": {
+			config: expiry.Config{TTL: time.Minute, Refresh: true},
+			test: func(t *testing.T, store ExpiringStore, clock *clock, expired *expired) {
+				_, err := store.CreateIfNotExist("a", State{})
+				require.NoError(t, err)
+				clock.Advance(40 * time.Second)
+				_, err = store.Mutator("a")(increment)
+				require.NoError(t, err)
+				clock.Advance(40 * time.Second)
+				has, err := store.Has("a")
+				require.NoError(t, err)
+				require.True(t, has)
+				clock.Advance(20 * time.Second)
+				has, err = store.Has("a")
+				require.NoError(t, err)
+				require.False(t, has)
+			},
+		},
+		"reads do not refresh": {
+			config: expiry.Config{TTL: time.Minute, Refresh: true},
+			test: func(t *testing.T, store ExpiringStore, clock *clock, expired *expired) {
+				_, err := store.CreateIfNotExist("a", State{Count: 1})
+				require.NoError(t, err)
+				clock.Advance(40 * time.Second)
+				_, err = store.Mutator("a")(func(s *State) (func(), error) {
+					require.Equal(t, 1, s.Count)
+					return func() {}, nil
+				})
+				require.NoError(t, err)
+				clock.Advance(20 * time.Second)
+				has, err := store.Has("a")
+				require.NoError(t, err)
+				require.False(t, has)
+			},
+		},
+		"mutations do not refresh by default": {
+			config: expiry.Config{TTL: time.Minute},
+			test: func(t *testing.T, store ExpiringStore, clock *clock, expired *expired) {
+				_, err := store.CreateIfNotExist("a", State{})
+				require.NoError(t, err)
+				clock.Advance(40 * time.Second)
+				_, err = store.Mutator("a")(increment)
+				require.NoError(t, err)
+				clock.Advance(20 * time.Second)
+				has, err := store.Has("a")
+				require.NoError(t, err)
+				require.False(t, has)
+			},
+		},
+		"per entry ttl": {
+			test: func(t *testing.T, store ExpiringStore, clock *clock, expired *expired) {
+				for _, id := range []ID{"a", "b", "c"} {
+					_, err := store.CreateIfNotExist(id, State{})
+					require.NoError(t, err)
+				}
+				require.ErrorIs(t, store.SetTTL("d", time.Minute), group.ErrNotFound)
+				require.NoError(t, store.SetTTL("a", time.Minute))
+				require.NoError(t, store.SetTTL("b", time.Minute))
+				require.NoError(t, store.SetTTL("b", 0))
+				clock.Advance(time.Hour)
+				require.NoError(t, store.Sweep())
+				require.Equal(t, []ID{"a"}, expired.get())
+				var ids []ID
+				require.NoError(t, store.IDs("", func(id ID) bool {
+					ids = append(ids, id)
+					return true
+				}))
+				require.Equal(t, []ID{"b", "c"}, ids)
+			},
+		},
+		"create replaces expired state": {
+			config: expiry.Config{TTL: time.Minute},
+			test: func(t *testing.T, store ExpiringStore, clock *clock, expired *expired) {
+				_, err := store.CreateIfNotExist("a", State{Count: 1})
+				require.NoError(t, err)
+				clock.Advance(time.Hour)
+				exists, err := store.CreateIfNotExist("a", State{Count: 2})
+				require.NoError(t, err)
+				require.False(t, exists)
+				require.Equal(t, []ID{"a"}, expired.get())
+				state, version, err := store.LoadVersion("a")
+				require.NoError(t, err)
+				require.Equal(t, State{Count: 2}, state)
+				require.Equal(t, uint64(1), version)
+				clock.Advance(59 * time.Second)
+				has, err := store.Has("a")
+				require.NoError(t, err)
+				require.True(t, has)
+			},
+		},
+		"background sweeper": {
+			config: expiry.Config{TTL: time.Minute, SweepInterval: time.Millisecond},
+			test: func(t *testing.T, store ExpiringStore, clock *clock, expired *expired) {
+				_, err := store.CreateIfNotExist("a", State{})
+				require.NoError(t, err)
+				clock.Advance(time.Hour)
+				require.Eventually(t, func() bool {
+					return len(expired.get()) == 1
+				}, 5*time.Second, time.Millisecond)
+			},
+		},
+	}
+	for testCase, data := range testCases {
+		t.Run(testCase, func(t *testing.T) {
+			clock := &clock{}
+			clock.now.Store(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC).UnixNano())
+			config := data.config
+			config.Clock = clock.Now
+			if config.SweepInterval == 0 {
+				// keep the background sweeper out of the way of explicit sweeps
+				config.SweepInterval = time.Hour
+			}
+			store := factory(t, config)
+			defer store.Close()
+			expired := &expired{}
+			store.OnExpire(expired.add)
+			data.test(t, store, clock, expired)
+		})
+	}
+}
@@ -0,0 +1,351 @@
+// Package storetest is a conformance suite for group.Store implementations
+package storetest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/hannahhoward/go-genserver/group"
+	"github.com/hannahhoward/go-genserver/store/watch"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// ID is the identifier type the suite stores states under
+type ID string
+
+func (id ID) String() string {
+	return string(id)
+}
+
+// State is the state type the suite stores. Its fields are exported so
+// persistent stores can encode it.
+type State struct {
+	Count int
+	Name  string
+}
+
+// watcher is a store with a change feed
+type watcher interface {
+	Watch(ctx context.Context, id ID) <-chan watch.Change[ID, State]
+}
+
+// Factory returns a new, empty store for a single test
+type Factory func(t *testing.T) group.Store[ID, State]
+
+// Run runs the conformance suite against stores made by factory
+func Run(t *testing.T, factory Factory) {
+	testCases := map[string]func(*testing.T, group.Store[ID, State]){
+		"create if not exist": func(t *testing.T, store group.Store[ID, State]) {
+			has, err := store.Has("a")
+			require.NoError(t, err)
+			require.False(t, has)
+			exists, err := store.CreateIfNotExist("a", State{Count: 1})
+			require.NoError(t, err)
+			require.False(t, exists)
+			has, err = store.Has("a")
+			require.NoError(t, err)
+			require.True(t, has)
+			exists, err = store.CreateIfNotExist("a", State{Count: 2})
+			require.NoError(t, err)
+			require.True(t, exists)
+			state, err := store.Load("a")
+			require.NoError(t, err)
+			require.Equal(t, State{Count: 1}, state)
+		},
+		"not found": func(t *testing.T, store group.Store[ID, State]) {
+			_, err := store.Load("a")
+			require.ErrorIs(t, err, group.ErrNotFound)
+			_, err = store.Mutator("a")(func(s *State) (func(), error) {
+				require.FailNow(t, "mutated a missing state")
+				return nil, nil
+			})
+			require.ErrorIs(t, err, group.ErrNotFound)
+		},
+		"mutator": func(t *testing.T, store group.Store[ID, State]) {
+			_, err := store.CreateIfNotExist("a", State{Count: 1})
+			require.NoError(t, err)
+			returned := false
+			returnValue, err := store.Mutator("a")(func(s *State) (func(), error) {
+				s.Count++
+				s.Name = "mutated"
+				return func() { returned = true }, nil
+			})
+			require.NoError(t, err)
+			returnValue()
+			require.True(t, returned)
+			state, err := store.Load("a")
+			require.NoError(t, err)
+			require.Equal(t, State{Count: 2, Name: "mutated"}, state)
+		},
+		"failed mutation is discarded": func(t *testing.T, store group.Store[ID, State]) {
+			_, err := store.CreateIfNotExist("a", State{Count: 1})
+			require.NoError(t, err)
+			errFailed := errors.New("failed")
+			_, err = store.Mutator("a")(func(s *State) (func(), error) {
+				s.Count = 100
+				return func() {}, errFailed
+			})
+			require.ErrorIs(t, err, errFailed)
+			state, err := store.Load("a")
+			require.NoError(t, err)
+			require.Equal(t, State{Count: 1}, state)
+		},
+		"versions": func(t *testing.T, store group.Store[ID, State]) {
+			_, err := store.CreateIfNotExist("a", State{Count: 1})
+			require.NoError(t, err)
+			state, version, err := store.LoadVersion("a")
+			require.NoError(t, err)
+			require.Equal(t, State{Count: 1}, state)
+			require.GreaterOrEqual(t, version, uint64(1))
+
+			_, err = store.Mutator("a")(func(s *State) (func(), error) {
+				s.Count++
+				return func() {}, nil
+			})
+			require.NoError(t, err)
+			_, changed, err := store.LoadVersion("a")
+			require.NoError(t, err)
+			require.Greater(t, changed, version)
+
+			_, err = store.Mutator("a")(func(s *State) (func(), error) {
+				s.Count++
+				return func() {}, errors.New("failed")
+			})
+			require.Error(t, err)
+			_, failed, err := store.LoadVersion("a")
+			require.NoError(t, err)
+			require.Equal(t, changed, failed)
+
+			_, _, err = store.LoadVersion("b")
+			require.ErrorIs(t, err, group.ErrNotFound)
+		},
+		"reads leave no trace": func(t *testing.T, store group.Store[ID, State]) {
+			_, err := store.CreateIfNotExist("a", State{Count: 1})
+			require.NoError(t, err)
+			_, version, err := store.LoadVersion("a")
+			require.NoError(t, err)
+			var changes <-chan watch.Change[ID, State]
+			if watcher, ok := store.(watcher); ok {
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+				changes = watcher.Watch(ctx, "a")
+			}
+
+			// a get is a mutation whose handler only reads the state
+			_, err = store.Mutator("a")(func(s *State) (func(), error) {
+				require.Equal(t, 1, s.Count)
+				return func() {}, nil
+			})
+			require.NoError(t, err)
+			state, read, err := store.LoadVersion("a")
+			require.NoError(t, err)
+			require.Equal(t, State{Count: 1}, state)
+			require.Equal(t, version, read)
+
+			_, err = store.Mutator("a")(increment)
+			require.NoError(t, err)
+			if changes != nil {
+				// changes are published in order, so a change published by
+				// the read would arrive first
+				change := <-changes
+				require.Equal(t, State{Count: 2}, change.New)
+			}
+		},
+		"load returns a copy": func(t *testing.T, store group.Store[ID, State]) {
+			_, err := store.CreateIfNotExist("a", State{Count: 1})
+			require.NoError(t, err)
+			state, err := store.Load("a")
+			require.NoError(t, err)
+			state.Count = 100
+			state, err = store.Load("a")
+			require.NoError(t, err)
+			require.Equal(t, State{Count: 1}, state)
+		},
+		"delete": func(t *testing.T, store group.Store[ID, State]) {
+			require.NoError(t, store.Delete("a"))
+			_, err := store.CreateIfNotExist("a", State{Count: 1})
+			require.NoError(t, err)
+			mutator := store.Mutator("a")
+			require.NoError(t, store.Delete("a"))
+			has, err := store.Has("a")
+			require.NoError(t, err)
+			require.False(t, has)
+			_, err = store.Load("a")
+			require.ErrorIs(t, err, group.ErrNotFound)
+			_, err = mutator(func(s *State) (func(), error) {
+				return func() {}, nil
+			})
+			require.ErrorIs(t, err, group.ErrNotFound)
+			exists, err := store.CreateIfNotExist("a", State{Count: 2})
+			require.NoError(t, err)
+			require.False(t, exists)
+		},
+		"ordered enumeration": func(t *testing.T, store group.Store[ID, State]) {
+			for i, id := range []ID{"c", "a", "e", "b", "d"} {
+				_, err := store.CreateIfNotExist(id, State{Count: i, Name: string(id)})
+				require.NoError(t, err)
+			}
+			var ids []ID
+			err := store.IDs("", func(id ID) bool {
+				ids = append(ids, id)
+				return true
+			})
+			require.NoError(t, err)
+			require.Equal(t, []ID{"a", "b", "c", "d", "e"}, ids)
+
+			ids = nil
+			err = store.IDs("b", func(id ID) bool {
+				ids = append(ids, id)
+				return len(ids) < 2
+			})
+			require.NoError(t, err)
+			require.Equal(t, []ID{"c", "d"}, ids)
+
+			ids = nil
+			err = store.Iterate("c", func(id ID, state State) bool {
+				require.Equal(t, string(id), state.Name)
+				ids = append(ids, id)
+				return true
+			})
+			require.NoError(t, err)
+			require.Equal(t, []ID{"d", "e"}, ids)
+		},
+		"concurrent mutations": func(t *testing.T, store group.Store[ID, State]) {
+			const writers, writes = 8, 50
+			_, err := store.CreateIfNotExist("a", State{})
+			require.NoError(t, err)
+			var wg sync.WaitGroup
+			for w := 0; w < writers; w++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					mutator := store.Mutator("a")
+					for i := 0; i < writes; i++ {
+						_, err := mutator(func(s *State) (func(), error) {
+							s.Count++
+							return func() {}, nil
+						})
+						assert.NoError(t, err)
+					}
+				}()
+			}
+			wg.Wait()
+			state, err := store.Load("a")
+			require.NoError(t, err)
+			require.Equal(t, writers*writes, state.Count)
+		},
+		"nested mutations": func(t *testing.T, store group.Store[ID, State]) {
+			// a handler calling another server mutates that server's state
+			// while its own mutation is in progress. Enough identifiers
+			// catch stores whose locks are shared between identifiers.
+			const others = 100
+			_, err := store.CreateIfNotExist("a", State{})
+			require.NoError(t, err)
+			for i := 0; i < others; i++ {
+				_, err := store.CreateIfNotExist(ID(fmt.Sprintf("b%02d", i)), State{})
+				require.NoError(t, err)
+			}
+			_, err = store.Mutator("a")(func(s *State) (func(), error) {
+				for i := 0; i < others; i++ {
+					_, err := store.Mutator(ID(fmt.Sprintf("b%02d", i)))(func(s *State) (func(), error) {
+						s.Count++
+						return func() {}, nil
+					})
+					if err != nil {
+						return nil, err
+					}
+				}
+				s.Count++
+				return func() {}, nil
+			})
+			require.NoError(t, err)
+			for _, id := range []ID{"a", "b00", ID(fmt.Sprintf("b%02d", others-1))} {
+				state, err := store.Load(id)
+				require.NoError(t, err)
+				require.Equal(t, 1, state.Count)
+			}
+		},
+		"list consistency": func(t *testing.T, store group.Store[ID, State]) {
+			const entries = 20
+			for i := 0; i < entries; i++ {
+				id := ID(fmt.Sprintf("%02d", i))
+				_, err := store.CreateIfNotExist(id, State{Name: string(id)})
+				require.NoError(t, err)
+				_, err = store.Mutator(id)(func(s *State) (func(), error) {
+					s.Count = i
+					return func() {}, nil
+				})
+				require.NoError(t, err)
+			}
+			require.NoError(t, store.Delete("05"))
+
+			var ids []ID
+			err := store.IDs("", func(id ID) bool {
+				ids = append(ids, id)
+				return true
+			})
+			require.NoError(t, err)
+			require.Len(t, ids, entries-1)
+			i := 0
+			err = store.Iterate("", func(id ID, state State) bool {
+				require.Equal(t, ids[i], id)
+				require.Equal(t, string(id), state.Name)
+				loaded, err := store.Load(id)
+				require.NoError(t, err)
+				require.Equal(t, loaded, state)
+				require.Equal(t, fmt.Sprintf("%02d", state.Count), state.Name)
+				i++
+				return true
+			})
+			require.NoError(t, err)
+			require.Equal(t, entries-1, i)
+		},
+		"thread safety": func(t *testing.T, store group.Store[ID, State]) {
+			const workers, rounds = 4, 50
+			ids := []ID{"a", "b", "c"}
+			var wg sync.WaitGroup
+			for w := 0; w < workers; w++ {
+				wg.Add(1)
+				go func(w int) {
+					defer wg.Done()
+					for i := 0; i < rounds; i++ {
+						id := ids[(w+i)%len(ids)]
+						_, err := store.CreateIfNotExist(id, State{Name: string(id)})
+						assert.NoError(t, err)
+						_, err = store.Mutator(id)(func(s *State) (func(), error) {
+							s.Count++
+							return func() {}, nil
+						})
+						if err != nil {
+							assert.ErrorIs(t, err, group.ErrNotFound)
+						}
+						state, err := store.Load(id)
+						if err != nil {
+							assert.ErrorIs(t, err, group.ErrNotFound)
+						} else {
+							assert.Equal(t, string(id), state.Name)
+						}
+						err = store.Iterate("", func(id ID, state State) bool {
+							assert.Equal(t, string(id), state.Name)
+							return true
+						})
+						assert.NoError(t, err)
+						if i%10 == w {
+							assert.NoError(t, store.Delete(id))
+						}
+					}
+				}(w)
+			}
+			wg.Wait()
+		},
+	}
+	for testCase, test := range testCases {
+		t.Run(testCase, func(t *testing.T) {
+			test(t, factory(t))
+		})
+	}
+}
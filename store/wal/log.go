@@ -0,0 +1,142 @@
+package wal
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"time"
+
+	"github.com/hannahhoward/go-genserver/store/expiry"
+)
+
+type op byte
+
+const (
+	opPut op = iota + 1
+	opDelete
+)
+
+// A record is framed as crc32(payload) | len(payload) | payload, where the
+// payload is op | uvarint(len(key)) | key | uvarint(version) |
+// uvarint(ttl duration) | uvarint(ttl deadline) | data. The checksum catches
+// records torn by a crash mid-write.
+const headerSize = 8
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+var errTorn = errors.New("torn record")
+
+type record struct {
+	op      op
+	key     string
+	version uint64
+	ttl     expiry.TTL
+	data    []byte
+}
+
+func encodeRecord(r record) []byte {
+	payload := make([]byte, 0, 1+4*binary.MaxVarintLen64+len(r.key)+len(r.data))
+	payload = append(payload, byte(r.op))
+	payload = binary.AppendUvarint(payload, uint64(len(r.key)))
+	payload = append(payload, r.key...)
+	payload = binary.AppendUvarint(payload, r.version)
+	payload = binary.AppendUvarint(payload, uint64(r.ttl.Duration))
+	payload = binary.AppendUvarint(payload, uint64(r.ttl.Deadline))
+	payload = append(payload, r.data...)
+
+	buf := make([]byte, headerSize, headerSize+len(payload))
+	binary.LittleEndian.PutUint32(buf[0:4], crc32.Checksum(payload, crcTable))
+	binary.LittleEndian.PutUint32(buf[4:8], uint32(len(payload)))
+	return append(buf, payload...)
+}
+
+// readRecords calls f for each record in the file at path, and returns the
+// offset just past the last whole record. It returns errTorn if the file ends
+// in a partial, corrupt or undecodable record, including the zeros left where
+// a file grew but its data never reached the disk.
+func readRecords(path string, f func(record)) (int64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	reader := bufio.NewReader(file)
+	var offset int64
+	header := make([]byte, headerSize)
+	for {
+		_, err := io.ReadFull(reader, header)
+		if err == io.EOF {
+			return offset, nil
+		}
+		if err == io.ErrUnexpectedEOF {
+			return offset, errTorn
+		}
+		if err != nil {
+			return offset, err
+		}
+		checksum := binary.LittleEndian.Uint32(header[0:4])
+		length := int64(binary.LittleEndian.Uint32(header[4:8]))
+		// the checksum of an empty payload is zero, so it cannot tell zeros
+		// from a record. Lengths running past the end of the file are torn
+		// too, and checking them first never allocates for a corrupt one.
+		if length == 0 || offset+headerSize+length > info.Size() {
+			return offset, errTorn
+		}
+		payload := make([]byte, length)
+		_, err = io.ReadFull(reader, payload)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return offset, errTorn
+		}
+		if err != nil {
+			return offset, err
+		}
+		if crc32.Checksum(payload, crcTable) != checksum {
+			return offset, errTorn
+		}
+		r, err := decodePayload(payload)
+		if err != nil {
+			return offset, fmt.Errorf("%w: %v", errTorn, err)
+		}
+		f(r)
+		offset += headerSize + length
+	}
+}
+
+func decodePayload(payload []byte) (record, error) {
+	if len(payload) < 1 {
+		return record{}, fmt.Errorf("empty record")
+	}
+	r := record{op: op(payload[0])}
+	keyLen, n := binary.Uvarint(payload[1:])
+	if n <= 0 || uint64(len(payload)-1-n) < keyLen {
+		return record{}, fmt.Errorf("malformed record key")
+	}
+	start := 1 + n
+	r.key = string(payload[start : start+int(keyLen)])
+	rest := payload[start+int(keyLen):]
+	r.version, n = binary.Uvarint(rest)
+	if n <= 0 {
+		return record{}, fmt.Errorf("malformed record version")
+	}
+	rest = rest[n:]
+	duration, n := binary.Uvarint(rest)
+	if n <= 0 {
+		return record{}, fmt.Errorf("malformed record ttl")
+	}
+	rest = rest[n:]
+	deadline, n := binary.Uvarint(rest)
+	if n <= 0 {
+		return record{}, fmt.Errorf("malformed record ttl")
+	}
+	r.ttl = expiry.TTL{Duration: time.Duration(duration), Deadline: int64(deadline)}
+	r.data = rest[n:]
+	return r, nil
+}
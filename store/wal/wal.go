@@ -0,0 +1,688 @@
+// Package wal is a group.Store that keeps states in memory, and makes them
+// durable by appending every change to a segmented write-ahead log that is
+// periodically compacted into a snapshot
+package wal
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	gosync "sync"
+	"time"
+
+	"github.com/hannahhoward/go-genserver/codec"
+	"github.com/hannahhoward/go-genserver/genserver"
+	"github.com/hannahhoward/go-genserver/group"
+	"github.com/hannahhoward/go-genserver/store/expiry"
+	"github.com/hannahhoward/go-genserver/store/index"
+	"github.com/hannahhoward/go-genserver/sync"
+)
+
+// SyncPolicy controls when the log is flushed to stable storage
+type SyncPolicy uint64
+
+const (
+	// SyncAlways fsyncs the log after every appended change
+	SyncAlways SyncPolicy = iota
+	// SyncNever leaves flushing to the operating system, so the latest
+	// changes may be lost on a power loss
+	SyncNever
+)
+
+const (
+	defaultSegmentSize   = 16 << 20
+	defaultSnapshotEvery = 4
+
+	segmentPattern  = "wal-%016d.log"
+	snapshotPattern = "snapshot-%016d.snap"
+	tmpGlob         = ".tmp-*"
+)
+
+type storeConfig struct {
+	codec         any
+	sync          SyncPolicy
+	segmentSize   int64
+	snapshotEvery int
+	expiry        expiry.Config
+}
+
+type Option func(*storeConfig)
+
+// WithCodec sets how states are encoded in the log. The default is
+// versioned JSON.
+func WithCodec[State any](c codec.Codec[State]) Option {
+	return func(config *storeConfig) {
+		config.codec = c
+	}
+}
+
+// WithSync sets when the log is flushed to disk. The default is SyncAlways.
+func WithSync(policy SyncPolicy) Option {
+	return func(config *storeConfig) {
+		config.sync = policy
+	}
+}
+
+// WithExpiry sets how states expire. By default they never do. Deadlines are
+// kept in the log, so they survive reopening the store.
+func WithExpiry(config expiry.Config) Option {
+	return func(storeConfig *storeConfig) {
+		storeConfig.expiry = config
+	}
+}
+
+// WithSegmentSize sets the size at which the log moves on to a new segment
+func WithSegmentSize(size int64) Option {
+	return func(config *storeConfig) {
+		config.segmentSize = size
+	}
+}
+
+// WithSnapshotEvery takes a snapshot, and removes the segments it covers,
+// after every n new segments. Zero disables automatic snapshots.
+func WithSnapshotEvery(n int) Option {
+	return func(config *storeConfig) {
+		config.snapshotEvery = n
+	}
+}
+
+type entry[ID fmt.Stringer] struct {
+	id      ID
+	version uint64
+	ttl     expiry.TTL
+	data    []byte
+}
+
+// Store keeps encoded states in memory, and appends every change to the log
+// before it is visible
+type Store[ID fmt.Stringer, State any] struct {
+	dir     string
+	parseID func(string) (ID, error)
+	codec   codec.Codec[State]
+	config  storeConfig
+	// locks serializes changes to each ID.String(), including mutations
+	// while their handler runs
+	locks sync.KeyedMutex[string]
+
+	snapshotLock gosync.Mutex
+
+	lock        gosync.Mutex
+	entries     map[string]entry[ID]
+	keys        index.Keys[ID]
+	segment     *os.File
+	segmentSeq  uint64
+	segmentSize int64
+	rotations   int
+	closed      bool
+	// broken is set when the log may no longer match the entries, after
+	// which appends fail until the store is reopened and recovers from disk
+	broken error
+
+	sweeper   *expiry.Sweeper
+	listeners expiry.Listeners[ID]
+}
+
+var _ group.Store[fmt.Stringer, any] = (*Store[fmt.Stringer, any])(nil)
+
+var _ group.Expirer[fmt.Stringer] = (*Store[fmt.Stringer, any])(nil)
+
+// Open opens the store in dir, recovering its states from the latest
+// snapshot and the log written after it. parseID turns the result of
+// ID.String() back into an ID.
+func Open[ID fmt.Stringer, State any](dir string, parseID func(string) (ID, error), options ...Option) (*Store[ID, State], error) {
+	config := storeConfig{
+		sync:          SyncAlways,
+		segmentSize:   defaultSegmentSize,
+		snapshotEvery: defaultSnapshotEvery,
+	}
+	for _, option := range options {
+		option(&config)
+	}
+	stateCodec, err := codec.For[State](config.codec)
+	if err != nil {
+		return nil, err
+	}
+	err = os.MkdirAll(dir, 0o755)
+	if err != nil {
+		return nil, fmt.Errorf("creating store directory: %w", err)
+	}
+	s := &Store[ID, State]{
+		dir:     dir,
+		parseID: parseID,
+		codec:   stateCodec,
+		config:  config,
+		entries: make(map[string]entry[ID]),
+	}
+	err = s.recover()
+	if err != nil {
+		return nil, fmt.Errorf("recovering %s: %w", dir, err)
+	}
+	s.sweeper = expiry.NewSweeper(config.expiry.SweepInterval, func() { s.Sweep() })
+	if config.expiry.TTL > 0 {
+		s.sweeper.Start()
+	}
+	return s, nil
+}
+
+// sequences lists the sequence numbers of files matching pattern, in order
+func (s *Store[ID, State]) sequences(pattern string) ([]uint64, error) {
+	glob := strings.Replace(pattern, "%016d", "*", 1)
+	paths, err := filepath.Glob(filepath.Join(s.dir, glob))
+	if err != nil {
+		return nil, err
+	}
+	var seqs []uint64
+	for _, path := range paths {
+		var seq uint64
+		_, err := fmt.Sscanf(filepath.Base(path), pattern, &seq)
+		if err == nil {
+			seqs = append(seqs, seq)
+		}
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+	return seqs, nil
+}
+
+func (s *Store[ID, State]) apply(r record) error {
+	switch r.op {
+	case opPut:
+		id, err := s.parseID(r.key)
+		if err != nil {
+			return fmt.Errorf("parsing ID %q: %w", r.key, err)
+		}
+		s.entries[r.key] = entry[ID]{id, r.version, r.ttl, r.data}
+		s.keys.Add(id)
+	case opDelete:
+		delete(s.entries, r.key)
+		s.keys.Remove(r.key)
+	default:
+		return fmt.Errorf("unknown record op %d", r.op)
+	}
+	return nil
+}
+
+func (s *Store[ID, State]) recover() error {
+	leftovers, err := filepath.Glob(filepath.Join(s.dir, tmpGlob))
+	if err != nil {
+		return err
+	}
+	for _, leftover := range leftovers {
+		os.Remove(leftover)
+	}
+
+	snapshots, err := s.sequences(snapshotPattern)
+	if err != nil {
+		return err
+	}
+	var base uint64
+	var applyErr error
+	applyRecord := func(r record) {
+		if applyErr == nil {
+			applyErr = s.apply(r)
+		}
+	}
+	if len(snapshots) > 0 {
+		// snapshots are renamed into place once complete, so any torn record
+		// means real corruption
+		base = snapshots[len(snapshots)-1]
+		_, err := readRecords(filepath.Join(s.dir, fmt.Sprintf(snapshotPattern, base)), applyRecord)
+		if err != nil {
+			return fmt.Errorf("reading snapshot %d: %w", base, err)
+		}
+		if applyErr != nil {
+			return applyErr
+		}
+	}
+
+	segments, err := s.sequences(segmentPattern)
+	if err != nil {
+		return err
+	}
+	s.segmentSeq = base
+	for i, seq := range segments {
+		path := filepath.Join(s.dir, fmt.Sprintf(segmentPattern, seq))
+		if seq < base {
+			// already covered by the snapshot, left behind by a crash before compaction
+			os.Remove(path)
+			continue
+		}
+		offset, err := readRecords(path, applyRecord)
+		if applyErr != nil {
+			return applyErr
+		}
+		last := i == len(segments)-1
+		if errors.Is(err, errTorn) && last {
+			// the crash interrupted the final append, which was never acknowledged
+			err = os.Truncate(path, offset)
+		}
+		if err != nil {
+			return fmt.Errorf("reading segment %d: %w", seq, err)
+		}
+		s.segmentSeq = seq
+	}
+	return s.openSegment()
+}
+
+func (s *Store[ID, State]) openSegment() error {
+	path := filepath.Join(s.dir, fmt.Sprintf(segmentPattern, s.segmentSeq))
+	segment, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := segment.Stat()
+	if err != nil {
+		segment.Close()
+		return err
+	}
+	s.segment = segment
+	s.segmentSize = info.Size()
+	return s.syncDir()
+}
+
+func (s *Store[ID, State]) syncDir() error {
+	if s.config.sync != SyncAlways {
+		return nil
+	}
+	dir, err := os.Open(s.dir)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+// rotateLocked moves the log on to a new, empty segment
+func (s *Store[ID, State]) rotateLocked() error {
+	err := s.segment.Close()
+	if err != nil {
+		return err
+	}
+	s.segmentSeq++
+	s.rotations++
+	return s.openSegment()
+}
+
+// appendLocked writes a record to the log, and applies it once it is
+// durable. It reports whether a snapshot is due.
+func (s *Store[ID, State]) appendLocked(id ID, r record) (bool, error) {
+	err := s.writableLocked()
+	if err != nil {
+		return false, err
+	}
+	n, err := s.segment.Write(encodeRecord(r))
+	if err != nil {
+		// cut off what was written of the record, or recovery would stop at
+		// it and drop every record appended after it
+		if truncateErr := s.segment.Truncate(s.segmentSize); truncateErr != nil {
+			s.broken = fmt.Errorf("truncating a partly written record: %w", truncateErr)
+		}
+		return false, fmt.Errorf("appending to log: %w", err)
+	}
+	s.segmentSize += int64(n)
+	if s.config.sync == SyncAlways {
+		err = s.segment.Sync()
+		if err != nil {
+			// the record, and earlier writes the kernel failed to flush, may
+			// or may not be on disk, so only recovering from it is safe
+			s.broken = fmt.Errorf("syncing log: %w", err)
+			return false, fmt.Errorf("appending to log: %w", err)
+		}
+	}
+	switch r.op {
+	case opPut:
+		s.entries[r.key] = entry[ID]{id, r.version, r.ttl, r.data}
+		s.keys.Add(id)
+	case opDelete:
+		delete(s.entries, r.key)
+		s.keys.Remove(r.key)
+	}
+	if s.segmentSize < s.config.segmentSize {
+		return false, nil
+	}
+	err = s.rotateLocked()
+	if err != nil {
+		return false, fmt.Errorf("rotating log: %w", err)
+	}
+	return s.config.snapshotEvery > 0 && s.rotations%s.config.snapshotEvery == 0, nil
+}
+
+// writableLocked returns why the log cannot be appended to, if it cannot
+func (s *Store[ID, State]) writableLocked() error {
+	if s.closed {
+		return errors.New("store is closed")
+	}
+	if s.broken != nil {
+		return fmt.Errorf("store must be reopened: %w", s.broken)
+	}
+	return nil
+}
+
+func (s *Store[ID, State]) append(id ID, r record) error {
+	s.lock.Lock()
+	snapshotDue, err := s.appendLocked(id, r)
+	s.lock.Unlock()
+	if err != nil {
+		return err
+	}
+	if snapshotDue {
+		return s.Snapshot()
+	}
+	return nil
+}
+
+// Snapshot writes every state to a snapshot file, then removes the log
+// segments and snapshots it replaces
+func (s *Store[ID, State]) Snapshot() error {
+	s.snapshotLock.Lock()
+	defer s.snapshotLock.Unlock()
+
+	s.lock.Lock()
+	if err := s.writableLocked(); err != nil {
+		s.lock.Unlock()
+		return err
+	}
+	if s.segmentSize > 0 {
+		err := s.rotateLocked()
+		if err != nil {
+			s.lock.Unlock()
+			return fmt.Errorf("rotating log: %w", err)
+		}
+	}
+	// the snapshot covers exactly the segments before the current one
+	seq := s.segmentSeq
+	entries := make([]record, 0, len(s.entries))
+	for key, e := range s.entries {
+		entries = append(entries, record{opPut, key, e.version, e.ttl, e.data})
+	}
+	s.lock.Unlock()
+
+	tmp, err := os.CreateTemp(s.dir, tmpGlob)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	for _, r := range entries {
+		_, err = tmp.Write(encodeRecord(r))
+		if err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("writing snapshot: %w", err)
+	}
+	err = os.Rename(tmp.Name(), filepath.Join(s.dir, fmt.Sprintf(snapshotPattern, seq)))
+	if err != nil {
+		return fmt.Errorf("writing snapshot: %w", err)
+	}
+	err = s.syncDir()
+	if err != nil {
+		return err
+	}
+	return s.compact(seq)
+}
+
+// compact removes segments and snapshots that the snapshot at seq replaces
+func (s *Store[ID, State]) compact(seq uint64) error {
+	for _, pattern := range []string{segmentPattern, snapshotPattern} {
+		seqs, err := s.sequences(pattern)
+		if err != nil {
+			return err
+		}
+		for _, old := range seqs {
+			if old >= seq {
+				break
+			}
+			err := os.Remove(filepath.Join(s.dir, fmt.Sprintf(pattern, old)))
+			if err != nil {
+				return fmt.Errorf("compacting log: %w", err)
+			}
+		}
+	}
+	return nil
+}
+
+// Close stops sweeping expired states and closes the log. The store cannot
+// be used afterwards.
+func (s *Store[ID, State]) Close() error {
+	s.sweeper.Stop()
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	return s.segment.Close()
+}
+
+// load returns the live entry for key. Entries that expired but were not
+// swept yet are reported as missing.
+func (s *Store[ID, State]) load(key string) (entry[ID], bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	e, ok := s.entries[key]
+	return e, ok && !s.config.expiry.Expired(e.ttl)
+}
+
+func (s *Store[ID, State]) decode(id ID, data []byte) (State, error) {
+	var state State
+	err := s.codec.Unmarshal(data, &state)
+	if err != nil {
+		return state, fmt.Errorf("Could not decode state for ID %s: %w", id, err)
+	}
+	return state, nil
+}
+
+func (s *Store[ID, State]) Has(id ID) (bool, error) {
+	_, ok := s.load(id.String())
+	return ok, nil
+}
+
+func (s *Store[ID, State]) Load(id ID) (State, error) {
+	state, _, err := s.LoadVersion(id)
+	return state, err
+}
+
+// LoadVersion writes back states stored in an older format, once they have
+// been migrated by the codec
+func (s *Store[ID, State]) LoadVersion(id ID) (State, uint64, error) {
+	e, ok := s.load(id.String())
+	if !ok {
+		var state State
+		return state, 0, fmt.Errorf("Could not load state for ID %s: %w", id, group.ErrNotFound)
+	}
+	state, err := s.decode(id, e.data)
+	if err == nil && codec.Outdated(s.codec, e.data) {
+		s.upgrade(id, state, e.version)
+	}
+	return state, e.version, err
+}
+
+// upgrade appends a state that was stored in an older format, at the same
+// version, unless it changed since. It is best effort: a failure leaves the
+// old record in place, to be upgraded by the next load or mutation. It skips
+// states being mutated, whose handler may be the one loading the state.
+func (s *Store[ID, State]) upgrade(id ID, state State, version uint64) {
+	key := id.String()
+	unlock, ok := s.locks.TryLock(key)
+	if !ok {
+		return
+	}
+	defer unlock()
+	e, ok := s.load(key)
+	if !ok || e.version != version || !codec.Outdated(s.codec, e.data) {
+		return
+	}
+	data, err := s.codec.Marshal(state)
+	if err != nil {
+		return
+	}
+	s.append(id, record{opPut, key, version, e.ttl, data})
+}
+
+func (s *Store[ID, State]) CreateIfNotExist(id ID, state State) (bool, error) {
+	exists, expired, err := s.create(id, state)
+	if expired {
+		s.listeners.Expired(id)
+	}
+	return exists, err
+}
+
+// create appends state for id unless there is a live state already. It
+// reports whether it replaced a state that had expired.
+func (s *Store[ID, State]) create(id ID, state State) (bool, bool, error) {
+	key := id.String()
+	defer s.locks.Lock(key)()
+	if _, ok := s.load(key); ok {
+		return true, false, nil
+	}
+	expired := s.stored(key)
+	data, err := s.codec.Marshal(state)
+	if err != nil {
+		return false, false, fmt.Errorf("Could not encode state for ID %s: %w", id, err)
+	}
+	return false, expired, s.append(id, record{opPut, key, 1, s.config.expiry.Start(), data})
+}
+
+// stored reports whether there is an entry for key, live or expired
+func (s *Store[ID, State]) stored(key string) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	_, ok := s.entries[key]
+	return ok
+}
+
+func (s *Store[ID, State]) Delete(id ID) error {
+	key := id.String()
+	defer s.locks.Lock(key)()
+	if !s.stored(key) {
+		return nil
+	}
+	return s.append(id, record{op: opDelete, key: key})
+}
+
+// SetTTL sets how long the state for id lives from now, replacing the TTL it
+// was created with. A zero ttl means it never expires.
+func (s *Store[ID, State]) SetTTL(id ID, ttl time.Duration) error {
+	key := id.String()
+	defer s.locks.Lock(key)()
+	e, ok := s.load(key)
+	if !ok {
+		return fmt.Errorf("Could not load state for ID %s: %w", id, group.ErrNotFound)
+	}
+	err := s.append(id, record{opPut, key, e.version, s.config.expiry.After(ttl), e.data})
+	if err != nil {
+		return err
+	}
+	if ttl > 0 {
+		s.sweeper.Start()
+	}
+	return nil
+}
+
+// OnExpire registers f to be called for each state the store expires
+func (s *Store[ID, State]) OnExpire(f func(id ID)) {
+	s.listeners.Add(f)
+}
+
+// Sweep deletes every expired state, appending a delete to the log for each.
+// It runs in the background once a TTL is configured or set, and may also be
+// called directly.
+func (s *Store[ID, State]) Sweep() error {
+	s.lock.Lock()
+	var candidates []entry[ID]
+	for _, e := range s.entries {
+		if s.config.expiry.Expired(e.ttl) {
+			candidates = append(candidates, e)
+		}
+	}
+	s.lock.Unlock()
+	var expired []ID
+	var err error
+	for _, e := range candidates {
+		err = s.expire(e.id)
+		if err != nil {
+			break
+		}
+		expired = append(expired, e.id)
+	}
+	for _, id := range expired {
+		s.listeners.Expired(id)
+	}
+	return err
+}
+
+// expire deletes the state for id if it is still expired
+func (s *Store[ID, State]) expire(id ID) error {
+	key := id.String()
+	defer s.locks.Lock(key)()
+	if _, ok := s.load(key); ok || !s.stored(key) {
+		return nil
+	}
+	return s.append(id, record{op: opDelete, key: key})
+}
+
+func (s *Store[ID, State]) IDs(cursor string, f func(id ID) bool) error {
+	s.keys.Each(&s.lock, cursor, func(id ID) bool {
+		_, ok := s.load(id.String())
+		return !ok || f(id)
+	})
+	return nil
+}
+
+func (s *Store[ID, State]) Iterate(cursor string, f func(id ID, state State) bool) error {
+	var err error
+	s.keys.Each(&s.lock, cursor, func(id ID) bool {
+		e, ok := s.load(id.String())
+		if !ok {
+			return true
+		}
+		var state State
+		state, err = s.decode(e.id, e.data)
+		return err == nil && f(e.id, state)
+	})
+	return err
+}
+
+// Mutator appends the new state to the log only when modifier succeeds and
+// changes it
+func (s *Store[ID, State]) Mutator(id ID) genserver.StateMutator[State] {
+	return func(modifier genserver.StateMutatorFn[State]) (func(), error) {
+		key := id.String()
+		defer s.locks.Lock(key)()
+		e, ok := s.load(key)
+		if !ok {
+			return nil, fmt.Errorf("Could not load state for ID %s: %w", id, group.ErrNotFound)
+		}
+		state, err := s.decode(id, e.data)
+		if err != nil {
+			return nil, err
+		}
+		returnValue, err := modifier(&state)
+		if err != nil {
+			return nil, err
+		}
+		data, err := s.codec.Marshal(state)
+		if err != nil {
+			return nil, fmt.Errorf("Could not encode state for ID %s: %w", id, err)
+		}
+		if bytes.Equal(data, e.data) {
+			// nothing to log for handlers that only read
+			return returnValue, nil
+		}
+		err = s.append(id, record{opPut, key, e.version + 1, s.config.expiry.Touch(e.ttl), data})
+		if err != nil {
+			return nil, err
+		}
+		return returnValue, nil
+	}
+}
@@ -0,0 +1,159 @@
+package wal_test
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hannahhoward/go-genserver/codec"
+	"github.com/hannahhoward/go-genserver/group"
+	"github.com/hannahhoward/go-genserver/store/expiry"
+	"github.com/hannahhoward/go-genserver/store/storetest"
+	"github.com/hannahhoward/go-genserver/store/wal"
+	"github.com/stretchr/testify/require"
+)
+
+func parseID(s string) (storetest.ID, error) {
+	return storetest.ID(s), nil
+}
+
+func TestConformance(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) group.Store[storetest.ID, storetest.State] {
+		store, err := wal.Open[storetest.ID, storetest.State](t.TempDir(), parseID,
+			wal.WithCodec(codec.Versioned(1, codec.Gob[storetest.State]())), wal.WithSync(wal.SyncNever), wal.WithSegmentSize(512), wal.WithSnapshotEvery(2))
+		require.NoError(t, err)
+		t.Cleanup(func() { store.Close() })
+		return store
+	})
+}
+
+func TestExpiry(t *testing.T) {
+	storetest.RunExpiry(t, func(t *testing.T, config expiry.Config) storetest.ExpiringStore {
+		store, err := wal.Open[storetest.ID, storetest.State](t.TempDir(), parseID, wal.WithExpiry(config), wal.WithSync(wal.SyncNever))
+		require.NoError(t, err)
+		return store
+	})
+}
+
+func increment(t *testing.T, store *wal.Store[storetest.ID, storetest.State], id storetest.ID) {
+	_, err := store.Mutator(id)(func(s *storetest.State) (func(), error) {
+		s.Count++
+		return func() {}, nil
+	})
+	require.NoError(t, err)
+}
+
+func segments(t *testing.T, dir string) []string {
+	paths, err := filepath.Glob(filepath.Join(dir, "wal-*.log"))
+	require.NoError(t, err)
+	return paths
+}
+
+func TestRecovery(t *testing.T) {
+	dir := t.TempDir()
+	store, err := wal.Open[storetest.ID, storetest.State](dir, parseID, wal.WithSegmentSize(256), wal.WithSnapshotEvery(3))
+	require.NoError(t, err)
+	for i := 0; i < 10; i++ {
+		_, err := store.CreateIfNotExist(storetest.ID(fmt.Sprint(i)), storetest.State{Name: fmt.Sprint(i)})
+		require.NoError(t, err)
+	}
+	for round := 0; round < 20; round++ {
+		for i := 0; i < 10; i++ {
+			increment(t, store, storetest.ID(fmt.Sprint(i)))
+		}
+	}
+	require.NoError(t, store.Delete("9"))
+
+	// compaction keeps only the segments written since the last snapshot
+	require.LessOrEqual(t, len(segments(t, dir)), 3)
+	snapshots, err := filepath.Glob(filepath.Join(dir, "snapshot-*.snap"))
+	require.NoError(t, err)
+	require.Len(t, snapshots, 1)
+	require.NoError(t, store.Close())
+
+	store, err = wal.Open[storetest.ID, storetest.State](dir, parseID, wal.WithSegmentSize(256), wal.WithSnapshotEvery(3))
+	require.NoError(t, err)
+	count := 0
+	err = store.Iterate("", func(id storetest.ID, state storetest.State) bool {
+		require.Equal(t, storetest.State{Count: 20, Name: string(id)}, state)
+		count++
+		return true
+	})
+	require.NoError(t, err)
+	require.Equal(t, 9, count)
+	require.NoError(t, store.Snapshot())
+	require.NoError(t, store.Close())
+}
+
+func TestTornWrite(t *testing.T) {
+	// tails a crash can leave after the last whole record
+	tails := map[string][]byte{
+		"partial record": {0xde, 0xad, 0xbe, 0xef, 0x40, 0, 0, 0, 1, 1},
+		// the file grew, but its data never reached the disk
+		"zero filled":      make([]byte, 16),
+		"oversized length": {0xde, 0xad, 0xbe, 0xef, 0xff, 0xff, 0xff, 0xff, 1, 1},
+	}
+	for name, tail := range tails {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			store, err := wal.Open[storetest.ID, storetest.State](dir, parseID)
+			require.NoError(t, err)
+			_, err = store.CreateIfNotExist("a", storetest.State{Count: 1})
+			require.NoError(t, err)
+			increment(t, store, "a")
+			require.NoError(t, store.Close())
+
+			paths := segments(t, dir)
+			last := paths[len(paths)-1]
+			info, err := os.Stat(last)
+			require.NoError(t, err)
+			f, err := os.OpenFile(last, os.O_WRONLY|os.O_APPEND, 0)
+			require.NoError(t, err)
+			_, err = f.Write(tail)
+			require.NoError(t, err)
+			require.NoError(t, f.Close())
+
+			store, err = wal.Open[storetest.ID, storetest.State](dir, parseID)
+			require.NoError(t, err)
+			state, err := store.Load("a")
+			require.NoError(t, err)
+			require.Equal(t, storetest.State{Count: 2}, state)
+			truncated, err := os.Stat(last)
+			require.NoError(t, err)
+			require.Equal(t, info.Size(), truncated.Size())
+
+			increment(t, store, "a")
+			require.NoError(t, store.Close())
+			store, err = wal.Open[storetest.ID, storetest.State](dir, parseID)
+			require.NoError(t, err)
+			state, err = store.Load("a")
+			require.NoError(t, err)
+			require.Equal(t, storetest.State{Count: 3}, state)
+			require.NoError(t, store.Close())
+		})
+	}
+}
+
+func TestUnchanged(t *testing.T) {
+	dir := t.TempDir()
+	store, err := wal.Open[storetest.ID, storetest.State](dir, parseID)
+	require.NoError(t, err)
+	defer store.Close()
+	_, err = store.CreateIfNotExist("a", storetest.State{Count: 1})
+	require.NoError(t, err)
+	before, err := os.Stat(segments(t, dir)[0])
+	require.NoError(t, err)
+
+	// a handler that only reads logs nothing
+	_, err = store.Mutator("a")(func(s *storetest.State) (func(), error) {
+		return func() {}, nil
+	})
+	require.NoError(t, err)
+	_, version, err := store.LoadVersion("a")
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), version)
+	after, err := os.Stat(segments(t, dir)[0])
+	require.NoError(t, err)
+	require.Equal(t, before.Size(), after.Size())
+}
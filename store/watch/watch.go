@@ -0,0 +1,173 @@
+// Package watch delivers the changes a store makes to its states to
+// watchers, for stores that offer a change feed
+package watch
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// Change is a single successful mutation of a state
+type Change[ID fmt.Stringer, State any] struct {
+	ID ID
+	// Old is the state before the mutation, and New the state after it. Like
+	// states returned by stores, they share any maps, slices or pointers.
+	Old     State
+	New     State
+	Version uint64
+}
+
+// Policy decides what happens when a watcher's buffer is full
+type Policy uint64
+
+const (
+	// Disconnect closes the channel of a watcher that falls behind, so it
+	// knows it missed changes and can watch again after catching up. The
+	// store never waits for watchers.
+	Disconnect Policy = iota
+	// Drop skips changes for a watcher whose buffer is full. The store never
+	// waits for watchers, and watchers cannot tell they missed changes.
+	Drop
+	// Block makes mutations wait until every watcher has room, or stops
+	// watching. A slow watcher slows every mutation it watches.
+	Block
+)
+
+// DefaultBuffer is how many changes a watcher can fall behind by, unless
+// configured otherwise
+const DefaultBuffer = 64
+
+// Config controls how changes are delivered to watchers
+type Config struct {
+	// Buffer is how many undelivered changes each watcher holds. The default
+	// is DefaultBuffer.
+	Buffer int
+	// Policy applies when a watcher's buffer is full. The default is
+	// Disconnect.
+	Policy Policy
+}
+
+type watcher[ID fmt.Stringer, State any] struct {
+	// key is the watched ID.String(), or empty when watching all states
+	key  string
+	all  bool
+	ctx  context.Context
+	lock sync.Mutex
+	// changes is closed, holding lock, once the watcher is removed
+	changes chan Change[ID, State]
+	closed  bool
+}
+
+func (w *watcher[ID, State]) close() {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if !w.closed {
+		w.closed = true
+		close(w.changes)
+	}
+}
+
+// Hub keeps track of watchers, and publishes changes to them
+type Hub[ID fmt.Stringer, State any] struct {
+	config   Config
+	lock     sync.RWMutex
+	watchers map[*watcher[ID, State]]struct{}
+}
+
+// NewHub returns a hub without watchers
+func NewHub[ID fmt.Stringer, State any](config Config) *Hub[ID, State] {
+	if config.Buffer <= 0 {
+		config.Buffer = DefaultBuffer
+	}
+	return &Hub[ID, State]{
+		config:   config,
+		watchers: make(map[*watcher[ID, State]]struct{}),
+	}
+}
+
+// Watch returns a channel receiving each change to the state for id, until
+// ctx is done and the channel is closed
+func (h *Hub[ID, State]) Watch(ctx context.Context, id ID) <-chan Change[ID, State] {
+	return h.add(ctx, &watcher[ID, State]{key: id.String()})
+}
+
+// WatchAll returns a channel receiving each change to every state, until ctx
+// is done and the channel is closed. Changes to one state arrive in order,
+// but may interleave with changes to others.
+func (h *Hub[ID, State]) WatchAll(ctx context.Context) <-chan Change[ID, State] {
+	return h.add(ctx, &watcher[ID, State]{all: true})
+}
+
+func (h *Hub[ID, State]) add(ctx context.Context, w *watcher[ID, State]) <-chan Change[ID, State] {
+	w.ctx = ctx
+	w.changes = make(chan Change[ID, State], h.config.Buffer)
+	h.lock.Lock()
+	h.watchers[w] = struct{}{}
+	h.lock.Unlock()
+	go func() {
+		<-ctx.Done()
+		h.remove(w)
+	}()
+	return w.changes
+}
+
+func (h *Hub[ID, State]) remove(w *watcher[ID, State]) {
+	h.lock.Lock()
+	delete(h.watchers, w)
+	h.lock.Unlock()
+	w.close()
+}
+
+// Watching reports whether anyone is watching, so stores can skip building
+// changes nobody receives
+func (h *Hub[ID, State]) Watching() bool {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	return len(h.watchers) > 0
+}
+
+// Publish delivers change to everyone watching its state. Stores call it
+// after the mutation is kept, and before the next mutation of the same state
+// starts, so each watcher sees a state's changes in order.
+func (h *Hub[ID, State]) Publish(change Change[ID, State]) {
+	key := change.ID.String()
+	h.lock.RLock()
+	var watchers []*watcher[ID, State]
+	for w := range h.watchers {
+		if w.all || w.key == key {
+			watchers = append(watchers, w)
+		}
+	}
+	h.lock.RUnlock()
+	for _, w := range watchers {
+		if !h.deliver(w, change) {
+			h.remove(w)
+		}
+	}
+}
+
+// deliver sends change to w according to the policy, and reports false if w
+// should be disconnected
+func (h *Hub[ID, State]) deliver(w *watcher[ID, State], change Change[ID, State]) bool {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.closed {
+		return true
+	}
+	switch h.config.Policy {
+	case Block:
+		select {
+		case w.changes <- change:
+		case <-w.ctx.Done():
+		}
+		return true
+	default:
+		select {
+		case w.changes <- change:
+			return true
+		default:
+			return h.config.Policy == Drop
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package watch_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/hannahhoward/go-genserver/store/watch"
+	"github.com/stretchr/testify/require"
+)
+
+type ID string
+
+func (id ID) String() string {
+	return string(id)
+}
+
+func change(id ID, n int) watch.Change[ID, int] {
+	return watch.Change[ID, int]{ID: id, Old: n - 1, New: n, Version: uint64(n)}
+}
+
+func TestPolicies(t *testing.T) {
+	testCases := map[string]struct {
+		policy   watch.Policy
+		received []int
+		closed   bool
+	}{
+		"disconnect": {policy: watch.Disconnect, received: []int{1, 2}, closed: true},
+		"drop":       {policy: watch.Drop, received: []int{1, 2}},
+		"block":      {policy: watch.Block, received: []int{1, 2, 3, 4}},
+	}
+	for testCase, data := range testCases {
+		t.Run(testCase, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			hub := watch.NewHub[ID, int](watch.Config{Buffer: 2, Policy: data.policy})
+			changes := hub.Watch(ctx, "a")
+			published := make(chan struct{})
+			go func() {
+				defer close(published)
+				for n := 1; n <= 4; n++ {
+					hub.Publish(change("a", n))
+				}
+			}()
+			if data.policy != watch.Block {
+				<-published
+			}
+
+			var received []int
+			for len(received) < len(data.received) {
+				received = append(received, (<-changes).New)
+			}
+			require.Equal(t, data.received, received)
+			<-published
+			select {
+			case _, ok := <-changes:
+				require.Equal(t, data.closed, !ok)
+			case <-time.After(10 * time.Millisecond):
+				require.False(t, data.closed)
+			}
+		})
+	}
+}
+
+func TestWatchScope(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	hub := watch.NewHub[ID, int](watch.Config{})
+	require.False(t, hub.Watching())
+	a := hub.Watch(ctx, "a")
+	all := hub.WatchAll(ctx)
+	require.True(t, hub.Watching())
+
+	hub.Publish(change("a", 1))
+	hub.Publish(change("b", 1))
+	require.Equal(t, change("a", 1), <-a)
+	require.Equal(t, change("a", 1), <-all)
+	require.Equal(t, change("b", 1), <-all)
+
+	cancel()
+	_, ok := <-a
+	require.False(t, ok)
+	_, ok = <-all
+	require.False(t, ok)
+	require.Eventually(t, func() bool { return !hub.Watching() }, time.Second, time.Millisecond)
+}
@@ -0,0 +1,64 @@
+package sync
+
+import "sync"
+
+// KeyedMutex is a mutex per key. Mutexes only exist while they are held or
+// waited for, so any number of keys can be locked over time. The zero value
+// is ready to use.
+type KeyedMutex[K comparable] struct {
+	lock  sync.Mutex
+	locks map[K]*keyedLock
+}
+
+type keyedLock struct {
+	sync.Mutex
+	refs int
+}
+
+func (km *KeyedMutex[K]) acquire(key K) *keyedLock {
+	km.lock.Lock()
+	defer km.lock.Unlock()
+	if km.locks == nil {
+		km.locks = make(map[K]*keyedLock)
+	}
+	l, ok := km.locks[key]
+	if !ok {
+		l = &keyedLock{}
+		km.locks[key] = l
+	}
+	l.refs++
+	return l
+}
+
+func (km *KeyedMutex[K]) release(key K, l *keyedLock) {
+	km.lock.Lock()
+	defer km.lock.Unlock()
+	l.refs--
+	if l.refs == 0 {
+		delete(km.locks, key)
+	}
+}
+
+// Lock locks the mutex for key, and returns a function that unlocks it
+func (km *KeyedMutex[K]) Lock(key K) (unlock func()) {
+	l := km.acquire(key)
+	l.Lock()
+	return func() {
+		l.Unlock()
+		km.release(key, l)
+	}
+}
+
+// TryLock is like Lock, but reports false instead of waiting when the mutex
+// for key is held
+func (km *KeyedMutex[K]) TryLock(key K) (unlock func(), ok bool) {
+	l := km.acquire(key)
+	if !l.TryLock() {
+		km.release(key, l)
+		return nil, false
+	}
+	return func() {
+		l.Unlock()
+		km.release(key, l)
+	}, true
+}
@@ -0,0 +1,38 @@
+package sync_test
+
+import (
+	"testing"
+
+	"github.com/hannahhoward/go-genserver/sync"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKeyedMutex(t *testing.T) {
+	var km sync.KeyedMutex[string]
+	unlockA := km.Lock("a")
+	_, ok := km.TryLock("a")
+	require.False(t, ok)
+
+	// other keys are independent
+	unlockB, ok := km.TryLock("b")
+	require.True(t, ok)
+	unlockB()
+
+	locked := make(chan struct{})
+	go func() {
+		unlock := km.Lock("a")
+		close(locked)
+		unlock()
+	}()
+	select {
+	case <-locked:
+		t.Fatal("locked a held mutex")
+	default:
+	}
+	unlockA()
+	<-locked
+
+	unlockA, ok = km.TryLock("a")
+	require.True(t, ok)
+	unlockA()
+}
@@ -0,0 +1,41 @@
+package sync
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"time"
+)
+
+// StaleLockFile is how old a lock file must be before LockFile takes it to
+// have been left by a process that crashed while holding it
+const StaleLockFile = 10 * time.Second
+
+// LockFile locks path across processes by creating it exclusively, waiting
+// while another process holds it, and returns a function that unlocks it by
+// removing the file. Lock files older than StaleLockFile are replaced, so the
+// lock must only be held for short critical sections.
+func LockFile(path string) (unlock func(), err error) {
+	for {
+		file, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o644)
+		if err == nil {
+			file.Close()
+			return func() { os.Remove(path) }, nil
+		}
+		if !errors.Is(err, fs.ErrExist) {
+			return nil, err
+		}
+		info, err := os.Stat(path)
+		switch {
+		case errors.Is(err, fs.ErrNotExist):
+			// unlocked since
+			continue
+		case err != nil:
+			return nil, err
+		case time.Since(info.ModTime()) > StaleLockFile:
+			os.Remove(path)
+			continue
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,42 @@
+package sync_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hannahhoward/go-genserver/sync"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLockFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "lock")
+	unlock, err := sync.LockFile(path)
+	require.NoError(t, err)
+
+	locked := make(chan struct{})
+	go func() {
+		unlock, err := sync.LockFile(path)
+		require.NoError(t, err)
+		close(locked)
+		unlock()
+	}()
+	select {
+	case <-locked:
+		t.Fatal("locked a held lock file")
+	case <-time.After(10 * time.Millisecond):
+	}
+	unlock()
+	<-locked
+	_, err = os.Stat(path)
+	require.ErrorIs(t, err, os.ErrNotExist)
+
+	// a lock file left by a crash is replaced once it is stale
+	require.NoError(t, os.WriteFile(path, nil, 0o644))
+	old := time.Now().Add(-2 * sync.StaleLockFile)
+	require.NoError(t, os.Chtimes(path, old, old))
+	unlock, err = sync.LockFile(path)
+	require.NoError(t, err)
+	unlock()
+}
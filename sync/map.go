@@ -6,6 +6,14 @@ type Map[K, V any] struct {
 	sync.Map
 }
 
+func (m *Map[K, V]) CompareAndDelete(key K, old V) (deleted bool) {
+	return m.Map.CompareAndDelete(key, old)
+}
+
+func (m *Map[K, V]) CompareAndSwap(key K, old V, new V) (swapped bool) {
+	return m.Map.CompareAndSwap(key, old, new)
+}
+
 func (m *Map[K, V]) Delete(v K) {
 	m.Map.Delete(v)
 }
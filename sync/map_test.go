@@ -39,6 +39,16 @@ func TestMap(t *testing.T) {
 			require.Equal(t, 2, val)
 			require.True(t, loaded)
 		},
+		"compareAndSwap and compareAndDelete key": func(t *testing.T, testMap *sync.Map[int, int]) {
+			require.False(t, testMap.CompareAndSwap(5, 2, 4))
+			testMap.Store(5, 2)
+			require.False(t, testMap.CompareAndSwap(5, 3, 4))
+			require.True(t, testMap.CompareAndSwap(5, 2, 4))
+			require.False(t, testMap.CompareAndDelete(5, 2))
+			require.True(t, testMap.CompareAndDelete(5, 4))
+			_, exists := testMap.Load(5)
+			require.False(t, exists)
+		},
 	}
 	for testCase, test := range testCases {
 		t.Run(testCase, func(t *testing.T) {
@@ -0,0 +1,102 @@
+package tracing
+
+import (
+	"context"
+	gosync "sync"
+	"time"
+)
+
+// RecordedSpan is a span kept by a Recorder
+type RecordedSpan struct {
+	// ID is unique within the recorder, starting from 1
+	ID uint64
+	// Parent is the ID of the span in the context the span started from, or
+	// zero if there was none
+	Parent uint64
+	Name   string
+	// Info describes the message of spans started by servers, and is empty
+	// for spans started with StartSpan
+	Info  Info
+	Start time.Time
+	// End is zero while the span is open
+	End time.Time
+	Err error
+}
+
+type spanKey struct{}
+
+// Recorder keeps every span in memory, for tests. Spans started with
+// StartSpan and by servers form one tree through their contexts.
+type Recorder struct {
+	lock   gosync.Mutex
+	spans  []*RecordedSpan
+	nextID uint64
+}
+
+var _ Tracer = (*Recorder)(nil)
+
+// NewRecorder returns a recorder without spans
+func NewRecorder() *Recorder {
+	return &Recorder{}
+}
+
+// Start starts the span of a message, named after its server kind and
+// message type
+func (r *Recorder) Start(ctx context.Context, info Info) (context.Context, Span) {
+	return r.start(ctx, info.Kind+" "+info.Operation+" "+info.Message, info)
+}
+
+// StartSpan starts a span named name, for example for a request that sends
+// messages, or for work a handler does
+func (r *Recorder) StartSpan(ctx context.Context, name string) (context.Context, Span) {
+	return r.start(ctx, name, Info{})
+}
+
+func (r *Recorder) start(ctx context.Context, name string, info Info) (context.Context, Span) {
+	parent, _ := ctx.Value(spanKey{}).(uint64)
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.nextID++
+	span := &RecordedSpan{
+		ID:     r.nextID,
+		Parent: parent,
+		Name:   name,
+		Info:   info,
+		Start:  time.Now(),
+	}
+	r.spans = append(r.spans, span)
+	return context.WithValue(ctx, spanKey{}, span.ID), recordedEnd{r, span}
+}
+
+type recordedEnd struct {
+	r    *Recorder
+	span *RecordedSpan
+}
+
+func (e recordedEnd) End(err error) {
+	e.r.lock.Lock()
+	defer e.r.lock.Unlock()
+	if e.span.End.IsZero() {
+		e.span.End = time.Now()
+		e.span.Err = err
+	}
+}
+
+// Spans returns copies of the spans recorded so far, in the order they
+// started
+func (r *Recorder) Spans() []RecordedSpan {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	spans := make([]RecordedSpan, 0, len(r.spans))
+	for _, span := range r.spans {
+		spans = append(spans, *span)
+	}
+	return spans
+}
+
+// Reset forgets every span
+func (r *Recorder) Reset() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.spans = nil
+}
@@ -0,0 +1,75 @@
+package tracing_test
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/hannahhoward/go-genserver/genserver"
+	"github.com/hannahhoward/go-genserver/group"
+	"github.com/hannahhoward/go-genserver/store/memory"
+	"github.com/hannahhoward/go-genserver/tracing"
+	"github.com/stretchr/testify/require"
+)
+
+type PrintableInt int
+
+func (p PrintableInt) String() string {
+	return strconv.Itoa(int(p))
+}
+
+type counter struct {
+	Current int
+}
+
+func TestRecorder(t *testing.T) {
+	recorder := tracing.NewRecorder()
+	g := group.New[PrintableInt, counter]("counter", memory.NewStore[PrintableInt, counter](),
+		group.WithGenServerOptions(genserver.WithTracer[PrintableInt, counter](recorder)))
+	defer g.Stop(context.Background())
+
+	// a request sends a call, whose handler does work of its own
+	ctx, request := recorder.StartSpan(context.Background(), "request")
+	total, err := group.CallWithContext(ctx, g, 1, 2, func(ctx context.Context, c *counter, amt int) (int, error) {
+		_, work := recorder.StartSpan(ctx, "work")
+		defer work.End(nil)
+		c.Current += amt
+		return c.Current, nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, 2, total)
+	errBoom := errors.New("boom")
+	require.NoError(t, group.CastContext(ctx, g, 1, 1, func(c *counter, amt int) error {
+		return errBoom
+	}))
+	request.End(nil)
+
+	require.Eventually(t, func() bool {
+		spans := recorder.Spans()
+		return len(spans) == 4 && !spans[3].End.IsZero()
+	}, time.Second, time.Millisecond)
+	spans := recorder.Spans()
+	require.Equal(t, "request", spans[0].Name)
+	require.Zero(t, spans[0].Parent)
+
+	call := spans[1]
+	require.Equal(t, "counter call int", call.Name)
+	require.Equal(t, spans[0].ID, call.Parent)
+	require.Equal(t, tracing.Info{Kind: "counter", ID: "1", Operation: "call", Message: "int", Wait: call.Info.Wait}, call.Info)
+	require.GreaterOrEqual(t, call.Info.Wait, time.Duration(0))
+	require.NoError(t, call.Err)
+
+	require.Equal(t, "work", spans[2].Name)
+	require.Equal(t, call.ID, spans[2].Parent)
+	require.False(t, spans[2].End.After(call.End))
+
+	cast := spans[3]
+	require.Equal(t, "cast", cast.Info.Operation)
+	require.Equal(t, spans[0].ID, cast.Parent)
+	require.ErrorIs(t, cast.Err, errBoom)
+
+	recorder.Reset()
+	require.Empty(t, recorder.Spans())
+}
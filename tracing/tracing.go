@@ -0,0 +1,48 @@
+// Package tracing defines how servers report a span for each message they
+// handle, so the work of a message can be correlated with whatever sent it
+package tracing
+
+import (
+	"context"
+	"time"
+)
+
+// Info describes a message a server is about to handle
+type Info struct {
+	// Kind and ID identify the server
+	Kind string
+	ID   string
+	// Operation is "call", "cast", "get" or "shutdown"
+	Operation string
+	// Message is the Go type of the message
+	Message string
+	// Wait is how long the message waited in the mailbox
+	Wait time.Duration
+}
+
+// Span is the span of a single message
+type Span interface {
+	// End finishes the span, with the error that failed the message, if any
+	End(err error)
+}
+
+// Tracer starts a span for each message a server handles. ctx is the context
+// the message was sent with, so the span can be a child of the sender's. The
+// returned context is passed to context-aware handlers, which can start
+// child spans from it. Implementations must be safe for concurrent use.
+type Tracer interface {
+	Start(ctx context.Context, info Info) (context.Context, Span)
+}
+
+// Nop starts spans that record nothing
+type Nop struct{}
+
+var _ Tracer = Nop{}
+
+func (Nop) Start(ctx context.Context, _ Info) (context.Context, Span) {
+	return ctx, nopSpan{}
+}
+
+type nopSpan struct{}
+
+func (nopSpan) End(error) {}